@@ -0,0 +1,298 @@
+/*
+Package acl checks the visitors of a tunnel against allow and deny rules on this
+side of the tunnel. The rules can match the visitor network, the country of the
+visitor from a local GeoIP database (MMDB format, such as GeoLite2-Country) and
+the time of the connection.
+*/
+package acl
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/internal/mmdb"
+)
+
+/*
+TimeWindow matches the times between Start and End on the given days. Start and
+End are durations since midnight. A window whose End is before Start spans
+midnight, such as 22:00 to 06:00; the day is the day on which it starts.
+*/
+type TimeWindow struct {
+	// Days of the window. Empty means every day.
+	Days []time.Weekday
+
+	Start time.Duration
+	End   time.Duration
+
+	// Location of the times. Default is the local time.
+	Location *time.Location
+}
+
+func (w *TimeWindow) matchDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Contains tells if t is in the window.
+*/
+func (w *TimeWindow) Contains(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	if w.Start <= w.End {
+		return w.matchDay(t.Weekday()) && since >= w.Start && since < w.End
+	}
+	if since >= w.Start {
+		return w.matchDay(t.Weekday())
+	}
+	return since < w.End && w.matchDay((t.Weekday()+6)%7)
+}
+
+/*
+Rule allows or denies visitors. A rule matches when all of its non-empty fields
+match the visitor.
+*/
+type Rule struct {
+	Allow bool
+
+	// Visitor networks, such as 203.0.113.0/24. The visitor has to be in one of them.
+	Networks []*net.IPNet
+
+	// ISO country codes, such as "DE". The country of the visitor has to be one of
+	// them. It needs GeoIPDatabase; visitors of unknown country do not match.
+	Countries []string
+
+	// The connection has to be made during the window.
+	Window *TimeWindow
+}
+
+/*
+Config of an ACL.
+*/
+type Config struct {
+	// Rules are checked in order and the first matching one decides. Visitors
+	// matching no rule are allowed unless DefaultDeny is set.
+	Rules       []Rule
+	DefaultDeny bool
+
+	// Path of the MMDB file used for the country rules.
+	GeoIPDatabase string
+
+	// Logger for the rejected visitors. Default logger is used if it is nil.
+	Logger *log.Logger
+}
+
+/*
+Stats counts the visitors checked by an ACL.
+*/
+type Stats struct {
+	Allowed  uint64
+	Rejected uint64
+}
+
+/*
+ACL checks visitors against a Config. The config can be replaced at any time with
+Update.
+*/
+type ACL struct {
+	allowed  uint64
+	rejected uint64
+
+	lock  sync.Mutex
+	conf  Config
+	geoip *mmdb.Reader
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+/*
+New returns an ACL for conf. It fails if the GeoIP database cannot be loaded.
+*/
+func New(conf Config) (*ACL, error) {
+	a := &ACL{now: time.Now}
+	err := a.Update(conf)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+/*
+Update replaces the config. The GeoIP database is loaded again, so that an updated
+file takes effect. The old config is kept if it fails.
+*/
+func (a *ACL) Update(conf Config) error {
+	var geoip *mmdb.Reader
+	if conf.GeoIPDatabase != "" {
+		var err error
+		geoip, err = mmdb.Open(conf.GeoIPDatabase)
+		if err != nil {
+			return fmt.Errorf("cannot load geoip database: %v", err)
+		}
+	}
+	for i, rule := range conf.Rules {
+		if len(rule.Countries) > 0 && geoip == nil {
+			return fmt.Errorf("acl rule %d: country rules need a geoip database", i)
+		}
+	}
+	if conf.Logger == nil {
+		conf.Logger = log.Default()
+	}
+
+	a.lock.Lock()
+	a.conf = conf
+	a.geoip = geoip
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *ACL) Config() Config {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.conf
+}
+
+func (a *ACL) Stats() Stats {
+	return Stats{
+		Allowed:  atomic.LoadUint64(&a.allowed),
+		Rejected: atomic.LoadUint64(&a.rejected),
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (a *ACL) country(geoip *mmdb.Reader, ip net.IP) string {
+	country, err := geoip.LookupString(ip, "country", "iso_code")
+	if err == nil && country == "" {
+		country, err = geoip.LookupString(ip, "registered_country", "iso_code")
+	}
+	if err != nil {
+		return ""
+	}
+	return country
+}
+
+func (a *ACL) matches(rule *Rule, geoip *mmdb.Reader, ip net.IP, now time.Time) bool {
+	if len(rule.Networks) > 0 {
+		found := false
+		for _, network := range rule.Networks {
+			if ip != nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Countries) > 0 {
+		if ip == nil || geoip == nil {
+			return false
+		}
+		country := a.country(geoip, ip)
+		found := false
+		for _, c := range rule.Countries {
+			if country != "" && strings.EqualFold(c, country) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Window != nil && !rule.Window.Contains(now) {
+		return false
+	}
+	return true
+}
+
+/*
+Check tells if the visitor is allowed. The error explains a rejection. Rejections
+are logged and counted in Stats.
+*/
+func (a *ACL) Check(visitor net.Addr) error {
+	a.lock.Lock()
+	conf := a.conf
+	geoip := a.geoip
+	a.lock.Unlock()
+
+	ip := addrIP(visitor)
+	now := a.now()
+	allow := !conf.DefaultDeny
+	reason := "default rule"
+	for i := range conf.Rules {
+		if a.matches(&conf.Rules[i], geoip, ip, now) {
+			allow = conf.Rules[i].Allow
+			reason = fmt.Sprintf("rule %d", i)
+			break
+		}
+	}
+
+	if allow {
+		atomic.AddUint64(&a.allowed, 1)
+		return nil
+	}
+	atomic.AddUint64(&a.rejected, 1)
+	err := fmt.Errorf("visitor %v denied by %s", visitor, reason)
+	conf.Logger.Printf("acl: %v\n", err)
+	return err
+}
+
+/*
+Listener returns a listener which closes the connections of the visitors who are
+not allowed and accepts the next one instead.
+*/
+func (a *ACL) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, acl: a}
+}
+
+type listener struct {
+	net.Listener
+	acl *ACL
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.Check(conn.RemoteAddr()) != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,155 @@
+package acl
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/internal/mmdb"
+)
+
+func visitor(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := mmdb.BuildCountryDatabase(map[string]string{
+		"203.0.113.0/24":  "DE",
+		"198.51.100.0/24": "FR",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "country.mmdb")
+	err = ioutil.WriteFile(dbPath, db, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Config{
+		Rules: []Rule{
+			{Allow: false, Networks: []*net.IPNet{mustCIDR("203.0.113.128/25")}},
+			{Allow: true, Countries: []string{"de"}},
+			{Allow: true, Networks: []*net.IPNet{mustCIDR("192.0.2.0/24")}, Window: &TimeWindow{Start: 9 * time.Hour, End: 17 * time.Hour, Location: time.UTC}},
+		},
+		DefaultDeny:   true,
+		GeoIPDatabase: dbPath,
+		Logger:        log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC) }
+
+	tests := map[string]bool{
+		"203.0.113.1":   true,
+		"203.0.113.200": false,
+		"198.51.100.1":  false,
+		"192.0.2.1":     true,
+		"10.0.0.1":      false,
+	}
+	for ip, expected := range tests {
+		if err := a.Check(visitor(ip)); (err == nil) != expected {
+			t.Errorf("%s: expected allowed %v, got %v", ip, expected, err)
+		}
+	}
+
+	a.now = func() time.Time { return time.Date(2024, 5, 6, 18, 0, 0, 0, time.UTC) }
+	if a.Check(visitor("192.0.2.1")) == nil {
+		t.Errorf("expected rejection outside the time window")
+	}
+
+	stats := a.Stats()
+	if stats.Allowed != 2 || stats.Rejected != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// Country rules without a database are refused and the old config is kept.
+	err = a.Update(Config{Rules: []Rule{{Countries: []string{"FR"}}}})
+	if err == nil {
+		t.Fatalf("expected error for country rule without database")
+	}
+	if !a.Config().DefaultDeny {
+		t.Errorf("config changed by failed update")
+	}
+
+	err = a.Update(Config{Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Check(visitor("10.0.0.1")); err != nil {
+		t.Errorf("expected allowed after update: %v", err)
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	night := &TimeWindow{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC}
+	tests := map[time.Time]bool{
+		time.Date(2024, 5, 10, 23, 0, 0, 0, time.UTC): true,  // Friday night
+		time.Date(2024, 5, 11, 5, 0, 0, 0, time.UTC):  true,  // Saturday morning
+		time.Date(2024, 5, 11, 7, 0, 0, 0, time.UTC):  false, // Saturday
+		time.Date(2024, 5, 11, 23, 0, 0, 0, time.UTC): false, // Saturday night
+		time.Date(2024, 5, 10, 5, 0, 0, 0, time.UTC):  false, // Friday morning
+	}
+	for now, expected := range tests {
+		if night.Contains(now) != expected {
+			t.Errorf("%v: expected %v", now, expected)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	a, err := New(Config{
+		Rules:  []Rule{{Allow: false, Networks: []*net.IPNet{mustCIDR("127.0.0.0/8")}}},
+		Logger: log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := a.Listener(l)
+	defer acl.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		acl.Close()
+	}()
+	_, err = acl.Accept()
+	if err == nil {
+		t.Fatalf("expected the rejected connection not to be accepted")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("expected the rejected connection to be closed")
+	}
+	if a.Stats().Rejected != 1 {
+		t.Errorf("unexpected stats: %+v", a.Stats())
+	}
+}
@@ -0,0 +1,79 @@
+package pinggy_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/acl"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func TestAccessControl(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	_, denied, _ := net.ParseCIDR("203.0.113.0/24")
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	conf.AccessControl = acl.Config{
+		Rules: []acl.Rule{{Allow: false, Networks: []*net.IPNet{denied}}},
+	}
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(visitor string) bool {
+		conn, err := srv.Tunnels()[0].DialTCP(visitor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		select {
+		case c := <-accepted:
+			c.Close()
+			return true
+		case <-time.After(300 * time.Millisecond):
+			return false
+		}
+	}
+
+	if dial("203.0.113.7:4000") {
+		t.Errorf("denied visitor was accepted")
+	}
+	if !dial("198.51.100.7:4000") {
+		t.Errorf("allowed visitor was not accepted")
+	}
+
+	err = pl.ACL().Update(acl.Config{DefaultDeny: true, Logger: conf.Logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dial("198.51.100.7:4000") {
+		t.Errorf("visitor accepted after the rules were updated")
+	}
+
+	stats := pl.ACL().Stats()
+	if stats.Allowed != 1 || stats.Rejected != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
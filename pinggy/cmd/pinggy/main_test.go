@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/internal/headermanipulation"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func parseConfig(t *testing.T, command string, args ...string) (pinggy.Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := &options{}
+	opts.register(fs, command == "http" || command == "serve")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return opts.config(command)
+}
+
+func TestConfig(t *testing.T) {
+	conf, err := parseConfig(t, "http",
+		"-token", "tok", "-server", "eu.a.pinggy.io:443", "-proxy", "http://proxy:3128",
+		"-ssl", "-force", "-timeout", "5s", "-ssh-timeout", "7s",
+		"-whitelist", "1.2.3.4", "-whitelist", "2001:db8::/32",
+		"-local-tls-sni", "local.example.com", "-quiet",
+		"-basic-auth", "user:pass", "-bearer-auth", "key",
+		"-header-add", "X-Add: 1", "-header-remove", "X-Remove", "-header-update", "X-Update: 2",
+		"-hostname", "Example.com", "-https-only", "-full-url", "-pass-preflight",
+		"-no-reverse-proxy", "-xff", "X-Real-IP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Type != pinggy.HTTP || conf.AltType != "" {
+		t.Errorf("unexpected types %q %q", conf.Type, conf.AltType)
+	}
+	if conf.Token != "tok" || conf.Server != "eu.a.pinggy.io:443" || !conf.SshOverSsl || !conf.Force {
+		t.Errorf("unexpected connection config %+v", conf)
+	}
+	if conf.Timeout != 5*time.Second || conf.SshTimeout != 7*time.Second {
+		t.Errorf("unexpected timeouts %v %v", conf.Timeout, conf.SshTimeout)
+	}
+	if conf.Proxy == nil || conf.Proxy.Host != "proxy:3128" {
+		t.Errorf("unexpected proxy %v", conf.Proxy)
+	}
+	if len(conf.IpWhiteList) != 2 || conf.IpWhiteList[0].String() != "1.2.3.4/32" || conf.IpWhiteList[1].String() != "2001:db8::/32" {
+		t.Errorf("unexpected whitelist %v", conf.IpWhiteList)
+	}
+	if fc := conf.ForwardedConnectionConf; fc == nil || !fc.TlsLocalServer || fc.TlsLocalServerSNI != "local.example.com" {
+		t.Errorf("unexpected forwarded connection config %+v", fc)
+	}
+	if conf.Logger == nil {
+		t.Error("quiet logger not set")
+	}
+
+	data, err := conf.HeaderManipulationAndAuth.ListHeaderManipulations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hm headermanipulation.HttpHeaderManipulationAndAuthConfig
+	if err := json.Unmarshal(data, &hm); err != nil {
+		t.Fatal(err)
+	}
+	if hm.HostName != "example.com" || !hm.HttpsOnly || !hm.FullRequestUrl || !hm.PassPreflight {
+		t.Errorf("unexpected header manipulation %s", data)
+	}
+	if hm.XFF != "X-Real-IP" || hm.XFH || hm.XFP || hm.Forwarded {
+		t.Errorf("unexpected reverse proxy headers %s", data)
+	}
+	if len(hm.BasicAuths) != 1 || !hm.BasicAuths["dXNlcjpwYXNz"] || len(hm.BearerAuths) != 1 || !hm.BearerAuths["key"] {
+		t.Errorf("unexpected authentication %s", data)
+	}
+	if h := hm.Headers["x-add"]; h == nil || h.Remove || len(h.NewValues) != 1 || h.NewValues[0] != "1" {
+		t.Errorf("unexpected added header %s", data)
+	}
+	if h := hm.Headers["x-remove"]; h == nil || !h.Remove || len(h.NewValues) != 0 {
+		t.Errorf("unexpected removed header %s", data)
+	}
+	if h := hm.Headers["x-update"]; h == nil || !h.Remove || len(h.NewValues) != 1 || h.NewValues[0] != "2" {
+		t.Errorf("unexpected updated header %s", data)
+	}
+
+	for command, want := range map[string]pinggy.Config{
+		"tcp":    {Type: pinggy.TCP},
+		"tls":    {Type: pinggy.TLS},
+		"tlstcp": {Type: pinggy.TLSTCP},
+		"udp":    {AltType: pinggy.UDP},
+		"serve":  {Type: pinggy.HTTP},
+	} {
+		conf, err := parseConfig(t, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.Type != want.Type || conf.AltType != want.AltType || conf.HeaderManipulationAndAuth != nil {
+			t.Errorf("%s: unexpected config %+v", command, conf)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-proxy", "://proxy"},
+		{"-whitelist", "1.2.3"},
+		{"-basic-auth", "user"},
+		{"-header-add", "X-Add"},
+		{"-header-remove", "Host"},
+	} {
+		if _, err := parseConfig(t, "http", args...); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Tokens = []string{"tok"}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The token is in use by another tunnel.
+	conf := srv.Config()
+	conf.Token = "tok"
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"ftp"}, exitUsage},
+		{[]string{"tcp", "-unknown"}, exitUsage},
+		{[]string{"tcp", "3000", "4000"}, exitUsage},
+		{[]string{"tcp"}, exitUsage},
+		{[]string{"serve"}, exitUsage},
+		{[]string{"tcp", "-whitelist", "1.2.3", "3000"}, exitConfig},
+		{[]string{"serve", "does-not-exist"}, exitConfig},
+		{[]string{"tcp", "-quiet", "-server", "a.pinggy.io:ssh", "3000"}, exitConfig},
+		{[]string{"tcp", "-quiet", "-server", closed, "3000"}, exitConnect},
+		{[]string{"tcp", "-quiet", "-server", srv.Addr, "-token", "bad", "3000"}, exitAuth},
+		{[]string{"tcp", "-quiet", "-server", srv.Addr, "-token", "tok", "3000"}, exitTunnel},
+	}
+	for _, test := range tests {
+		if code := exitCode(run(test.args)); code != test.code {
+			t.Errorf("%v: exit code %d, expected %d", test.args, code, test.code)
+		}
+	}
+}
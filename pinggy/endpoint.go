@@ -0,0 +1,190 @@
+package pinggy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+Endpoint is a public address of the tunnel.
+*/
+type Endpoint struct {
+	// Protocol is the scheme of the url. It is one of http, https, tcp, tls or udp.
+	Protocol string
+
+	Host string
+	Port int
+
+	// Primary is false for the domains added with StartAdditionalForwarding.
+	Primary bool
+
+	// Url as received from the server.
+	Url string
+}
+
+/*
+Addr returns the endpoint as net.Addr. The network is udp for udp endpoints and tcp otherwise.
+*/
+func (e Endpoint) Addr() net.Addr {
+	network := "tcp"
+	if e.Protocol == "udp" {
+		network = "udp"
+	}
+	return &TunnelAddr{Net: network, Host: e.Host, Port: e.Port}
+}
+
+/*
+TunnelAddr is the public address of a tunnel. Unlike net.TCPAddr it keeps the
+hostname as the ip of a tunnel is not stable.
+*/
+type TunnelAddr struct {
+	Net  string
+	Host string
+	Port int
+}
+
+func (ta *TunnelAddr) Network() string { return ta.Net }
+func (ta *TunnelAddr) String() string  { return net.JoinHostPort(ta.Host, strconv.Itoa(ta.Port)) }
+
+var defaultPorts = map[string]int{
+	"http":  80,
+	"https": 443,
+	"tls":   443,
+}
+
+/*
+Parse a tunnel url such as `https://abc.a.pinggy.link` or `tcp://abc.a.pinggy.link:40000`.
+*/
+func ParseEndpoint(rawUrl string) (Endpoint, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if u.Scheme == "" || u.Hostname() == "" {
+		return Endpoint{}, fmt.Errorf("invalid tunnel url: %s", rawUrl)
+	}
+	ep := Endpoint{
+		Protocol: strings.ToLower(u.Scheme),
+		Host:     u.Hostname(),
+		Primary:  true,
+		Url:      rawUrl,
+	}
+	if u.Port() != "" {
+		ep.Port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("invalid port in tunnel url: %s", rawUrl)
+		}
+	} else if port, ok := defaultPorts[ep.Protocol]; ok {
+		ep.Port = port
+	} else {
+		return Endpoint{}, fmt.Errorf("port missing in tunnel url: %s", rawUrl)
+	}
+	return ep, nil
+}
+
+/*
+parseEndpoints parses the urls received from the server. Urls which cannot be
+parsed are logged and skipped.
+*/
+func (pl *pinggyListener) parseEndpoints(urls []string) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(urls))
+	for _, u := range urls {
+		ep, err := ParseEndpoint(u)
+		if err != nil {
+			pl.conf.Logger.Println("Skipping tunnel url:", err)
+			continue
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+func (pl *pinggyListener) Endpoints() ([]Endpoint, error) {
+	urls, err := pl.getConnectionUrl()
+	if err != nil {
+		return nil, err
+	}
+	endpoints := pl.parseEndpoints(urls)
+
+	pl.lock.Lock()
+	domains := make([]string, 0, len(pl.additionalForwardings))
+	for domain := range pl.additionalForwardings {
+		domains = append(domains, domain)
+	}
+	pl.lock.Unlock()
+
+	primary := endpoints
+	for _, domain := range domains {
+		host, _, err := net.SplitHostPort(domain)
+		if err != nil {
+			host = domain
+		}
+		endpoints = append(endpoints, domainEndpoints(primary, host)...)
+	}
+
+	return endpoints, nil
+}
+
+/*
+domainEndpoints returns the endpoints of a domain forwarded over the same
+connection. The domain is served the same way as the primary http endpoints, so
+it gets the same protocols and ports.
+*/
+func domainEndpoints(primary []Endpoint, host string) []Endpoint {
+	var endpoints []Endpoint
+	for _, ep := range primary {
+		if !ep.Primary || (ep.Protocol != "http" && ep.Protocol != "https") {
+			continue
+		}
+		u := ep.Protocol + "://" + host
+		if ep.Port != defaultPorts[ep.Protocol] {
+			u += ":" + strconv.Itoa(ep.Port)
+		}
+		endpoints = append(endpoints, Endpoint{
+			Protocol: ep.Protocol,
+			Host:     host,
+			Port:     ep.Port,
+			Primary:  false,
+			Url:      u,
+		})
+	}
+	return endpoints
+}
+
+/*
+resolveEndpoints fetches the urls of the tunnel, or returns nil if they are not
+available. It is called once per connection, so that Addr and PublicAddr do not
+have to ask the server.
+*/
+func (pl *pinggyListener) resolveEndpoints() []Endpoint {
+	urls, err := pl.getConnectionUrl()
+	if err != nil {
+		return nil
+	}
+	return pl.parseEndpoints(urls)
+}
+
+/*
+publicAddr finds the primary endpoint for the given protocols in the order of preference.
+*/
+func (pl *pinggyListener) publicAddr(protocols ...string) net.Addr {
+	pl.lock.Lock()
+	endpoints := pl.endpoints
+	pl.lock.Unlock()
+
+	for _, protocol := range protocols {
+		for _, ep := range endpoints {
+			if ep.Primary && ep.Protocol == protocol {
+				return ep.Addr()
+			}
+		}
+	}
+	return nil
+}
+
+func (pl *pinggyListener) PublicAddr() net.Addr {
+	return pl.publicAddr("tcp", "tls", "udp", "https", "http")
+}
@@ -0,0 +1,130 @@
+package pinggy_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		url      string
+		protocol string
+		host     string
+		port     int
+		addr     string
+	}{
+		{"https://abc.a.pinggy.link", "https", "abc.a.pinggy.link", 443, "abc.a.pinggy.link:443"},
+		{"http://abc.a.pinggy.link", "http", "abc.a.pinggy.link", 80, "abc.a.pinggy.link:80"},
+		{"HTTPS://abc.a.pinggy.link:8443", "https", "abc.a.pinggy.link", 8443, "abc.a.pinggy.link:8443"},
+		{"tls://abc.a.pinggy.link", "tls", "abc.a.pinggy.link", 443, "abc.a.pinggy.link:443"},
+		{"tcp://abc.a.pinggy.link:40000", "tcp", "abc.a.pinggy.link", 40000, "abc.a.pinggy.link:40000"},
+		{"udp://[2001:db8::1]:40000", "udp", "2001:db8::1", 40000, "[2001:db8::1]:40000"},
+	}
+	for _, test := range tests {
+		ep, err := pinggy.ParseEndpoint(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if ep.Protocol != test.protocol || ep.Host != test.host || ep.Port != test.port || !ep.Primary || ep.Url != test.url {
+			t.Errorf("%s: unexpected endpoint %+v", test.url, ep)
+		}
+		network := "tcp"
+		if test.protocol == "udp" {
+			network = "udp"
+		}
+		if addr := ep.Addr(); addr.Network() != network || addr.String() != test.addr {
+			t.Errorf("%s: unexpected address %s/%s", test.url, addr.Network(), addr)
+		}
+	}
+
+	for _, url := range []string{
+		"",
+		"abc.a.pinggy.link",
+		"tcp://abc.a.pinggy.link",
+		"udp://abc.a.pinggy.link",
+		"https://:443",
+		"tcp://abc.a.pinggy.link:port",
+		"https://abc\x7f.a.pinggy.link",
+	} {
+		if ep, err := pinggy.ParseEndpoint(url); err == nil {
+			t.Errorf("%q: expected an error, got %+v", url, ep)
+		}
+	}
+}
+
+func TestTunnelEndpoints(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	connect := func(conf pinggy.Config) (pinggy.PinggyListener, *pinggytest.Tunnel) {
+		base := srv.Config()
+		base.Type = conf.Type
+		base.AltType = conf.AltType
+		base.Logger = log.New(io.Discard, "", 0)
+		pl, err := pinggy.ConnectWithConfig(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pl.Close() })
+		tunnels := srv.Tunnels()
+		return pl, tunnels[len(tunnels)-1]
+	}
+
+	for _, tc := range []struct {
+		conf     pinggy.Config
+		protocol string
+		network  string
+	}{
+		{pinggy.Config{Type: pinggy.TCP}, "tcp", "tcp"},
+		{pinggy.Config{AltType: pinggy.UDP}, "udp", "udp"},
+	} {
+		pl, tun := connect(tc.conf)
+		want := net.JoinHostPort(tun.Host, strconv.Itoa(tun.Port))
+
+		endpoints, err := pl.Endpoints()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(endpoints) != 1 || endpoints[0].Protocol != tc.protocol || endpoints[0].Host != tun.Host ||
+			endpoints[0].Port != tun.Port || !endpoints[0].Primary {
+			t.Fatalf("%s: unexpected endpoints %+v", tc.protocol, endpoints)
+		}
+		for _, addr := range []net.Addr{pl.PublicAddr(), pl.Addr()} {
+			if addr == nil || addr.Network() != tc.network || addr.String() != want {
+				t.Fatalf("%s: unexpected address %v, want %s", tc.protocol, addr, want)
+			}
+		}
+	}
+
+	// The additional domains follow the primary http endpoints.
+	pl, tun := connect(pinggy.Config{Type: pinggy.HTTP})
+	if err := pl.StartAdditionalForwarding("api.example.com", "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := pl.Endpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, ep := range endpoints {
+		if ep.Primary != (ep.Host == tun.Host) {
+			t.Fatalf("unexpected primary flag %+v", ep)
+		}
+		urls = append(urls, ep.Url)
+	}
+	if len(urls) != 4 || urls[0] != "http://"+tun.Host || urls[3] != "https://api.example.com" {
+		t.Fatalf("unexpected endpoints %v", urls)
+	}
+	if addr := pl.Addr().String(); addr != tun.Host+":443" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+}
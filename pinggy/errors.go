@@ -0,0 +1,38 @@
+package pinggy
+
+/*
+ConnectError is returned when the ssh connection to the server could not be
+established, such as when the server is not reachable or the handshake failed.
+*/
+type ConnectError struct {
+	// Address of the server. It is empty when none of Config.Servers could be
+	// connected.
+	Server string
+
+	Err error
+}
+
+func (e *ConnectError) Error() string { return e.Err.Error() }
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+/*
+TunnelError is returned when the server refused the tunnel after the ssh
+connection was established. Authenticated is false when the token was rejected.
+*/
+type TunnelError struct {
+	Message       string
+	Authenticated bool
+}
+
+func (e *TunnelError) Error() string { return e.Message }
+
+/*
+ConfigError is returned when the Config is invalid, such as a server address with
+an invalid port. Nothing is connected in this case.
+*/
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.LstdFlags)
+	srv := pinggytest.NewServer()
+	defer srv.Close()
+
+	conf := srv.Config()
+	conf.Type = pinggy.HTTP
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer pl.Close()
+	log.Println("Addrs: ", pl.RemoteUrls())
+
+	go http.Serve(pl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello visitor %s\n", r.RemoteAddr)
+	}))
+
+	res, err := srv.HTTPClient().Get(pl.RemoteUrls()[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	log.Print(string(body))
+}
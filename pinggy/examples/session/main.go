@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.LstdFlags)
+	sess, err := pinggy.NewSession(pinggy.Config{Server: "a.pinggy.io:443", Token: "noscreen", Type: pinggy.HTTP})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer sess.Close()
+
+	tunnels := []pinggy.TunnelConfig{
+		{TcpForwardingAddr: "127.0.0.1:3000"},
+		{Domain: "api.example.com", TcpForwardingAddr: "127.0.0.1:3001"},
+		{Domain: "admin.example.com", TcpForwardingAddr: "127.0.0.1:3002"},
+	}
+
+	done := make(chan error)
+	for _, tc := range tunnels {
+		pl, err := sess.Listen(tc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("Addrs: ", pl.RemoteUrls())
+		go func() { done <- pl.StartForwarding() }()
+	}
+
+	for range tunnels {
+		log.Println(<-done)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.LstdFlags)
+	pl, err := pinggy.ConnectWithConfig(pinggy.Config{Server: "a.pinggy.io:443", Token: "noscreen", Type: pinggy.TCP})
+	if err != nil {
+		log.Panicln(err)
+	}
+	log.Println("Addrs: ", pl.RemoteUrls())
+
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	err = pl.ServeSocks5(socks.ServerConfig{
+		Validator:   socks.StaticCredentials{"user": "pass"},
+		Rules:       []socks.Rule{{Allow: true, Network: lan}},
+		DefaultDeny: true,
+	})
+	log.Println(err)
+}
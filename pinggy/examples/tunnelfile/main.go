@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnelfile"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.LstdFlags)
+	if len(os.Args) < 2 {
+		log.Fatalln("usage: tunnelfile <tunnels.yaml>")
+	}
+	listeners, err := tunnelfile.StartFile(os.Args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, pl := range listeners {
+		log.Println("Addrs: ", pl.RemoteUrls())
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+
+	for _, pl := range listeners {
+		pl.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.LstdFlags)
+	pl, err := pinggy.ConnectWithConfig(pinggy.Config{Server: "a.pinggy.io:443", TcpForwardingAddr: "127.0.0.1:4000"})
+	if err != nil {
+		log.Panicln(err)
+	}
+	log.Println("Addrs: ", pl.RemoteUrls())
+
+	_, err = pinggy.WatchUsages(pl, pinggy.UsageAlertConfig{
+		TunnelLifetime:   60 * time.Minute,
+		TimeRemaining:    5 * time.Minute,
+		ReconnectBefore:  time.Minute,
+		BandwidthUsed:    100 * 1024 * 1024,
+		TotalConnections: 1000,
+		WebhookUrl:       "http://localhost:9000/alerts",
+		OnAlert: func(alert pinggy.UsageAlert) {
+			log.Println("Alert:", alert.Type, alert.Value, alert.Error)
+			if alert.Type == pinggy.UsageAlert_Reconnected {
+				log.Println("New addrs: ", pl.RemoteUrls())
+			}
+		},
+	})
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	log.Println(pl.StartForwarding())
+}
@@ -0,0 +1,3 @@
+package pinggy
+
+var ParseServerAddr = parseServerAddr
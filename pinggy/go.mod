@@ -5,6 +5,11 @@ go 1.16
 // require golang.org/x/crypto v0.8.0
 require golang.org/x/crypto v0.23.0
 
+require (
+	github.com/BurntSushi/toml v1.3.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 replace golang.org/x/crypto => github.com/abhimp/GoCrypto v0.0.0-20240721151748-a09ecffc8004
 
 retract v0.0.0-20240101024325-6bb8db62dbef
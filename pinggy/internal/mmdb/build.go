@@ -0,0 +1,103 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+/*
+BuildCountryDatabase returns a small IPv4 country database in the format of
+GeoLite2-Country. It maps networks such as "203.0.113.0/24" to ISO country
+codes. It is meant for tests.
+*/
+func BuildCountryDatabase(countries map[string]string) ([]byte, error) {
+	const empty = -1
+	type node struct{ records [2]int }
+	// Records are node indexes, empty, or -2-n for the n-th data offset.
+	nodes := []*node{{records: [2]int{empty, empty}}}
+
+	var data bytes.Buffer
+	offsets := map[string]int{}
+	for network, country := range countries {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		ip := ipnet.IP.To4()
+		ones, _ := ipnet.Mask.Size()
+		if ip == nil || ones == 0 {
+			return nil, fmt.Errorf("unsupported network: %s", network)
+		}
+		if _, ok := offsets[country]; !ok {
+			offsets[country] = data.Len()
+			data.Write(encodeMap(map[string][]byte{
+				"country": encodeMap(map[string][]byte{"iso_code": encodeString(country)}),
+			}))
+		}
+
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[current].records[bit] = -2 - offsets[country]
+				break
+			}
+			next := nodes[current].records[bit]
+			if next < 0 {
+				nodes = append(nodes, &node{records: [2]int{empty, empty}})
+				next = len(nodes) - 1
+				nodes[current].records[bit] = next
+			}
+			current = next
+		}
+	}
+
+	nodeCount := len(nodes)
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, record := range n.records {
+			value := record
+			if record == empty {
+				value = nodeCount
+			} else if record < empty {
+				value = nodeCount + dataSectionSeparator + (-2 - record)
+			}
+			buf.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data.Bytes())
+	buf.Write(metadataMarker)
+	buf.Write(encodeMap(map[string][]byte{
+		"node_count":    encodeUint(typeUint32, uint64(nodeCount)),
+		"record_size":   encodeUint(typeUint16, 24),
+		"ip_version":    encodeUint(typeUint16, 4),
+		"database_type": encodeString("GeoLite2-Country"),
+	}))
+	return buf.Bytes(), nil
+}
+
+func encodeString(s string) []byte {
+	if len(s) >= 29 {
+		panic("string too long")
+	}
+	return append([]byte{byte(typeString<<5 | len(s))}, s...)
+}
+
+func encodeUint(typ int, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	value := bytes.TrimLeft(b[:], "\x00")
+	return append([]byte{byte(typ<<5 | len(value))}, value...)
+}
+
+func encodeMap(fields map[string][]byte) []byte {
+	buf := []byte{byte(typeMap<<5 | len(fields))}
+	for key, value := range fields {
+		buf = append(buf, encodeString(key)...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
@@ -0,0 +1,350 @@
+/*
+Package mmdb reads MaxMind DB files such as GeoLite2-Country.mmdb. Only what is
+needed to look up an ip address is implemented.
+*/
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const dataSectionSeparator = 16
+
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+}
+
+type Reader struct {
+	buf      []byte
+	data     []byte
+	Metadata Metadata
+
+	ipv4Start uint
+}
+
+/*
+Open reads the whole database file into memory.
+*/
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+func FromBytes(buf []byte) (*Reader, error) {
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid mmdb file: metadata not found")
+	}
+	meta := buf[idx+len(metadataMarker):]
+	value, _, err := (&decoder{buf: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata: %v", err)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid mmdb metadata")
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.NodeCount = uint(toUint(fields["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(fields["record_size"]))
+	r.Metadata.IPVersion = uint(toUint(fields["ip_version"]))
+	r.Metadata.DatabaseType, _ = fields["database_type"].(string)
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported mmdb record size: %d", r.Metadata.RecordSize)
+	}
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	if treeSize+dataSectionSeparator > uint(idx) {
+		return nil, fmt.Errorf("invalid mmdb file: search tree is larger than the file")
+	}
+	r.data = buf[treeSize+dataSectionSeparator : idx]
+
+	if r.Metadata.IPVersion == 6 {
+		// IPv4 addresses are in ::/96.
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or the right (bit 1) record of node.
+func (r *Reader) record(node uint, bit uint) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := r.buf[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := r.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[off : off+4]))
+	}
+}
+
+/*
+Lookup returns the record of ip, or nil if the database has no record for it.
+*/
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, fmt.Errorf("ipv6 address in an ipv4 database")
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("invalid ip address")
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(bits)*8 && node < nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == nodeCount {
+		return nil, nil
+	}
+	if node < nodeCount {
+		return nil, fmt.Errorf("invalid mmdb search tree")
+	}
+	offset := node - nodeCount - dataSectionSeparator
+	value, _, err := (&decoder{buf: r.data}).decode(offset, 0)
+	return value, err
+}
+
+/*
+LookupString follows path in the record of ip, e.g. "country", "iso_code". It
+returns an empty string if there is no such string.
+*/
+func (r *Reader) LookupString(ip net.IP, path ...string) (string, error) {
+	value, err := r.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range path {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return "", nil
+		}
+		value = fields[key]
+	}
+	str, _ := value.(string)
+	return str, nil
+}
+
+func toUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
+
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// Maximum nesting of the data, to protect against pointer loops.
+const maxDepth = 32
+
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+func uintFromBytes(b []byte) uint64 {
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+/*
+decode decodes the value at offset and returns it with the offset of the next
+value.
+*/
+func (d *decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+	ctrl, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := uint(ctrl[0] >> 5)
+
+	if typ == typePointer {
+		ss := uint(ctrl[0]>>3) & 0x3
+		b, err := d.bytes(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += ss + 1
+		var ptr uint
+		vvv := uint(ctrl[0] & 0x7)
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(b[0])
+		case 1:
+			ptr = (vvv<<16 | uint(uintFromBytes(b))) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(uintFromBytes(b))) + 526336
+		default:
+			ptr = uint(uintFromBytes(b))
+		}
+		value, _, err := d.decode(ptr, depth+1)
+		return value, offset, err
+	}
+
+	if typ == typeExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + uint(b[0])
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		b, err := d.bytes(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + uint(uintFromBytes(b))
+		default:
+			size = 65821 + uint(uintFromBytes(b))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		fields := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			fields[keyStr] = value
+		}
+		return fields, offset, nil
+	case typeArray:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+		}
+		return values, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEnd:
+		return nil, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size: %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size: %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size: %d", size)
+		}
+		return uintFromBytes(b), offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size: %d", size)
+		}
+		v := uintFromBytes(b)
+		if size == 4 {
+			return int64(int32(v)), offset, nil
+		}
+		return int64(v), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type: %d", typ)
+}
@@ -0,0 +1,64 @@
+package mmdb
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCountryLookup(t *testing.T) {
+	db, err := BuildCountryDatabase(map[string]string{
+		"203.0.113.0/24":  "DE",
+		"198.51.100.0/25": "FR",
+		"10.0.0.0/8":      "US",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := FromBytes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Metadata.DatabaseType != "GeoLite2-Country" || r.Metadata.RecordSize != 24 {
+		t.Fatalf("unexpected metadata: %+v", r.Metadata)
+	}
+
+	tests := map[string]string{
+		"203.0.113.7":    "DE",
+		"198.51.100.1":   "FR",
+		"198.51.100.200": "",
+		"10.20.30.40":    "US",
+		"192.0.2.1":      "",
+	}
+	for ip, expected := range tests {
+		country, err := r.LookupString(net.ParseIP(ip), "country", "iso_code")
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if country != expected {
+			t.Errorf("%s: expected %q, got %q", ip, expected, country)
+		}
+	}
+
+	_, err = r.Lookup(net.ParseIP("2001:db8::1"))
+	if err == nil {
+		t.Errorf("expected error for ipv6 address")
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	db, err := BuildCountryDatabase(map[string]string{"203.0.113.0/24": "DE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range [][]byte{nil, []byte("not a database"), db[len(db)-20:]} {
+		if _, err := FromBytes(buf); err == nil {
+			t.Errorf("expected error for %q", buf)
+		}
+	}
+
+	// Pointers to themselves must not loop forever.
+	d := &decoder{buf: []byte{0x20, 0x00}}
+	if _, _, err := d.decode(0, 0); err == nil {
+		t.Errorf("expected error for pointer loop")
+	}
+}
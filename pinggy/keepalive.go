@@ -0,0 +1,176 @@
+package pinggy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+// Time to wait for the keepalive reply in waitReconnect when keepalives are disabled.
+const defaultPingTimeout = 10 * time.Second
+
+// Delays between the attempts of AutoReconnect.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+/*
+ping sends a keepalive request and waits for the reply for at most timeout. It
+returns the round trip time.
+*/
+func ping(client *ssh.Client, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepAliveRequest, true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return time.Since(start), err
+	case <-timer.C:
+		return 0, fmt.Errorf("no keepalive reply in %v", timeout)
+	}
+}
+
+/*
+monitor watches the ssh connection until it is lost. It sends the keepalives and
+closes the connection when too many of them are missed.
+*/
+func (s *Session) monitor(client *ssh.Client) {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	interval := s.conf.KeepAliveInterval
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	missed := 0
+	for {
+		select {
+		case err := <-closed:
+			if err == nil {
+				err = fmt.Errorf("connection closed")
+			}
+			s.connectionLost(client, err)
+			return
+		case <-tick:
+			rtt, err := ping(client, interval)
+			if err == nil {
+				atomic.StoreInt64(&s.rtt, int64(rtt))
+				missed = 0
+				continue
+			}
+			missed++
+			if missed < s.conf.KeepAliveMaxMissed {
+				continue
+			}
+			client.Close()
+			<-closed
+			s.connectionLost(client, fmt.Errorf("%d keepalives missed: %v", missed, err))
+			return
+		}
+	}
+}
+
+/*
+RoundTripTime returns the round trip time to the server measured by the last
+keepalive, or zero if none was answered yet.
+*/
+func (s *Session) RoundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+/*
+connectionLost reports the loss of client and reconnects if configured. Losing a
+connection which is already replaced or closed is not reported.
+*/
+func (s *Session) connectionLost(client *ssh.Client, err error) {
+	s.lock.Lock()
+	current := !s.shutdown && s.clientConn == client
+	s.lock.Unlock()
+	if !current {
+		return
+	}
+
+	s.conf.Logger.Println("Ssh connection lost:", err)
+	if s.conf.OnDisconnect != nil {
+		s.conf.OnDisconnect(err)
+	}
+	if !s.conf.AutoReconnect || s.conf.ServerConnection != nil {
+		return
+	}
+
+	delay := minReconnectDelay
+	for {
+		err = s.Reconnect()
+		if err == nil {
+			return
+		}
+		s.lock.Lock()
+		shutdown := s.shutdown
+		replaced := s.clientConn != client
+		changed := s.connChanged
+		s.lock.Unlock()
+		if shutdown || replaced {
+			return
+		}
+		s.conf.Logger.Printf("Reconnect failed, retrying in %v: %v\n", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			// Closed or reconnected by someone else, checked by the next attempt.
+			timer.Stop()
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+/*
+waitReconnect is called when a listener of pl on client failed with err. It waits
+for the automatic reconnect if client is dead and returns nil once pl was moved to
+a new connection, however many attempts it takes. It returns err if the session is
+closed meanwhile. A listener which was closed on a live connection is not waited for.
+*/
+func (s *Session) waitReconnect(pl *pinggyListener, client *ssh.Client, err error) error {
+	if !s.conf.AutoReconnect || client == nil {
+		return err
+	}
+	timeout := s.conf.KeepAliveInterval
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	if _, pingErr := ping(client, timeout); pingErr == nil {
+		return err
+	}
+	for {
+		s.lock.Lock()
+		shutdown := s.shutdown
+		changed := s.connChanged
+		s.lock.Unlock()
+		if shutdown {
+			return err
+		}
+		if pl.client() != client {
+			return nil
+		}
+		<-changed
+	}
+}
@@ -0,0 +1,250 @@
+package pinggy_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+/*
+stallingProxy forwards tcp connections to the server. While it is stalled, the
+data is held back without closing anything, like a connection lost in a NAT.
+*/
+type stallingProxy struct {
+	net.Listener
+	lock    sync.Mutex
+	stalled bool
+	cond    *sync.Cond
+}
+
+func newStallingProxy(t *testing.T, target string) *stallingProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stallingProxy{Listener: l}
+	p.cond = sync.NewCond(&p.lock)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go p.pipe(conn, server)
+			go p.pipe(server, conn)
+		}
+	}()
+	return p
+}
+
+func (p *stallingProxy) pipe(dst, src net.Conn) {
+	defer dst.Close()
+	defer src.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		p.lock.Lock()
+		for p.stalled {
+			p.cond.Wait()
+		}
+		p.lock.Unlock()
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *stallingProxy) setStalled(stalled bool) {
+	p.lock.Lock()
+	p.stalled = stalled
+	p.lock.Unlock()
+	p.cond.Broadcast()
+}
+
+func TestKeepAliveReconnect(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	proxy := newStallingProxy(t, srv.Addr)
+
+	disconnected := make(chan error, 10)
+	conf := srv.Config()
+	conf.Server = proxy.Addr().String()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	conf.KeepAliveInterval = 50 * time.Millisecond
+	conf.KeepAliveMaxMissed = 3
+	conf.AutoReconnect = true
+	conf.OnDisconnect = func(err error) { disconnected <- err }
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pl.RoundTripTime() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// The connection goes silent. The keepalives find it dead and it is replaced.
+	proxy.setStalled(true)
+	select {
+	case <-disconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("dead connection was not detected")
+	}
+	proxy.setStalled(false)
+
+	// visit waits for a visitor to reach Accept through the current tunnel.
+	visit := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			tunnels := srv.Tunnels()
+			if len(tunnels) != 1 {
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+			visitor, err := tunnels[0].DialTCP("")
+			if err != nil {
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+			defer visitor.Close()
+			select {
+			case conn, ok := <-accepted:
+				if !ok {
+					t.Fatal("Accept failed during reconnect")
+				}
+				conn.Close()
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+		t.Fatal("visitor was not accepted after reconnect")
+	}
+	visit()
+
+	// Closed by the server. The new tunnel keeps Accept working.
+	srv.Tunnels()[0].Disconnect()
+	select {
+	case <-disconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("disconnect was not reported")
+	}
+	visit()
+}
+
+func TestAcceptWaitsForReconnect(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	proxy := newDownProxy(t, srv.Addr)
+
+	conf := srv.Config()
+	conf.Server = proxy.Addr().String()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	conf.AutoReconnect = true
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	accept := func() chan error {
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := pl.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}()
+		return accepted
+	}
+
+	// Accept keeps waiting while the reconnect attempts fail.
+	accepted := accept()
+	atomic.StoreInt32(&proxy.down, 1)
+	srv.Tunnels()[0].Disconnect()
+	select {
+	case err := <-accepted:
+		t.Fatalf("Accept returned during the outage: %v", err)
+	case <-time.After(2 * time.Second):
+	}
+
+	// It returns the visitor once a later attempt succeeds.
+	atomic.StoreInt32(&proxy.down, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not reconnected")
+		}
+		if tunnels := srv.Tunnels(); len(tunnels) == 1 {
+			if visitor, err := tunnels[0].DialTCP(""); err == nil {
+				defer visitor.Close()
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("visitor was not accepted after reconnect")
+	}
+
+	// Close ends the wait of an outage.
+	accepted = accept()
+	atomic.StoreInt32(&proxy.down, 1)
+	srv.Tunnels()[0].Disconnect()
+	time.Sleep(500 * time.Millisecond)
+	pl.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("Accept succeeded after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept is still waiting after Close")
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/Pinggy-io/pinggy-go/pinggy/acl"
 	"github.com/Pinggy-io/pinggy-go/pinggy/internal/headermanipulation"
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks"
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 )
 
 type TunnelType string
@@ -163,6 +166,12 @@ type Config struct {
 	*/
 	AltType UDPTunnelType
 
+	/*
+		Validator of the socks username/password authentication when both Type and
+		AltType are set. Anyone who can reach the tunnel can use it if it is nil.
+	*/
+	SocksValidator socks.CredentialValidator
+
 	/*
 		This module log several thing. We use the Logger for this task. If Logger is `nil`, we use the default Logger.
 	*/
@@ -180,6 +189,18 @@ type Config struct {
 	*/
 	Server string
 
+	/*
+		Candidate servers to connect to. If it is set, Server is ignored. They are
+		tried in the order given by ServerSelection until one of them connects.
+		Reconnects try the last server which worked first.
+	*/
+	Servers []ServerCandidate
+
+	/*
+		Strategy to order Servers. Default is ServerSelectionFailover.
+	*/
+	ServerSelection ServerSelection
+
 	/*
 		Automatically forward connection to this address. Keep empty to disable it.
 	*/
@@ -190,6 +211,99 @@ type Config struct {
 	*/
 	UdpForwardingAddr string
 
+	/*
+		Rules to forward the udp flows to different addresses, by visitor, by the port
+		in the socks header or by the first datagram. The first matching rule is used.
+		The flows which do not match any rule are forwarded to UdpForwardingAddr, or
+		dropped if it is empty.
+	*/
+	UdpForwardingRules []tunnel.UdpRule
+
+	/*
+		Forwarded tcp connections without any data in either direction for this
+		duration are closed. It applies to StartForwarding and
+		StartAdditionalForwarding. Zero means no timeout.
+	*/
+	TcpIdleTimeout time.Duration
+
+	/*
+		Forwarded tcp connections are closed after this duration even if they are
+		active. Zero means no limit.
+	*/
+	TcpMaxLifetime time.Duration
+
+	/*
+		Keep dialing the forwarding address for this duration when it is not
+		reachable, such as while the local server restarts. The retries back off
+		from TcpDialRetryBackoff (default 100 milliseconds) up to 2 seconds. Zero
+		means a single attempt.
+	*/
+	TcpDialRetryTimeout time.Duration
+	TcpDialRetryBackoff time.Duration
+
+	/*
+		Maximum number of visitor connections waiting for the forwarding address to
+		become reachable. The others are refused at once. Zero means no limit.
+	*/
+	TcpMaxWaiting int
+
+	/*
+		Answer the visitors of a http tunnel with a "service starting" page while the
+		forwarding address is not reachable, instead of closing the connection.
+		StartingPage is the html of the page; tunnel.DefaultStartingPage is used if
+		it is empty.
+	*/
+	ServeStartingPage bool
+	StartingPage      string
+
+	/*
+		Udp flows without any datagram for this duration are closed. It applies to
+		both ReadFrom/WriteTo and UdpForwardingAddr. Default is 2 minutes. Negative
+		value disables it.
+	*/
+	UdpFlowIdleTimeout time.Duration
+
+	/*
+		Maximum number of concurrent udp flows. New flows are rejected once it is
+		reached. Zero means no limit.
+	*/
+	UdpMaxFlows int
+
+	/*
+		Send the datagrams forwarded to UdpForwardingAddr from the port of the visitor
+		if that port is free on this machine.
+	*/
+	UdpPreserveSourcePort bool
+
+	/*
+		Forward the datagrams received from any address back to the visitor. By default
+		only the datagrams from the ip of UdpForwardingAddr are forwarded.
+	*/
+	UdpAcceptAnySource bool
+
+	/*
+		Udp datagrams larger than this are dropped and counted in UdpStats. It applies to
+		both ReadFrom/WriteTo and UdpForwardingAddr. Default and maximum is 65535.
+	*/
+	UdpMaxDatagramSize int
+
+	/*
+		Bandwidth and connection limits of the forwarded connections. They apply to
+		StartForwarding and StartAdditionalForwarding. Zero values mean no limit. The
+		limits can be changed later with Limiter().SetLimits; connections forwarded
+		while there were no limits stay unlimited. The connections from
+		Accept, ServeHttp and ServeSocks5 are not limited; wrap them with
+		Limiter().Conn to apply the limits.
+	*/
+	Limits tunnel.Limits
+
+	/*
+		Allow and deny rules for the visitors, checked on this side of the tunnel
+		before a connection or an udp flow is accepted. Unlike IpWhiteList, the rules
+		can deny visitors and can be changed later with ACL().Update.
+	*/
+	AccessControl acl.Config
+
 	/*
 		IP Whitelist
 	*/
@@ -227,6 +341,31 @@ type Config struct {
 	// A SshTimeout of zero means no timeout.
 	SshTimeout time.Duration
 
+	// KeepAliveInterval is the interval of the keepalive requests sent over the ssh
+	// connection. They keep idle connections alive through NATs and measure the
+	// round trip time. Keepalives are on by default: zero means 30 seconds. Set a
+	// negative value to disable them, then a dead connection is noticed only when
+	// the tcp connection fails.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveMaxMissed is the number of keepalive requests in a row which may stay
+	// unanswered for an interval. The connection is considered dead and closed
+	// after that. Default is 3.
+	KeepAliveMaxMissed int
+
+	// TcpKeepAlive is the keepalive period of the tcp connection to the server.
+	// Default is 15 seconds; a negative value disables it.
+	TcpKeepAlive time.Duration
+
+	// OnDisconnect is called when the ssh connection is lost, either closed by the
+	// server or found dead by the keepalives. It is not called after Close.
+	OnDisconnect func(err error)
+
+	// AutoReconnect reconnects the tunnels when the ssh connection is lost. Failed
+	// attempts are retried with a growing delay of up to 30 seconds until Close.
+	// Accept and the forwardings wait for the new connection instead of failing.
+	AutoReconnect bool
+
 	/*
 		Force login.
 	*/
@@ -266,6 +405,34 @@ type PinggyListener interface {
 	RemoteUrls() []string
 	RemoteUrls2() ([]string, error)
 
+	/*
+		Return the public endpoints of the tunnel including the domains added with
+		StartAdditionalForwarding.
+	*/
+	Endpoints() ([]Endpoint, error)
+
+	/*
+		Return the public address of the tunnel. It is the tcp, tls or udp endpoint for
+		the respective tunnels and the https endpoint for http tunnels, which is the
+		one of the domain for the domain tunnels of a Session. It returns nil
+		if the endpoints are not available. Addr() returns the same address when available.
+		The address is resolved once when the tunnel is connected, so it does not
+		block.
+	*/
+	PublicAddr() net.Addr
+
+	/*
+		Return the active udp flows, oldest first. The visitor address of a flow is the
+		address returned by ReadFrom for its datagrams. It is nil for tunnels without udp.
+	*/
+	UdpFlows() []UdpFlow
+
+	/*
+		Return the counters of the udp datagrams, including the ones dropped for being
+		larger than UdpMaxDatagramSize.
+	*/
+	UdpStats() tunnel.UdpStats
+
 	/*
 		Start webdebugger. This can not be called more than once.
 		Once the debugger started, it cannot be closed.
@@ -284,16 +451,45 @@ type PinggyListener interface {
 	*/
 	ServeHttp(fs fs.FS) error
 
+	/*
+		Start a socks5 server on the tunnel. Visitors can reach the network of this
+		machine through it. Use the rules in conf to restrict the destinations; a
+		Validator, Rules or DefaultDeny is required. UDP ASSOCIATE needs
+		conf.UdpRelayAddr, as the relay is not reachable through the tunnel.
+	*/
+	ServeSocks5(conf socks.ServerConfig) error
+
 	/*
 		Forward tcp tunnel to this new address.
 	*/
 	UpdateTcpForwarding(addr string) error
 
 	/*
-		Forward tcp tunnel to this new address.
+		Forward udp tunnel to this new address. The address is used for the flows
+		which do not match any of the UdpForwardingRules. The change applies to the
+		new flows only.
 	*/
 	UpdateUdpForwarding(addr string) error
 
+	/*
+		Replace the UdpForwardingRules with rules. Calling it without rules removes
+		them. The change applies to the new flows only.
+	*/
+	SetUdpForwardingRules(rules ...tunnel.UdpRule) error
+
+	/*
+		Return the limiter of the forwarded connections. Use its SetLimits to change
+		the limits at runtime and Stats to see the rejected connections. Its Conn
+		applies the limits to a connection returned by Accept.
+	*/
+	Limiter() *tunnel.Limiter
+
+	/*
+		Return the access control of the visitors. Use its Update to change the
+		rules at runtime and Stats to see the rejected visitors.
+	*/
+	ACL() *acl.ACL
+
 	/*
 		Start forwarding. It would work only if
 		Forwarding address is present
@@ -339,6 +535,25 @@ type PinggyListener interface {
 		This would provide the greeting msg. Not usefull most of the cases
 	*/
 	GetGreetingMsg() ([]string, error)
+
+	/*
+		Server which the tunnel is connected to, with its region if it was given in
+		Config.Servers.
+	*/
+	ConnectedServer() ServerCandidate
+
+	/*
+		Round trip time to the server measured by the last keepalive. It is zero if
+		the keepalives are disabled or none was answered yet.
+	*/
+	RoundTripTime() time.Duration
+
+	/*
+		Reconnect to the server with the same configuration. Accept, ReadFrom and the
+		forwarding started with StartForwarding continue on the new connection.
+		Annonymous tunnels would get new urls after reconnect.
+	*/
+	Reconnect() error
 }
 
 /*
@@ -374,7 +589,10 @@ func ConnectUdp(token string) (PinggyListener, error) {
 Create tunnel with config.
 */
 func ConnectWithConfig(conf Config) (PinggyListener, error) {
-	conf.verify()
+	err := conf.verify()
+	if err != nil {
+		return nil, err
+	}
 	return setupPinggyTunnel(conf)
 }
 
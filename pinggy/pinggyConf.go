@@ -11,31 +11,39 @@ import (
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-func (conf *Config) verify() {
+func (conf *Config) verify() error {
+	if conf.Logger == nil {
+		conf.Logger = log.Default()
+	}
 	if conf.Server == "" {
 		conf.Server = "a.pinggy.io"
 	}
 	conf.sni = "a.pinggy.io"
-	addr := strings.Split(conf.Server, ":")
-	conf.port = 443
-	conf.Server = addr[0]
-	if len(addr) > 1 {
-		p, err := strconv.Atoi(addr[1])
-		if err != nil {
-			conf.Logger.Fatal(err)
-		}
-		conf.port = p
+	host, port, err := parseServerAddr(conf.Server)
+	if err != nil {
+		return &ConfigError{Err: err}
 	}
-	if conf.Logger == nil {
-		conf.Logger = log.Default()
+	conf.Server = host
+	conf.port = port
+	if conf.KeepAliveInterval == 0 {
+		conf.KeepAliveInterval = 30 * time.Second
+	}
+	if conf.KeepAliveMaxMissed <= 0 {
+		conf.KeepAliveMaxMissed = 3
 	}
 
+	conf.verifyTunnel()
+	return nil
+}
+
+// verifyTunnel normalizes the tunnel specific part of the config.
+func (conf *Config) verifyTunnel() {
 	ctype := conf.Type
 	switch ctype {
 	case HTTP, TCP, TLS, TLSTCP:
@@ -79,9 +87,10 @@ func (conf *Config) verify() {
 }
 
 func dialWithConnectProxy(conf *Config, addr string) (net.Conn, error) {
-	proxyAddr := fmt.Sprintf("%s:%s", conf.Proxy.Hostname(), conf.Proxy.Port())
+	proxyAddr := net.JoinHostPort(conf.Proxy.Hostname(), conf.Proxy.Port())
 
-	conn, err := net.DialTimeout("tcp", proxyAddr, conf.Timeout)
+	dialer := &net.Dialer{Timeout: conf.Timeout, KeepAlive: conf.TcpKeepAlive}
+	conn, err := dialer.Dial("tcp", proxyAddr)
 	if err != nil {
 		return conn, err
 	}
@@ -138,7 +147,8 @@ func connectToServer(conf *Config, addr string) (net.Conn, error) {
 	}
 
 	if conf.Proxy == nil {
-		return net.DialTimeout("tcp", addr, conf.Timeout)
+		dialer := &net.Dialer{Timeout: conf.Timeout, KeepAlive: conf.TcpKeepAlive}
+		return dialer.Dial("tcp", addr)
 	}
 
 	switch conf.Proxy.Scheme {
@@ -174,13 +184,12 @@ func dialWithConfig(conf *Config) (*ssh.Client, error) {
 	if conf.Token != "" {
 		usingToken = fmt.Sprintf("using token: %s", conf.Token)
 	}
-	conf.Logger.Printf("Initiating ssh connection %s to server: %s:%d\n", usingToken, conf.Server, conf.port)
-
-	addr := fmt.Sprintf("%s:%d", conf.Server, conf.port)
+	addr := net.JoinHostPort(conf.Server, strconv.Itoa(conf.port))
+	conf.Logger.Printf("Initiating ssh connection %s to server: %s\n", usingToken, addr)
 	conn, err := connectToServer(conf, addr)
 	if err != nil {
 		conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
-		return nil, err
+		return nil, &ConnectError{Server: addr, Err: err}
 	}
 
 	// Try to connect with a timeout. context is used for timeout.
@@ -231,10 +240,10 @@ func dialWithConfig(conf *Config) (*ssh.Client, error) {
 	select {
 	case <-ctx.Done():
 		atomic.StoreInt32(&timerExpired, 1)
-		return nil, fmt.Errorf("failed to complete ssh handshake after %d seconds", int(conf.SshTimeout.Seconds()))
+		return nil, &ConnectError{Server: addr, Err: fmt.Errorf("failed to complete ssh handshake after %d seconds", int(conf.SshTimeout.Seconds()))}
 	case err := <-resultChan:
 		if err != nil {
-			return nil, err // dialer error
+			return nil, &ConnectError{Server: addr, Err: err} // dialer error
 		}
 	}
 
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Pinggy-io/pinggy-go/pinggy/acl"
 	"github.com/Pinggy-io/pinggy-go/pinggy/socks"
 	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 	"golang.org/x/crypto/ssh"
@@ -43,18 +44,33 @@ type pinggyListener struct {
 	debugListener net.Listener
 	udpChannel    bool
 	tcpChannel    bool
-	closed        bool
 
 	tcpDialer tunnel.TcpDialer
 	udpDialer tunnel.UdpDialer
 
 	udpHandler     *packetForwardingHandler
+	udpTunnelMan   tunnel.UdpTunnelManager
+	limiter        *tunnel.Limiter
+	acl            *acl.ACL
 	portConfig     *pinggyPortConfig
 	updateListener PinggyUsagesUpdateListener
 
 	additionalForwardings map[string]tunnel.TunnelManager
 
 	status connectionStatus
+
+	// lock protects the connection specific fields which are replaced by Reconnect.
+	lock      sync.Mutex
+	usageConn net.Conn
+	webDebug  bool
+	shutdown  bool
+
+	// Endpoints of the tunnel, resolved when it is connected.
+	endpoints []Endpoint
+
+	sess       *Session
+	ownSession bool
+	bindAddr   string
 }
 
 type udpListenerWrapper struct {
@@ -62,8 +78,11 @@ type udpListenerWrapper struct {
 }
 
 func (ul *udpListenerWrapper) Accept() (net.Conn, error) {
-	conn, _, err := ul.udpListener.AcceptUdp()
-	return conn, err
+	conn, addr, err := ul.udpListener.AcceptUdp()
+	if err != nil {
+		return nil, err
+	}
+	return &visitorConn{Conn: conn, visitor: addr}, nil
 }
 
 func (ul *udpListenerWrapper) Close() error {
@@ -105,7 +124,7 @@ func (pl *pinggyListener) checkConnectionStatus() error {
 	}
 	if !pl.status.Success {
 		// logger.Println("Could not read: ", pl.status.Error, string(data))
-		return fmt.Errorf(pl.status.Error)
+		return &TunnelError{Message: pl.status.Error, Authenticated: pl.status.Authenticated}
 	}
 	// logger.Println("done")
 	return nil
@@ -148,33 +167,30 @@ func (pl *pinggyListener) updateUsage(conn net.Conn, bufReader *bufio.Reader) {
 	for {
 		line, _, err := bufReader.ReadLine()
 		if err != nil {
-			pl.updateListener = nil
+			pl.lock.Lock()
+			if pl.usageConn == conn {
+				pl.updateListener = nil
+				pl.usageConn = nil
+			}
+			pl.lock.Unlock()
 			return
 		}
 		str := string(line)
-		if pl.updateListener == nil {
+		pl.lock.Lock()
+		// A newer stream replaced this one, or the listener was removed.
+		current := pl.usageConn == conn
+		updateListener := pl.updateListener
+		pl.lock.Unlock()
+		if !current || updateListener == nil {
 			break
 		}
-		pl.updateListener.Update(str)
+		updateListener.Update(str)
 	}
 }
 
-func (pl *pinggyListener) SetUsagesUpdateListener(usageUpdate PinggyUsagesUpdateListener) error {
-	if pl.portConfig == nil {
-		return fmt.Errorf("pinggy does not support this")
-	}
-
-	if usageUpdate == nil {
-		pl.updateListener = nil
-		return nil
-	}
-
-	if pl.updateListener != nil {
-		pl.updateListener = usageUpdate
-		return nil
-	}
-
-	conn, err := pl.DialAddr(fmt.Sprintf("localhost:%d", pl.portConfig.UsageContinuousTcp))
+func (pl *pinggyListener) startUsageStream() error {
+	portConfig := pl.ports()
+	conn, err := pl.DialAddr(fmt.Sprintf("localhost:%d", portConfig.UsageContinuousTcp))
 	if err != nil {
 		return err
 	}
@@ -185,13 +201,46 @@ func (pl *pinggyListener) SetUsagesUpdateListener(usageUpdate PinggyUsagesUpdate
 		return fmt.Errorf("cannot make reader")
 	}
 
-	pl.updateListener = usageUpdate
+	pl.lock.Lock()
+	pl.usageConn = conn
+	pl.lock.Unlock()
 
 	go pl.updateUsage(conn, reader)
 
 	return nil
 }
 
+func (pl *pinggyListener) SetUsagesUpdateListener(usageUpdate PinggyUsagesUpdateListener) error {
+	if pl.ports() == nil {
+		return fmt.Errorf("pinggy does not support this")
+	}
+
+	pl.lock.Lock()
+	running := pl.updateListener != nil
+	pl.updateListener = usageUpdate
+	var usageConn net.Conn
+	if usageUpdate == nil {
+		usageConn = pl.usageConn
+		pl.usageConn = nil
+	}
+	pl.lock.Unlock()
+
+	if usageConn != nil {
+		usageConn.Close()
+	}
+	if usageUpdate == nil || running {
+		return nil
+	}
+
+	err := pl.startUsageStream()
+	if err != nil {
+		pl.lock.Lock()
+		pl.updateListener = nil
+		pl.lock.Unlock()
+	}
+	return err
+}
+
 func (pl *pinggyListener) readUsages(port int) (string, error) {
 	conn, err := pl.DialAddr(fmt.Sprintf("localhost:%d", port))
 	if err != nil {
@@ -212,31 +261,34 @@ func (pl *pinggyListener) readUsages(port int) (string, error) {
 }
 
 func (pl *pinggyListener) LongPollUsages() (string, error) {
-	if pl.portConfig == nil {
+	portConfig := pl.ports()
+	if portConfig == nil {
 		return "", fmt.Errorf("pinggy does not support this yet")
 	}
 
-	return pl.readUsages(pl.portConfig.UsageOnceLongPollTcp)
+	return pl.readUsages(portConfig.UsageOnceLongPollTcp)
 }
 
 func (pl *pinggyListener) GetCurUsages() (string, error) {
-	if pl.portConfig == nil {
+	portConfig := pl.ports()
+	if portConfig == nil {
 		return "", fmt.Errorf("pinggy does not support this yet")
 	}
 
-	return pl.readUsages(pl.portConfig.UsageTcp)
+	return pl.readUsages(portConfig.UsageTcp)
 }
 
 func (pl *pinggyListener) GetGreetingMsg() ([]string, error) {
-	if pl.portConfig == nil {
+	portConfig := pl.ports()
+	if portConfig == nil {
 		return nil, fmt.Errorf("pinggy does not support this yet")
 	}
 
-	if pl.portConfig.GreetingMsgTCPPort <= 0 {
+	if portConfig.GreetingMsgTCPPort <= 0 {
 		return nil, fmt.Errorf("pinggy does not support this yet")
 	}
 
-	conn, err := pl.DialAddr(fmt.Sprintf("localhost:%d", pl.portConfig.GreetingMsgTCPPort))
+	conn, err := pl.DialAddr(fmt.Sprintf("localhost:%d", portConfig.GreetingMsgTCPPort))
 	if err != nil {
 		return nil, err
 	}
@@ -306,6 +358,16 @@ func (pl *pinggyListener) getConnectionUrl() ([]string, error) {
 		return nil, err
 	}
 	logger.Println(urls)
+	if pl.bindAddr != primaryBindAddr {
+		// The server reports the urls of the connection. A tunnel of a domain is
+		// served at the domain in the same way.
+		host, _, _ := net.SplitHostPort(pl.bindAddr)
+		domainUrls := []string{}
+		for _, ep := range domainEndpoints(pl.parseEndpoints(urls["urls"]), host) {
+			domainUrls = append(domainUrls, ep.Url)
+		}
+		return domainUrls, nil
+	}
 	return urls["urls"], nil
 }
 
@@ -318,19 +380,59 @@ func (pl *pinggyListener) Accept() (net.Conn, error) {
 		return nil, fmt.Errorf("automatic tcp forwarding enabled")
 	}
 
-	return pl.listener.Accept()
+	return pl.tcpAcceptor().Accept()
 }
 
-func (pl *pinggyListener) Close() error {
+/*
+closeLocal closes what the tunnel runs on this side of the ssh connection, which
+is not closed along with the connection.
+*/
+func (pl *pinggyListener) closeLocal() {
 	if pl.debugListener != nil {
 		pl.debugListener.Close()
 		pl.debugListener = nil
 	}
-	err := pl.clientConn.Close()
-	return err
+
+	// Unblock the pending reads and writes of the packet conn.
+	if pl.udpHandler != nil {
+		pl.udpHandler.close(net.ErrClosed)
+	}
+	if pl.udpTunnelMan != nil {
+		pl.udpTunnelMan.Close()
+	}
+}
+
+func (pl *pinggyListener) Close() error {
+	if pl.ownSession {
+		return pl.sess.Close()
+	}
+
+	pl.lock.Lock()
+	pl.shutdown = true
+	listener := pl.listener
+	session := pl.session
+	additionalForwardings := pl.additionalForwardings
+	pl.lock.Unlock()
+
+	pl.closeLocal()
+
+	// Only this tunnel is closed. The ssh connection is shared with other tunnels of the session.
+	pl.sess.remove(pl)
+	for _, tunnelMan := range additionalForwardings {
+		tunnelMan.Close()
+	}
+	if session != nil {
+		session.Close()
+	}
+	return listener.Close()
 }
 
-func (pl *pinggyListener) Addr() net.Addr { return pl.listener.Addr() }
+func (pl *pinggyListener) Addr() net.Addr {
+	if addr := pl.PublicAddr(); addr != nil {
+		return addr
+	}
+	return pl.currentListener(false).Addr()
+}
 
 func (pl *pinggyListener) RemoteUrls() []string {
 	urls, _ := pl.getConnectionUrl()
@@ -349,14 +451,13 @@ func (pl *pinggyListener) InitiateWebDebug(addr string) error {
 		return fmt.Errorf("webDebugging is available only with %v mode", HTTP)
 	}
 	// Start the session
-	if pl.session == nil {
-		err := pl.initiateSession()
-		if err != nil {
-			return err
-		}
-		err = pl.session.Shell()
+	pl.lock.Lock()
+	session := pl.session
+	pl.webDebug = true
+	pl.lock.Unlock()
+	if session == nil {
+		err := pl.startShell()
 		if err != nil {
-			pl.conf.Logger.Println("Cannot initiate WebDebug")
 			return err
 		}
 	}
@@ -386,8 +487,7 @@ func (pl *pinggyListener) InitiateDebugForward(addr string) error {
 				pl.conf.Logger.Println(err)
 				return
 			}
-			go io.Copy(conn, conn2)
-			go io.Copy(conn2, conn)
+			go tunnel.Join(conn, conn2)
 		}
 	}()
 	pl.debugListener = webListener
@@ -399,7 +499,20 @@ func (pl *pinggyListener) ServeHttp(fs fs.FS) error {
 
 	server := http.Server{}
 	server.Handler = http.FileServer(httpfs)
-	return server.Serve(pl.listener)
+	return server.Serve(pl.tcpAcceptor())
+}
+
+func (pl *pinggyListener) ServeSocks5(conf socks.ServerConfig) error {
+	if pl.conf.Type != TCP && pl.conf.Type != TLSTCP {
+		return fmt.Errorf("socks5 is available only with %v or %v mode", TCP, TLSTCP)
+	}
+	if conf.EnableUdpAssociate && conf.UdpRelayAddr == "" {
+		return fmt.Errorf("udp associate needs an UdpRelayAddr the visitors can reach, the tunnel does not carry its datagrams")
+	}
+	if conf.Logger == nil {
+		conf.Logger = pl.conf.Logger
+	}
+	return socks.NewServer(conf).Serve(pl.tcpAcceptor())
 }
 
 // net.PacketConn
@@ -407,52 +520,81 @@ func (pl *pinggyListener) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if pl.udpHandler == nil {
 		return -1, nil, fmt.Errorf("not allowed")
 	}
-	if pl.closed {
-		return 0, nil, io.EOF
-	}
-	pkt := <-pl.udpHandler.readChannel
-	if pkt.closed {
-		pl.closed = true
-		return 0, nil, io.EOF
-	}
-	l := copy(p, pkt.bytes)
-	return l, pkt.addr, nil
+	return pl.udpHandler.readFrom(p)
 }
 
 func (pl *pinggyListener) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if pl.udpHandler == nil {
 		return -1, fmt.Errorf("not allowed")
 	}
-	pl.udpHandler.writeTo(p, addr)
-	return n, nil
+	return pl.udpHandler.writeTo(p, addr)
 }
 
 func (pl *pinggyListener) LocalAddr() net.Addr {
 	if pl.udpHandler == nil {
 		return nil
 	}
-	return pl.Addr()
+	if addr := pl.publicAddr("udp"); addr != nil {
+		return addr
+	}
+	return pl.currentListener(true).Addr()
+}
+
+func (pl *pinggyListener) UdpFlows() []UdpFlow {
+	if pl.udpHandler != nil {
+		return pl.udpHandler.flows()
+	}
+	if pl.udpTunnelMan == nil {
+		return nil
+	}
+	flows := make([]UdpFlow, 0)
+	for _, f := range pl.udpTunnelMan.Flows() {
+		flows = append(flows, UdpFlow{
+			Visitor:    f.Visitor,
+			Started:    f.Started,
+			LastActive: f.LastActive,
+			PacketsIn:  f.PacketsIn,
+			PacketsOut: f.PacketsOut,
+			BytesIn:    f.BytesIn,
+			BytesOut:   f.BytesOut,
+		})
+	}
+	return flows
+}
+
+func (pl *pinggyListener) UdpStats() tunnel.UdpStats {
+	if pl.udpHandler != nil {
+		return pl.udpHandler.stats()
+	}
+	if pl.udpTunnelMan == nil {
+		return tunnel.UdpStats{}
+	}
+	return pl.udpTunnelMan.Stats()
 }
 
 func (pl *pinggyListener) SetDeadline(t time.Time) error {
 	if pl.udpHandler == nil {
 		return fmt.Errorf("not allowed")
 	}
-	return fmt.Errorf("not implemented")
+	pl.udpHandler.readDeadline.set(t)
+	pl.udpHandler.writeDeadline.set(t)
+	return nil
 }
 
 func (pl *pinggyListener) SetReadDeadline(t time.Time) error {
 	if pl.udpHandler == nil {
 		return fmt.Errorf("not allowed")
 	}
-	return fmt.Errorf("not implemented")
+	pl.udpHandler.readDeadline.set(t)
+	return nil
 }
 
 func (pl *pinggyListener) SetWriteDeadline(t time.Time) error {
 	if pl.udpHandler == nil {
 		return fmt.Errorf("not allowed")
 	}
-	return fmt.Errorf("not implemented")
+	pl.udpHandler.writeDeadline.set(t)
+	return nil
 }
 
 func (pl *pinggyListener) UpdateTcpForwarding(addr string) error {
@@ -474,18 +616,25 @@ func (pl *pinggyListener) UpdateUdpForwarding(addr string) error {
 	}
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	pl.udpDialer.UpdateAddr(udpAddr)
 	return nil
 }
 
+func (pl *pinggyListener) SetUdpForwardingRules(rules ...tunnel.UdpRule) error {
+	if pl.udpTunnelMan == nil {
+		return fmt.Errorf("udp forwarding rules need an udp tunnel")
+	}
+	return pl.udpTunnelMan.SetRules(rules)
+}
+
 func (pl *pinggyListener) initiateSession() error {
 	if pl.session != nil {
 		return nil
 	}
-	session, err := pl.clientConn.NewSession()
+	session, err := pl.client().NewSession()
 	if err != nil {
 		pl.conf.Logger.Println("Cannot initiate WebDebug")
 		return err
@@ -494,11 +643,26 @@ func (pl *pinggyListener) initiateSession() error {
 	session.Stdout = pl.conf.Stdout
 	session.Stderr = pl.conf.Stderr
 
+	pl.lock.Lock()
 	pl.session = session
+	pl.lock.Unlock()
 
 	return nil
 }
 
+func (pl *pinggyListener) startShell() error {
+	err := pl.initiateSession()
+	if err != nil {
+		return err
+	}
+	err = pl.session.Shell()
+	if err != nil {
+		pl.conf.Logger.Println("Cannot initiate WebDebug")
+		return err
+	}
+	return nil
+}
+
 func (pl *pinggyListener) startSession() error {
 	command := ""
 	for _, ip := range pl.conf.IpWhiteList {
@@ -577,52 +741,98 @@ func (pl *pinggyListener) startSession() error {
 	return nil
 }
 
-func setupPinggyTunnel(conf Config) (list *pinggyListener, err error) {
-	clientConn, err := dialWithConfig(&conf)
+// attach sets up the reverse tunnel over the given ssh connection. It is used
+// for the initial connection as well as by Reconnect.
+func (pl *pinggyListener) attach(clientConn *ssh.Client) error {
+	conf := pl.conf
+	listener, err := clientConn.Listen("tcp", pl.bindAddr)
 	if err != nil {
-		conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
-		return
+		conf.Logger.Printf("Error in ssh tunnel initiation: %v\n", err)
+		return err
 	}
 
-	conf.Logger.Println("Ssh connection initiated. Setting up reverse tunnel")
-	listener, err := clientConn.Listen("tcp", "0.0.0.0:0")
+	pl.clientConn = clientConn
+	pl.listener = listener
+	pl.udpListener = listener
+
+	err = pl.preparePinggyPort()
 	if err != nil {
-		clientConn.Close()
-		conf.Logger.Printf("Error in ssh tunnel initiation: %v\n", err)
-		return
+		conf.Logger.Println("Something wrong:", err)
+		listener.Close()
+		return err
+	}
+
+	if pl.tcpChannel && pl.udpChannel {
+		socksListener := socks.InitiatateSocks5uWithConfig(listener, socks.Socks5uConfig{Validator: conf.SocksValidator})
+		udpListener := &udpListenerWrapper{udpListener: socksListener}
+		go socksListener.Start()
+
+		pl.listener = socksListener
+		pl.udpListener = udpListener
 	}
 
+	if conf.startSession {
+		err = pl.startSession()
+	} else if pl.webDebug {
+		err = pl.startShell()
+	}
+	if err != nil {
+		if pl.session != nil {
+			pl.session.Close()
+		}
+		listener.Close()
+		return err
+	}
+
+	pl.endpoints = pl.resolveEndpoints()
+
+	return nil
+}
+
+func setupPinggyTunnel(conf Config) (*pinggyListener, error) {
+	sess, err := newSession(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := sess.listen(*sess.conf, primaryBindAddr)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	list.ownSession = true
+
+	return list, nil
+}
+
+func newPinggyListener(sess *Session, conf Config, bindAddr string) (list *pinggyListener, err error) {
 	list = &pinggyListener{
-		listener:    listener,
-		udpListener: listener,
-		clientConn:  clientConn,
-		conf:        &conf,
-		tcpChannel:  conf.Type != "",
-		udpChannel:  conf.AltType != "",
-		closed:      false,
+		conf:       &conf,
+		sess:       sess,
+		bindAddr:   bindAddr,
+		tcpChannel: conf.Type != "",
+		udpChannel: conf.AltType != "",
 
 		tcpDialer: nil,
 		udpDialer: nil,
 
 		additionalForwardings: map[string]tunnel.TunnelManager{},
+		limiter:               tunnel.NewLimiter(conf.Limits),
 	}
 
-	err = list.preparePinggyPort()
+	if conf.AccessControl.Logger == nil {
+		conf.AccessControl.Logger = conf.Logger
+	}
+	list.acl, err = acl.New(conf.AccessControl)
 	if err != nil {
-		conf.Logger.Println("Something wrong:", err)
-		list.Close()
 		list = nil
 		return
 	}
 
-	if conf.Type != "" && conf.AltType != "" {
-		socksListener := socks.InitiatateSocks5u(listener)
-		udpListener := &udpListenerWrapper{udpListener: socksListener}
-		listener = socksListener
-		go socksListener.Start()
-
-		list.listener = listener
-		list.udpListener = udpListener
+	err = list.attach(sess.client())
+	if err != nil {
+		list = nil
+		return
 	}
 
 	if conf.TcpForwardingAddr != "" {
@@ -636,48 +846,83 @@ func setupPinggyTunnel(conf Config) (list *pinggyListener, err error) {
 		list.tcpDialer = tunnel.NewTcpDialer(addr)
 	}
 
-	if conf.UdpForwardingAddr != "" {
+	if conf.UdpForwardingAddr != "" || len(conf.UdpForwardingRules) > 0 {
 		var addr *net.UDPAddr = nil
-		addr, err = net.ResolveUDPAddr("udp", conf.UdpForwardingAddr)
+		if conf.UdpForwardingAddr != "" {
+			addr, err = net.ResolveUDPAddr("udp", conf.UdpForwardingAddr)
+			if err != nil {
+				list.Close()
+				list = nil
+				return
+			}
+		}
+		list.udpDialer = tunnel.NewUdpDialer(addr)
+	}
+
+	if list.udpChannel && list.udpDialer != nil {
+		list.udpTunnelMan = tunnel.NewUdpTunnelMangerWithOptions(list.udpAcceptor(), list.udpDialer, list.udpOptions())
+		err = list.udpTunnelMan.SetRules(conf.UdpForwardingRules)
 		if err != nil {
 			list.Close()
 			list = nil
 			return
 		}
-		list.udpDialer = tunnel.NewUdpDialer(addr)
 	}
 
 	if list.udpChannel && list.udpDialer == nil {
-		list.udpHandler = &packetForwardingHandler{
-			list:        list.udpListener,
-			readChannel: make(chan *packet, 50),
-			tunnels:     make(map[string]udpTunnel),
-		}
+		list.udpHandler = newPacketForwardingHandler(list.udpAcceptor(), conf.UdpFlowIdleTimeout, conf.UdpMaxDatagramSize, conf.UdpMaxFlows)
 		go list.udpHandler.startForwarding()
 	}
 
-	if conf.startSession {
-		err = list.startSession()
-		if err != nil {
-			list.Close()
-			list = nil
-		}
+	return
+}
+
+// tcpOptions returns the options of the tcp forwardings of the tunnel.
+func (pl *pinggyListener) tcpOptions() tunnel.TcpOptions {
+	options := tunnel.TcpOptions{
+		Limiter:          pl.limiter,
+		IdleTimeout:      pl.conf.TcpIdleTimeout,
+		MaxLifetime:      pl.conf.TcpMaxLifetime,
+		DialRetryTimeout: pl.conf.TcpDialRetryTimeout,
+		DialRetryBackoff: pl.conf.TcpDialRetryBackoff,
+		MaxWaiting:       pl.conf.TcpMaxWaiting,
+	}
+	if pl.conf.ServeStartingPage && pl.conf.Type == HTTP {
+		options.Unavailable = tunnel.HttpUnavailable(pl.conf.StartingPage)
 	}
+	return options
+}
 
-	return
+// udpOptions returns the options of the udp forwarding of the tunnel.
+func (pl *pinggyListener) udpOptions() tunnel.UdpOptions {
+	return tunnel.UdpOptions{
+		MaxDatagramSize:    pl.conf.UdpMaxDatagramSize,
+		IdleTimeout:        pl.conf.UdpFlowIdleTimeout,
+		MaxFlows:           pl.conf.UdpMaxFlows,
+		PreserveSourcePort: pl.conf.UdpPreserveSourcePort,
+		AcceptAnySource:    pl.conf.UdpAcceptAnySource,
+		Limiter:            pl.limiter,
+	}
+}
+
+func (pl *pinggyListener) Limiter() *tunnel.Limiter {
+	return pl.limiter
+}
+
+func (pl *pinggyListener) ACL() *acl.ACL {
+	return pl.acl
 }
 
 func (pl *pinggyListener) StartForwarding() error {
 	var wg sync.WaitGroup
 	forwarding := false
 	//add socks here
-	if pl.udpChannel && pl.udpDialer != nil {
+	if pl.udpTunnelMan != nil {
 		forwarding = true
 		wg.Add(1)
 		go func(pl *pinggyListener, wg *sync.WaitGroup) {
 			defer wg.Done()
-			udpTunnelMan := tunnel.NewUdpTunnelMangerWithDialer(pl.udpListener, pl.udpDialer)
-			udpTunnelMan.StartForwarding()
+			pl.udpTunnelMan.StartForwarding()
 		}(pl, &wg)
 	}
 	if pl.tcpChannel && pl.tcpDialer != nil {
@@ -685,7 +930,7 @@ func (pl *pinggyListener) StartForwarding() error {
 		wg.Add(1)
 		go func(pl *pinggyListener, wg *sync.WaitGroup) {
 			defer wg.Done()
-			tcpTunnelMan := tunnel.NewTcpTunnelMangerDialer(pl.listener, pl.tcpDialer)
+			tcpTunnelMan := tunnel.NewTcpTunnelMangerWithOptions(pl.tcpAcceptor(), pl.tcpDialer, pl.tcpOptions())
 			tcpTunnelMan.StartForwarding()
 		}(pl, &wg)
 	}
@@ -708,30 +953,46 @@ func (pl *pinggyListener) StartAdditionalForwarding(domain, addr string) error {
 	if domain == "" || addr == "" {
 		return fmt.Errorf("domain and address cannot be empty")
 	}
-	host, port, err := net.SplitHostPort(domain)
-	if err != nil {
-		host = domain
-		port = "0"
-	}
-	listener, err := pl.clientConn.Listen("tcp", net.JoinHostPort(host, port))
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	tcpTunnelMan, err := tunnel.NewTcpTunnelManger(listener, addr)
+	tcpTunnelMan, err := listenAdditionalForwarding(pl.client(), domain, tunnel.NewTcpDialer(tcpAddr), pl.tcpOptions(), pl.acl)
 	if err != nil {
 		return err
 	}
 
-	go tcpTunnelMan.StartForwarding()
-
+	pl.lock.Lock()
 	pl.additionalForwardings[domain] = tcpTunnelMan
+	pl.lock.Unlock()
 
 	return nil
 }
 
+func listenAdditionalForwarding(clientConn *ssh.Client, domain string, dialer tunnel.TcpDialer, options tunnel.TcpOptions, access *acl.ACL) (tunnel.TunnelManager, error) {
+	host, port, err := net.SplitHostPort(domain)
+	if err != nil {
+		host = domain
+		port = "0"
+	}
+	listener, err := clientConn.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	tcpTunnelMan := tunnel.NewTcpTunnelMangerWithOptions(access.Listener(listener), dialer, options)
+
+	go tcpTunnelMan.StartForwarding()
+
+	return tcpTunnelMan, nil
+}
+
 func (pl *pinggyListener) UpdateAdditionalForwarding(domain, addr string) error {
-	if _, ok := pl.additionalForwardings[domain]; !ok {
+	pl.lock.Lock()
+	tunnelMan, ok := pl.additionalForwardings[domain]
+	pl.lock.Unlock()
+	if !ok {
 		return fmt.Errorf("no forwarding available for domain: %s", domain)
 	}
 
@@ -740,14 +1001,13 @@ func (pl *pinggyListener) UpdateAdditionalForwarding(domain, addr string) error
 		return err
 	}
 
-	tunnelMan := pl.additionalForwardings[domain]
 	tunnelMan.GetDialer().UpdateAddr(tcpAddr)
 
 	return nil
 }
 
 func (pl *pinggyListener) DialAddr(addr string) (net.Conn, error) {
-	conn, err := pl.clientConn.Dial("tcp", addr)
+	conn, err := pl.client().Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,790 @@
+/*
+Package pinggytest provides an in-process pinggy server for tests.
+
+The server speaks enough of the pinggy protocol for the client in package pinggy
+to run offline: it authenticates the `token+type` ssh users, accepts the reverse
+forwardings, serves the port configuration, connection status, usages, greeting
+messages, `/urls` and `/headerman`, and lets the test inject visitor connections
+into the tunnels.
+
+	srv := pinggytest.NewServer()
+	defer srv.Close()
+
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	pl, _ := pinggy.ConnectWithConfig(conf)
+
+	conn, _ := srv.Tunnels()[0].DialTCP("203.0.113.7:5555")
+*/
+package pinggytest
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"golang.org/x/crypto/ssh"
+)
+
+// Ports served through direct-tcpip. They are same as the ones used by the pinggy server.
+const (
+	configPort            = 4
+	usageContinuousPort   = 5
+	usageOnceLongPollPort = 6
+	usagePort             = 7
+	urlPort               = 8
+	statusPort            = 12
+	greetingPort          = 13
+	webDebuggerPort       = 4300
+)
+
+// DefaultVisitorIP is used as the visitor address when the test does not provide one.
+const DefaultVisitorIP = "198.51.100.1"
+
+/*
+Server is a mock pinggy server. Exported fields can be changed only before Start.
+*/
+type Server struct {
+	// Listener accepting the ssh connections.
+	Listener net.Listener
+
+	// Address of the listener in host:port form. It can be used as Config.Server.
+	Addr string
+
+	// Tokens accepted by the server. Any token is accepted if it is empty.
+	Tokens []string
+
+	// Messages served through the greeting port.
+	Greetings []string
+
+	// Domain under which the tunnel hostnames are generated. Default `a.pinggy.test`.
+	Domain string
+
+	// Logger for the server. Default logger is used if it is nil.
+	Logger *log.Logger
+
+	config *ssh.ServerConfig
+
+	lock          sync.Mutex
+	conns         map[*serverConn]bool
+	tunnels       []*Tunnel
+	nextTunnelId  int
+	nextPort      int
+	nextVisitorId int
+	closed        bool
+	wg            sync.WaitGroup
+}
+
+/*
+Create and start a server listening on a loopback port. It panics if the server
+cannot be started, similar to httptest.NewServer.
+*/
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+/*
+Create a server without starting it. Change the exported fields and call Start.
+*/
+func NewUnstartedServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("pinggytest: failed to listen on a port: %v", err))
+	}
+	return &Server{
+		Listener: l,
+		Addr:     l.Addr().String(),
+	}
+}
+
+/*
+Start accepting ssh connections.
+*/
+func (s *Server) Start() {
+	if s.config != nil {
+		panic("pinggytest: server already started")
+	}
+	if s.Domain == "" {
+		s.Domain = "a.pinggy.test"
+	}
+	if s.Logger == nil {
+		s.Logger = log.Default()
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("pinggytest: failed to generate host key: %v", err))
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(fmt.Sprintf("pinggytest: failed to generate host key: %v", err))
+	}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			_, err := parseUser(c.User())
+			return nil, err
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	s.conns = make(map[*serverConn]bool)
+	s.nextPort = 40000
+	s.nextVisitorId = 50000
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := s.Listener.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.ServeConn(conn)
+			}()
+		}
+	}()
+}
+
+/*
+Config returns a client configuration pointing to the server. Type, Token and
+the rest can be changed before connecting.
+*/
+func (s *Server) Config() pinggy.Config {
+	return pinggy.Config{Server: s.Addr}
+}
+
+/*
+Conn returns a new connection to the server. It can be used as Config.ServerConnection.
+*/
+func (s *Server) Conn() (net.Conn, error) {
+	return net.Dial("tcp", s.Addr)
+}
+
+/*
+Close the listener and all the ssh connections, and wait for them to end.
+*/
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.lock.Unlock()
+
+	s.Listener.Close()
+	for _, sc := range conns {
+		sc.conn.Close()
+	}
+	s.wg.Wait()
+}
+
+/*
+CloseConnections drops all the ssh connections while the server keeps accepting
+new ones. It is useful to test reconnection.
+*/
+func (s *Server) CloseConnections() {
+	s.lock.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.lock.Unlock()
+
+	for _, sc := range conns {
+		sc.conn.Close()
+	}
+}
+
+/*
+Tunnels returns the active tunnels in the order they were created.
+*/
+func (s *Server) Tunnels() []*Tunnel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Tunnel{}, s.tunnels...)
+}
+
+/*
+Tunnel finds an active tunnel by its public hostname. It returns nil if there is none.
+*/
+func (s *Server) Tunnel(host string) *Tunnel {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tunnels {
+		if strings.EqualFold(t.Host, host) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Server) nextVisitorAddr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextVisitorId++
+	if s.nextVisitorId > 65535 {
+		s.nextVisitorId = 50000
+	}
+	return net.JoinHostPort(DefaultVisitorIP, strconv.Itoa(s.nextVisitorId))
+}
+
+/*
+ServeConn runs the ssh protocol on the connection. It returns when the connection ends.
+*/
+func (s *Server) ServeConn(netConn net.Conn) {
+	if s.config == nil {
+		panic("pinggytest: server not started")
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		s.Logger.Printf("pinggytest: ssh handshake failed: %v\n", err)
+		netConn.Close()
+		return
+	}
+
+	user, _ := parseUser(sshConn.User())
+	sc := &serverConn{
+		srv:       s,
+		conn:      sshConn,
+		user:      user,
+		started:   time.Now(),
+		usageCond: make(chan struct{}),
+	}
+	sc.status = s.register(sc)
+
+	go sc.handleRequests(reqs)
+	sc.handleChannels(chans)
+
+	sshConn.Close()
+	s.unregister(sc)
+}
+
+func (s *Server) register(sc *serverConn) connectionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return connectionStatus{Error: "server is closed"}
+	}
+
+	if sc.user.token != "" && len(s.Tokens) > 0 {
+		found := false
+		for _, t := range s.Tokens {
+			if t == sc.user.token {
+				found = true
+			}
+		}
+		if !found {
+			return connectionStatus{Error: "Invalid token"}
+		}
+	}
+
+	if sc.user.token != "" {
+		for other := range s.conns {
+			if other.user.token != sc.user.token || !other.status.Success {
+				continue
+			}
+			if !sc.user.force {
+				return connectionStatus{Authenticated: true, Error: "Tunnel with this token is already running. Use force to close it."}
+			}
+			go other.conn.Close()
+		}
+	}
+
+	s.conns[sc] = true
+	return connectionStatus{Success: true, Authenticated: true}
+}
+
+func (s *Server) unregister(sc *serverConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, sc)
+	tunnels := s.tunnels[:0]
+	for _, t := range s.tunnels {
+		if t.conn != sc {
+			tunnels = append(tunnels, t)
+		}
+	}
+	s.tunnels = tunnels
+}
+
+type sshUser struct {
+	token   string
+	typ     string
+	altType string
+	force   bool
+}
+
+func parseUser(user string) (sshUser, error) {
+	var u sshUser
+	for _, part := range strings.Split(user, "+") {
+		switch strings.ToLower(part) {
+		case "", "auth":
+		case "http", "tcp", "tls", "tlstcp":
+			if u.typ != "" {
+				return u, fmt.Errorf("more than one tunnel type in %s", user)
+			}
+			u.typ = strings.ToLower(part)
+		case "udp":
+			u.altType = "udp"
+		case "force":
+			u.force = true
+		default:
+			if u.token != "" {
+				return u, fmt.Errorf("unknown keyword %s in %s", part, user)
+			}
+			u.token = part
+		}
+	}
+	return u, nil
+}
+
+type connectionStatus struct {
+	Success       bool   `json:"Success"`
+	Authenticated bool   `json:"Authenticated"`
+	Error         string `json:"Error"`
+}
+
+// serverConn is the state of a single ssh connection.
+type serverConn struct {
+	srv     *Server
+	conn    *ssh.ServerConn
+	user    sshUser
+	status  connectionStatus
+	started time.Time
+
+	lock      sync.Mutex
+	tunnels   []*Tunnel
+	commands  []string
+	whitelist []*net.IPNet
+	usage     *pinggy.Usage
+	usageCond chan struct{} // closed and replaced on every usage update
+}
+
+type channelForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (sc *serverConn) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var msg channelForwardMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			t, err := sc.addTunnel(msg.BindAddr, msg.BindPort)
+			if err != nil {
+				sc.srv.Logger.Printf("pinggytest: tcpip-forward rejected: %v\n", err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, ssh.Marshal(&struct{ Port uint32 }{uint32(t.Port)}))
+		case "cancel-tcpip-forward":
+			var msg channelForwardMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(sc.removeTunnel(msg.BindAddr, msg.BindPort), nil)
+		case "keepalive@openssh.com":
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (sc *serverConn) addTunnel(bindHost string, bindPort uint32) (*Tunnel, error) {
+	bindAddr := net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+	t := &Tunnel{
+		BindAddr: bindAddr,
+		Token:    sc.user.token,
+		conn:     sc,
+		bindHost: bindHost,
+	}
+
+	switch bindHost {
+	case "", "0.0.0.0", "localhost", "::":
+		t.Type, t.AltType = sc.user.typ, sc.user.altType
+	default:
+		// Other bind hosts are domains of the token, served over http.
+		t.Type, t.AltType = "http", ""
+		t.Host = bindHost
+	}
+	if t.Type == "" && t.AltType == "" {
+		t.Type = "http"
+	}
+
+	s := sc.srv
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sc.lock.Lock()
+	for _, other := range sc.tunnels {
+		if other.BindAddr == bindAddr {
+			sc.lock.Unlock()
+			return nil, fmt.Errorf("duplicate forwarding for %s", bindAddr)
+		}
+	}
+	sc.lock.Unlock()
+
+	s.nextTunnelId++
+	if t.Host == "" {
+		t.Host = fmt.Sprintf("tunnel%d.%s", s.nextTunnelId, s.Domain)
+	}
+	t.Port = int(bindPort)
+	if t.Port == 0 {
+		s.nextPort++
+		t.Port = s.nextPort
+	}
+
+	sc.lock.Lock()
+	sc.tunnels = append(sc.tunnels, t)
+	sc.lock.Unlock()
+	s.tunnels = append(s.tunnels, t)
+
+	return t, nil
+}
+
+func (sc *serverConn) removeTunnel(bindHost string, port uint32) bool {
+	s := sc.srv
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for i, t := range sc.tunnels {
+		if t.bindHost == bindHost && t.Port == int(port) {
+			sc.tunnels = append(sc.tunnels[:i], sc.tunnels[i+1:]...)
+			for j, st := range s.tunnels {
+				if st == t {
+					s.tunnels = append(s.tunnels[:j], s.tunnels[j+1:]...)
+					break
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// primaryTunnel is the tunnel of the connection which /urls and /headerman are about.
+func (sc *serverConn) primaryTunnel() *Tunnel {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for _, t := range sc.tunnels {
+		if t.bindHost == "0.0.0.0" || t.bindHost == "" {
+			return t
+		}
+	}
+	if len(sc.tunnels) > 0 {
+		return sc.tunnels[0]
+	}
+	return nil
+}
+
+func (sc *serverConn) handleChannels(chans <-chan ssh.NewChannel) {
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go sc.handleSession(ch, reqs)
+		case "direct-tcpip":
+			var msg forwardedTCPPayload
+			if err := ssh.Unmarshal(newCh.ExtraData(), &msg); err != nil {
+				newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+				continue
+			}
+			handler := sc.portHandler(int(msg.Port))
+			if handler == nil {
+				newCh.Reject(ssh.ConnectionFailed, fmt.Sprintf("nothing listening on %s:%d", msg.Addr, msg.Port))
+				continue
+			}
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				defer ch.Close()
+				handler(ch)
+			}()
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (sc *serverConn) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var msg struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			sc.addCommand(msg.Command)
+			req.Reply(true, nil)
+			sc.printUrls(ch)
+		case "shell":
+			req.Reply(true, nil)
+			sc.printUrls(ch)
+		case "pty-req", "env", "window-change":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (sc *serverConn) addCommand(command string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.commands = append(sc.commands, command)
+	for _, word := range strings.Fields(command) {
+		if !strings.HasPrefix(word, "w:") {
+			continue
+		}
+		for _, w := range strings.Split(word[2:], ",") {
+			if !strings.Contains(w, "/") {
+				if strings.Contains(w, ":") {
+					w += "/128"
+				} else {
+					w += "/32"
+				}
+			}
+			if _, ipNet, err := net.ParseCIDR(w); err == nil {
+				sc.whitelist = append(sc.whitelist, ipNet)
+			}
+		}
+	}
+}
+
+func (sc *serverConn) printUrls(w io.Writer) {
+	sc.lock.Lock()
+	tunnels := append([]*Tunnel{}, sc.tunnels...)
+	sc.lock.Unlock()
+	fmt.Fprintln(w, "You are connected to the pinggy test server.")
+	for _, t := range tunnels {
+		for _, u := range t.Urls() {
+			fmt.Fprintln(w, u)
+		}
+	}
+}
+
+func (sc *serverConn) portHandler(port int) func(ch ssh.Channel) {
+	switch port {
+	case configPort:
+		return func(ch ssh.Channel) {
+			writeJson(ch, map[string]int{
+				"ConfigTcp":            configPort,
+				"UsageContinuousTcp":   usageContinuousPort,
+				"UsageOnceLongPollTcp": usageOnceLongPollPort,
+				"UsageTcp":             usagePort,
+				"UrlTcp":               urlPort,
+				"StatusPort":           statusPort,
+				"GreetingMsgTCP":       greetingPort,
+			})
+		}
+	case statusPort:
+		return func(ch ssh.Channel) { writeJson(ch, sc.status) }
+	case greetingPort:
+		return func(ch ssh.Channel) {
+			msgs := sc.srv.Greetings
+			if msgs == nil {
+				msgs = []string{}
+			}
+			writeJson(ch, struct{ Msgs []string }{msgs})
+		}
+	case urlPort:
+		return func(ch ssh.Channel) {
+			t := sc.primaryTunnel()
+			urls := []string{}
+			if t != nil {
+				urls = t.Urls()
+			}
+			writeJson(ch, map[string][]string{"urls": urls})
+		}
+	case usagePort:
+		return func(ch ssh.Channel) {
+			usage, _ := sc.currentUsage()
+			writeJson(ch, usage)
+		}
+	case usageOnceLongPollPort:
+		return func(ch ssh.Channel) {
+			_, updated := sc.currentUsage()
+			select {
+			case <-updated:
+			case <-closeNotify(ch):
+				return
+			}
+			usage, _ := sc.currentUsage()
+			writeJson(ch, usage)
+		}
+	case usageContinuousPort:
+		return func(ch ssh.Channel) {
+			closed := closeNotify(ch)
+			for {
+				usage, updated := sc.currentUsage()
+				if writeJson(ch, usage) != nil {
+					return
+				}
+				select {
+				case <-updated:
+				case <-closed:
+					return
+				}
+			}
+		}
+	case webDebuggerPort:
+		return sc.serveHttp
+	}
+	return nil
+}
+
+func (sc *serverConn) currentUsage() (pinggy.Usage, <-chan struct{}) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	usage := pinggy.Usage{}
+	if sc.usage != nil {
+		usage = *sc.usage
+	}
+	if usage.ElapsedTime == 0 {
+		usage.ElapsedTime = int64(time.Since(sc.started).Seconds())
+	}
+	return usage, sc.usageCond
+}
+
+func (sc *serverConn) setUsage(usage pinggy.Usage) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.usage = &usage
+	close(sc.usageCond)
+	sc.usageCond = make(chan struct{})
+}
+
+// serveHttp serves /urls, /headerman and a placeholder web debugger page.
+func (sc *serverConn) serveHttp(ch ssh.Channel) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/urls", func(w http.ResponseWriter, r *http.Request) {
+		t := sc.primaryTunnel()
+		if t == nil {
+			http.Error(w, "unknown tunnel", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"urls": t.Urls()})
+	})
+	mux.HandleFunc("/headerman", func(w http.ResponseWriter, r *http.Request) {
+		t := sc.primaryTunnel()
+		if t == nil {
+			http.Error(w, "unknown tunnel", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			data, err := io.ReadAll(r.Body)
+			if err != nil || !json.Valid(data) {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			t.lock.Lock()
+			t.headerManipulation = data
+			t.lock.Unlock()
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(t.HeaderManipulation())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "pinggy test server web debugger")
+	})
+
+	reader := bufio.NewReader(ch)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if req.URL.Host == "" {
+			req.URL = &url.URL{Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		req.Body.Close()
+
+		res := rec.Result()
+		res.ContentLength = int64(rec.Body.Len())
+		res.Close = req.Close
+		if res.Write(ch) != nil || req.Close {
+			return
+		}
+	}
+}
+
+func writeJson(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// closeNotify reads and discards the data from the channel and is closed once the peer closes it.
+func closeNotify(ch ssh.Channel) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ch)
+		close(closed)
+	}()
+	return closed
+}
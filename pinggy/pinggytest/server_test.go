@@ -0,0 +1,165 @@
+package pinggytest_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func newServer(t *testing.T) *pinggytest.Server {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Tokens = []string{"goodtoken"}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func connect(t *testing.T, srv *pinggytest.Server, conf pinggy.Config) pinggy.PinggyListener {
+	conf.Server = srv.Addr
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { pl.Close() })
+	return pl
+}
+
+func TestHttpTunnel(t *testing.T) {
+	srv := newServer(t)
+	hm := pinggy.CreateHeaderManipulationAndAuthConfig()
+	hm.AddBasicAuth("user", "pass")
+	pl := connect(t, srv, pinggy.Config{Type: pinggy.HTTP, HeaderManipulationAndAuth: hm})
+
+	urls := pl.RemoteUrls()
+	if len(urls) != 2 || !strings.HasPrefix(urls[0], "http://tunnel") {
+		t.Fatalf("unexpected urls: %v", urls)
+	}
+	tunnel := srv.Tunnels()[0]
+	if !strings.Contains(string(tunnel.HeaderManipulation()), "basicAuths") {
+		t.Fatalf("header manipulation not received: %s", tunnel.HeaderManipulation())
+	}
+
+	go http.Serve(pl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.RemoteAddr)
+	}))
+
+	res, err := srv.HTTPClient().Get(urls[1] + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.HasPrefix(string(body), "hello "+pinggytest.DefaultVisitorIP+":") {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestTcpTunnel(t *testing.T) {
+	srv := newServer(t)
+	pl := connect(t, srv, pinggy.Config{Token: "goodtoken", Type: pinggy.TCP})
+	tunnel := srv.Tunnels()[0]
+
+	go func() {
+		conn, err := pl.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	conn, err := tunnel.DialTCP("203.0.113.7:5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("tcp echo failed: %q %v", buf, err)
+	}
+	conn.Close()
+	if addr := pl.Addr().String(); addr != fmt.Sprintf("%s:%d", tunnel.Host, tunnel.Port) {
+		t.Fatalf("unexpected public address: %s", addr)
+	}
+}
+
+func TestTcpUdpTunnel(t *testing.T) {
+	srv := newServer(t)
+	pl := connect(t, srv, pinggy.Config{Token: "goodtoken", Type: pinggy.TCP, AltType: pinggy.UDP})
+	tunnel := srv.Tunnels()[0]
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pl.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pl.WriteTo(buf[:n], addr)
+		}
+	}()
+	udpConn, err := tunnel.DialUDP("203.0.113.8:5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpConn.Write([]byte("datagram"))
+	big := make([]byte, 64)
+	n, err := udpConn.Read(big)
+	if err != nil || string(big[:n]) != "datagram" {
+		t.Fatalf("udp echo failed: %q %v", big[:n], err)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	srv := newServer(t)
+	_, err := pinggy.ConnectWithConfig(pinggy.Config{
+		Token:  "badtoken",
+		Type:   pinggy.TCP,
+		Server: srv.Addr,
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err == nil || !strings.Contains(err.Error(), "Invalid token") {
+		t.Fatalf("expected invalid token error, got %v", err)
+	}
+}
+
+type usageListener chan string
+
+func (ul usageListener) Update(usage string) { ul <- usage }
+
+func TestUsagesAndWhitelist(t *testing.T) {
+	srv := newServer(t)
+	_, ipNet, _ := net.ParseCIDR("203.0.113.0/24")
+	pl := connect(t, srv, pinggy.Config{Type: pinggy.TCP, IpWhiteList: []*net.IPNet{ipNet}})
+	tunnel := srv.Tunnels()[0]
+
+	if _, err := tunnel.DialTCP("198.51.100.9:1000"); err == nil {
+		t.Fatal("visitor outside of whitelist was accepted")
+	}
+
+	updates := make(usageListener, 10)
+	if err := pl.SetUsagesUpdateListener(updates); err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+	tunnel.SetUsage(pinggy.Usage{ElapsedTime: 10, NumTotalTxBytes: 1234})
+	select {
+	case line := <-updates:
+		usage, err := pinggy.ParseUsage(line)
+		if err != nil || usage.NumTotalTxBytes != 1234 {
+			t.Fatalf("unexpected usage %q: %v", line, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("usage update not received")
+	}
+}
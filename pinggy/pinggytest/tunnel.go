@@ -0,0 +1,369 @@
+package pinggytest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+Tunnel is a reverse forwarding requested by a client.
+*/
+type Tunnel struct {
+	// Bind address as requested by the client, such as 0.0.0.0:0 or example.com:0.
+	BindAddr string
+
+	// Public hostname and port of the tunnel.
+	Host string
+	Port int
+
+	// Type is one of http, tcp, tls, tlstcp or empty. AltType is udp or empty.
+	Type    string
+	AltType string
+
+	// Token used by the client. Empty for the free tunnels.
+	Token string
+
+	conn     *serverConn
+	bindHost string
+
+	lock               sync.Mutex
+	headerManipulation []byte
+}
+
+/*
+Urls of the tunnel in the format returned by `/urls`.
+*/
+func (t *Tunnel) Urls() []string {
+	port := strconv.Itoa(t.Port)
+	var urls []string
+	switch t.Type {
+	case "http":
+		urls = append(urls, "http://"+t.Host, "https://"+t.Host)
+	case "tcp":
+		urls = append(urls, "tcp://"+net.JoinHostPort(t.Host, port))
+	case "tls":
+		urls = append(urls, "tls://"+t.Host)
+	case "tlstcp":
+		urls = append(urls, "tls://"+net.JoinHostPort(t.Host, port))
+	}
+	if t.AltType == "udp" {
+		urls = append(urls, "udp://"+net.JoinHostPort(t.Host, port))
+	}
+	return urls
+}
+
+/*
+Commands returns the remote commands (such as `w:1.2.3.4/32 x:localservertls`)
+received on the ssh connection of the tunnel.
+*/
+func (t *Tunnel) Commands() []string {
+	t.conn.lock.Lock()
+	defer t.conn.lock.Unlock()
+	return append([]string{}, t.conn.commands...)
+}
+
+/*
+Whitelist parsed from the `w:` commands. Visitors outside of it are refused by
+DialTCP and DialUDP.
+*/
+func (t *Tunnel) Whitelist() []*net.IPNet {
+	t.conn.lock.Lock()
+	defer t.conn.lock.Unlock()
+	return append([]*net.IPNet{}, t.conn.whitelist...)
+}
+
+/*
+HeaderManipulation returns the json received through `/headerman`. It is nil if
+nothing is received.
+*/
+func (t *Tunnel) HeaderManipulation() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.headerManipulation
+}
+
+/*
+SetUsage changes the usage reported on the ssh connection of the tunnel and pushes
+it to the usage streams. If ElapsedTime is zero, the time since the connection was
+established is reported.
+*/
+func (t *Tunnel) SetUsage(usage pinggy.Usage) {
+	t.conn.setUsage(usage)
+}
+
+/*
+Disconnect closes the ssh connection of the tunnel as if the server dropped it.
+*/
+func (t *Tunnel) Disconnect() error {
+	return t.conn.conn.Close()
+}
+
+func (t *Tunnel) visitor(visitor string) (*net.TCPAddr, error) {
+	if visitor == "" {
+		visitor = t.conn.srv.nextVisitorAddr()
+	}
+	addr, err := net.ResolveTCPAddr("tcp", visitor)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("visitor address must be an ip: %s", visitor)
+	}
+
+	whitelist := t.Whitelist()
+	if len(whitelist) == 0 {
+		return addr, nil
+	}
+	for _, ipNet := range whitelist {
+		if ipNet.Contains(addr.IP) {
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("visitor %s is not in the whitelist", visitor)
+}
+
+func (t *Tunnel) openChannel(visitor *net.TCPAddr) (ssh.Channel, error) {
+	payload := forwardedTCPPayload{
+		Addr:       t.bindHost,
+		Port:       uint32(t.Port),
+		OriginAddr: visitor.IP.String(),
+		OriginPort: uint32(visitor.Port),
+	}
+	ch, reqs, err := t.conn.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+/*
+DialTCP opens a visitor connection to the tunnel from the given visitor address
+(ip:port). A visitor address is generated if it is empty. For http tunnels the
+connection is passed as is, the test has to write the http request itself.
+*/
+func (t *Tunnel) DialTCP(visitor string) (net.Conn, error) {
+	if t.Type == "" {
+		return nil, fmt.Errorf("tunnel does not accept tcp connections")
+	}
+	addr, err := t.visitor(visitor)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := t.openChannel(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.AltType != "" {
+		err = socksHandshake(ch, socksCmdConnect, addr)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	return &channelConn{
+		Channel: ch,
+		local:   &net.TCPAddr{IP: net.IPv4zero, Port: t.Port},
+		remote:  addr,
+	}, nil
+}
+
+/*
+DialUDP opens a visitor flow to an udp tunnel. Every Write on the returned
+connection is delivered as a single datagram and every Read returns a single
+datagram.
+*/
+func (t *Tunnel) DialUDP(visitor string) (net.Conn, error) {
+	if t.AltType != "udp" {
+		return nil, fmt.Errorf("tunnel does not accept udp")
+	}
+	addr, err := t.visitor(visitor)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := t.openChannel(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.Type != "" {
+		err = socksHandshake(ch, socksCmdUdp, addr)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	return &datagramConn{
+		channelConn: channelConn{
+			Channel: ch,
+			local:   &net.UDPAddr{IP: net.IPv4zero, Port: t.Port},
+			remote:  &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone},
+		},
+	}, nil
+}
+
+/*
+DialContext connects to a public address of a tunnel, such as
+`tunnel1.a.pinggy.test:80`. It is suitable for http.Transport.
+*/
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	t := s.Tunnel(addr)
+	if t == nil {
+		return nil, fmt.Errorf("no tunnel for %s", addr)
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		return t.DialUDP("")
+	}
+	return t.DialTCP("")
+}
+
+/*
+HTTPClient returns a client which sends the requests for the tunnel urls through
+the server. The mock server does not terminate tls, https urls are sent over plain
+http as the pinggy server would forward them after decryption.
+*/
+func (s *Server) HTTPClient() *http.Client {
+	transport := &http.Transport{
+		DialContext:    s.DialContext,
+		DialTLSContext: s.DialContext,
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+type channelConn struct {
+	ssh.Channel
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr  { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *channelConn) SetDeadline(time.Time) error {
+	return errors.New("pinggytest: deadline not supported")
+}
+func (c *channelConn) SetReadDeadline(time.Time) error {
+	return errors.New("pinggytest: deadline not supported")
+}
+func (c *channelConn) SetWriteDeadline(time.Time) error {
+	return errors.New("pinggytest: deadline not supported")
+}
+
+// datagramConn frames the datagrams with a two byte length like the pinggy server.
+type datagramConn struct {
+	channelConn
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	var length [2]byte
+	_, err := io.ReadFull(c.Channel, length[:])
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(c.Channel, buf)
+	if err != nil {
+		return 0, err
+	}
+	// Excess bytes are dropped as with an udp socket.
+	return copy(p, buf), nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > 65535 {
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := c.Channel.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Pinggy marks the udp flows with command 4 rather than the udp associate of rfc1928.
+const (
+	socksCmdConnect = 1
+	socksCmdUdp     = 4
+)
+
+// socksHandshake does the client side of the socks5 handshake which the pinggy
+// server uses to multiplex tcp and udp over the same forwarding.
+func socksHandshake(conn io.ReadWriter, cmd byte, addr *net.TCPAddr) error {
+	_, err := conn.Write([]byte{5, 1, 0})
+	if err != nil {
+		return err
+	}
+	var method [2]byte
+	_, err = io.ReadFull(conn, method[:])
+	if err != nil {
+		return err
+	}
+	if method[0] != 5 || method[1] != 0 {
+		return fmt.Errorf("socks method rejected by client")
+	}
+
+	request := []byte{5, cmd, 0}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		request = append(request, 1)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 4)
+		request = append(request, addr.IP.To16()...)
+	}
+	request = append(request, byte(addr.Port>>8), byte(addr.Port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// Reply is read exactly, the tunnel data follows it immediately.
+	var reply [4]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("socks request rejected by client with code %d", reply[1])
+	}
+	skip := 2
+	switch reply[3] {
+	case 1:
+		skip += 4
+	case 4:
+		skip += 16
+	case 3:
+		var n [1]byte
+		_, err = io.ReadFull(conn, n[:])
+		if err != nil {
+			return err
+		}
+		skip += int(n[0])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	if err != nil {
+		return err
+	}
+	return nil
+}
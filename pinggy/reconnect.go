@@ -0,0 +1,152 @@
+package pinggy
+
+import (
+	"net"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+tunnelAcceptor accepts connections from the current listener of a
+pinggyListener. The underlying listener is replaced when the tunnel
+reconnects, so the acceptor keeps accepting from the new one instead of
+failing with the old one.
+*/
+type tunnelAcceptor struct {
+	pl  *pinggyListener
+	udp bool
+}
+
+func (ta *tunnelAcceptor) Accept() (net.Conn, error) {
+	for {
+		listener := ta.pl.currentListener(ta.udp)
+		client := ta.pl.client()
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if ta.pl.currentListener(ta.udp) != listener {
+			continue
+		}
+		if ta.pl.isShutdown() {
+			return nil, err
+		}
+		if err := ta.pl.sess.waitReconnect(ta.pl, client, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (ta *tunnelAcceptor) Close() error {
+	return ta.pl.currentListener(ta.udp).Close()
+}
+
+func (ta *tunnelAcceptor) Addr() net.Addr {
+	return ta.pl.currentListener(ta.udp).Addr()
+}
+
+// The acceptors reject the visitors denied by the ACL of the listener.
+func (pl *pinggyListener) tcpAcceptor() net.Listener {
+	return pl.acl.Listener(&tunnelAcceptor{pl: pl, udp: false})
+}
+
+func (pl *pinggyListener) udpAcceptor() net.Listener {
+	return pl.acl.Listener(&tunnelAcceptor{pl: pl, udp: true})
+}
+
+func (pl *pinggyListener) currentListener(udp bool) net.Listener {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if udp {
+		return pl.udpListener
+	}
+	return pl.listener
+}
+
+func (pl *pinggyListener) isShutdown() bool {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return pl.shutdown
+}
+
+func (pl *pinggyListener) client() *ssh.Client {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return pl.clientConn
+}
+
+func (pl *pinggyListener) ports() *pinggyPortConfig {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return pl.portConfig
+}
+
+func (pl *pinggyListener) ConnectedServer() ServerCandidate {
+	return pl.sess.Server()
+}
+
+func (pl *pinggyListener) RoundTripTime() time.Duration {
+	return pl.sess.RoundTripTime()
+}
+
+func (pl *pinggyListener) Reconnect() error {
+	return pl.sess.Reconnect()
+}
+
+// detachedCopy creates a listener with same configuration which can be attached
+// to a new ssh connection without disturbing the current one.
+func (pl *pinggyListener) detachedCopy() *pinggyListener {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return &pinggyListener{
+		conf:       pl.conf,
+		sess:       pl.sess,
+		bindAddr:   pl.bindAddr,
+		tcpChannel: pl.tcpChannel,
+		udpChannel: pl.udpChannel,
+		webDebug:   pl.webDebug,
+	}
+}
+
+// adopt moves the listener over to the connection attached to fresh and restores
+// the additional forwardings and the usages update on it.
+func (pl *pinggyListener) adopt(fresh *pinggyListener) {
+	pl.lock.Lock()
+	pl.clientConn = fresh.clientConn
+	pl.listener = fresh.listener
+	pl.udpListener = fresh.udpListener
+	pl.session = fresh.session
+	pl.portConfig = fresh.portConfig
+	pl.status = fresh.status
+	pl.usageConn = nil
+	pl.endpoints = fresh.endpoints
+	updateListener := pl.updateListener
+	additionalForwardings := pl.additionalForwardings
+	pl.additionalForwardings = map[string]tunnel.TunnelManager{}
+	pl.lock.Unlock()
+
+	for domain, tunnelMan := range additionalForwardings {
+		tunnelMan.Close()
+		dialer, ok := tunnelMan.GetDialer().(tunnel.TcpDialer)
+		if !ok {
+			continue
+		}
+		tcpTunnelMan, err := listenAdditionalForwarding(fresh.clientConn, domain, dialer, pl.tcpOptions(), pl.acl)
+		if err != nil {
+			pl.conf.Logger.Printf("Could not restore additional forwarding for %s: %v\n", domain, err)
+			continue
+		}
+		pl.lock.Lock()
+		pl.additionalForwardings[domain] = tcpTunnelMan
+		pl.lock.Unlock()
+	}
+
+	if updateListener != nil && fresh.portConfig != nil {
+		err := pl.startUsageStream()
+		if err != nil {
+			pl.conf.Logger.Println("Could not restart usages update:", err)
+		}
+	}
+}
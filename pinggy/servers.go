@@ -0,0 +1,208 @@
+package pinggy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ServerSelection is the strategy to choose a server out of Config.Servers.
+*/
+type ServerSelection string
+
+const (
+	// Try the servers in the given order.
+	ServerSelectionFailover ServerSelection = "failover"
+
+	// Measure the tcp connect time (and the tls handshake with SshOverSsl) to all
+	// the servers at once and try the fastest first.
+	ServerSelectionLowestLatency ServerSelection = "latency"
+
+	// Try the servers in a random order.
+	ServerSelectionRandom ServerSelection = "random"
+)
+
+/*
+ServerCandidate is a server which a tunnel can connect to.
+*/
+type ServerCandidate struct {
+	// Address of the server in host or host:port form. Default port is 443.
+	Address string
+
+	// Free form label of the server, such as "ap" or "eu". It is only reported back.
+	Region string
+}
+
+// Maximum time to measure the latency of a server when Config.Timeout is not set.
+const defaultProbeTimeout = 5 * time.Second
+
+func parseServerAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port. An ipv6 address may still be in brackets.
+		if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+			addr = addr[1 : len(addr)-1]
+		}
+		return addr, 443, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid server address %s: %v", addr, err)
+	}
+	return host, port, nil
+}
+
+/*
+probeServer connects to the server the same way as the ssh connection would and
+returns how long it took.
+*/
+func probeServer(conf *Config, server ServerCandidate) (time.Duration, error) {
+	host, port, err := parseServerAddr(server.Address)
+	if err != nil {
+		return 0, err
+	}
+	probeConf := *conf
+	if probeConf.Timeout <= 0 {
+		probeConf.Timeout = defaultProbeTimeout
+	}
+
+	start := time.Now()
+	conn, err := connectToServer(&probeConf, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if conf.SshOverSsl {
+		conn.SetDeadline(time.Now().Add(probeConf.Timeout))
+		err = tls.Client(conn, &tls.Config{ServerName: conf.sni}).Handshake()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
+
+/*
+orderServers returns the servers in the order they should be tried.
+*/
+func orderServers(conf *Config) []ServerCandidate {
+	servers := append([]ServerCandidate{}, conf.Servers...)
+	switch conf.ServerSelection {
+	case ServerSelectionRandom:
+		// The global source is not seeded before go 1.20.
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rng.Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+	case ServerSelectionLowestLatency:
+		latencies := make([]time.Duration, len(servers))
+		var wg sync.WaitGroup
+		for i := range servers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				latency, err := probeServer(conf, servers[i])
+				if err != nil {
+					conf.Logger.Printf("Server %s is not reachable: %v\n", servers[i].Address, err)
+					latency = -1
+				}
+				latencies[i] = latency
+			}(i)
+		}
+		wg.Wait()
+		// Unreachable servers are kept last, in case the probe was wrong.
+		order := make([]int, len(servers))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			la, lb := latencies[order[a]], latencies[order[b]]
+			if la < 0 || lb < 0 {
+				return lb < 0 && la >= 0
+			}
+			return la < lb
+		})
+		sorted := make([]ServerCandidate, len(servers))
+		for i, idx := range order {
+			sorted[i] = servers[idx]
+		}
+		servers = sorted
+	}
+	return servers
+}
+
+/*
+dial opens the ssh connection of the session. Without Config.Servers it connects
+to Config.Server. Otherwise the last good server is tried first, then the servers
+in the order of the selection strategy. The server connected to is remembered.
+*/
+func (s *Session) dial() (*ssh.Client, error) {
+	conf := s.conf
+	if len(conf.Servers) == 0 || conf.ServerConnection != nil {
+		clientConn, err := dialWithConfig(conf)
+		if err == nil {
+			s.setServer(ServerCandidate{Address: net.JoinHostPort(conf.Server, strconv.Itoa(conf.port))})
+		}
+		return clientConn, err
+	}
+
+	s.lock.Lock()
+	lastGood := s.server
+	s.lock.Unlock()
+
+	servers := orderServers(conf)
+	if lastGood.Address != "" {
+		ordered := []ServerCandidate{lastGood}
+		for _, server := range servers {
+			if server.Address != lastGood.Address {
+				ordered = append(ordered, server)
+			}
+		}
+		servers = ordered
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		host, port, err := parseServerAddr(server.Address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		serverConf := *conf
+		serverConf.Server = host
+		serverConf.port = port
+		clientConn, err := dialWithConfig(&serverConf)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.setServer(server)
+		return clientConn, nil
+	}
+	return nil, &ConnectError{Err: fmt.Errorf("could not connect to any server: %v", lastErr)}
+}
+
+func (s *Session) setServer(server ServerCandidate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.server = server
+}
+
+/*
+Server returns the server which the session is connected to, or connected to
+last.
+*/
+func (s *Session) Server() ServerCandidate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.server
+}
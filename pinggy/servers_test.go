@@ -0,0 +1,163 @@
+package pinggy_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+/*
+downProxy forwards tcp connections to the server unless it is down, in which case
+it closes them at once.
+*/
+type downProxy struct {
+	net.Listener
+	down int32
+}
+
+func newDownProxy(t *testing.T, target string) *downProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &downProxy{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&p.down) == 1 {
+				conn.Close()
+				continue
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(server, conn)
+				server.Close()
+			}()
+			go func() {
+				io.Copy(conn, server)
+				conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+func TestServerFailover(t *testing.T) {
+	start := func() *pinggytest.Server {
+		srv := pinggytest.NewUnstartedServer()
+		srv.Logger = log.New(io.Discard, "", 0)
+		srv.Start()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	eu := newDownProxy(t, start().Addr)
+	ap := start()
+
+	conf := pinggy.Config{
+		Type:   pinggy.TCP,
+		Logger: log.New(io.Discard, "", 0),
+		Servers: []pinggy.ServerCandidate{
+			{Address: eu.Addr().String(), Region: "eu"},
+			{Address: ap.Addr, Region: "ap"},
+		},
+	}
+
+	atomic.StoreInt32(&eu.down, 1)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	if server := pl.ConnectedServer(); server.Region != "ap" || server.Address != ap.Addr {
+		t.Fatalf("unexpected server %+v", server)
+	}
+
+	// The last good server is kept even though the first one is back.
+	atomic.StoreInt32(&eu.down, 0)
+	err = pl.Reconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := pl.ConnectedServer(); server.Region != "ap" {
+		t.Fatalf("unexpected server after reconnect %+v", server)
+	}
+
+	// A new tunnel uses the first server again.
+	first, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if server := first.ConnectedServer(); server.Region != "eu" {
+		t.Fatalf("unexpected server %+v", server)
+	}
+}
+
+func TestServerLowestLatency(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// A port which refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	pl, err := pinggy.ConnectWithConfig(pinggy.Config{
+		Type:            pinggy.TCP,
+		Logger:          log.New(io.Discard, "", 0),
+		ServerSelection: pinggy.ServerSelectionLowestLatency,
+		Servers: []pinggy.ServerCandidate{
+			{Address: closed, Region: "closed"},
+			{Address: srv.Addr, Region: "local"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	if server := pl.ConnectedServer(); server.Region != "local" {
+		t.Fatalf("unexpected server %+v", server)
+	}
+}
+
+func TestParseServerAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"a.pinggy.io", "a.pinggy.io", 443},
+		{"a.pinggy.io:7000", "a.pinggy.io", 7000},
+		{"192.0.2.1", "192.0.2.1", 443},
+		{"2001:db8::1", "2001:db8::1", 443},
+		{"[2001:db8::1]", "2001:db8::1", 443},
+		{"[2001:db8::1]:7000", "2001:db8::1", 7000},
+	}
+	for _, test := range tests {
+		host, port, err := pinggy.ParseServerAddr(test.addr)
+		if err != nil || host != test.host || port != test.port {
+			t.Errorf("%s: got %s %d %v", test.addr, host, port, err)
+		}
+	}
+	if _, _, err := pinggy.ParseServerAddr("a.pinggy.io:ssh"); err == nil {
+		t.Error("invalid port was accepted")
+	}
+}
@@ -0,0 +1,326 @@
+package pinggy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const primaryBindAddr = "0.0.0.0:0"
+
+/*
+TunnelConfig configures one tunnel of a Session. The connection related
+configurations such as Token, Server and Proxy are taken from the session Config.
+*/
+type TunnelConfig struct {
+	/*
+		Tunnel type. The tunnel without a Domain has the type of the session Config,
+		so it can be empty or the same type. The tunnels of the domains are HTTP.
+	*/
+	Type TunnelType
+
+	/*
+		Alternate tunnel type. It can be empty or the AltType of the session Config
+		for the tunnel without a Domain. It has to be empty for the domains.
+	*/
+	AltType UDPTunnelType
+
+	/*
+		Domain for the tunnel. It has to be a domain already configured for the token.
+		Keep it empty for the tunnel of the session Config.
+	*/
+	Domain string
+
+	/*
+		Automatically forward connection to this address. Keep empty to disable it.
+	*/
+	TcpForwardingAddr string
+
+	/*
+		Automatically forward udp packet to this address. Keep empty to disable it.
+	*/
+	UdpForwardingAddr string
+
+	/*
+		IP Whitelist. The server applies it to the whole connection, so it can be
+		set only for the tunnel without a Domain.
+	*/
+	IpWhiteList []*net.IPNet
+
+	/*
+		Forwarded local server connection configuration. TlsLocalServer applies to
+		the whole connection, so it can be set only for the tunnel without a Domain.
+	*/
+	ForwardedConnectionConf *ForwardedConnectionConf
+
+	/*
+		Configure Header Manipulation, Basic auth, and Bearer auth for HTTP tunnels.
+		The server applies it to the whole connection, so it can be set only for the
+		tunnel without a Domain.
+	*/
+	HeaderManipulationAndAuth HttpHeaderManipulationAndAuthConfig
+}
+
+/*
+Session owns a single ssh connection to the pinggy server and can open several
+tunnels over it. Each tunnel is returned as its own PinggyListener.
+
+The pinggy server takes the tunnel type from the ssh user name when the connection
+is made, and gives the connection one tunnel of that type. So a session has one
+tunnel of the type in the session Config, which is opened with an empty
+TunnelConfig.Domain, and HTTP tunnels for the domains configured for the token, the
+same way as StartAdditionalForwarding. TCP, TLS or UDP tunnels besides the one of
+the session Config are not possible on the same connection. They need a session
+each, eg. one session for the HTTP tunnel and its domains and one for a TCP tunnel.
+
+Reconnecting any of the tunnels reconnects the session and moves all the tunnels
+to the new connection. Closing a tunnel closes only that tunnel, while closing the
+session closes all of them.
+*/
+type Session struct {
+	// Round trip time of the last keepalive in nanoseconds.
+	rtt int64
+
+	conf *Config
+
+	lock       sync.Mutex
+	clientConn *ssh.Client
+	listeners  []*pinggyListener
+	shutdown   bool
+
+	// Server of the current connection, tried first on reconnect.
+	server ServerCandidate
+
+	// connChanged is closed when the listeners moved to a new clientConn or the
+	// session is closed.
+	connChanged chan struct{}
+
+	// reconnectLock serializes Reconnect and Listen.
+	reconnectLock sync.Mutex
+}
+
+/*
+Create a session with the config. Type and AltType of the config is used for the
+ssh user and for the tunnel opened with an empty TunnelConfig.Domain.
+*/
+func NewSession(conf Config) (*Session, error) {
+	err := conf.verify()
+	if err != nil {
+		return nil, err
+	}
+	return newSession(conf)
+}
+
+func newSession(conf Config) (*Session, error) {
+	s := &Session{conf: &conf, connChanged: make(chan struct{})}
+	clientConn, err := s.dial()
+	if err != nil {
+		conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
+		return nil, err
+	}
+	conf.Logger.Println("Ssh connection initiated. Setting up reverse tunnel")
+
+	s.clientConn = clientConn
+	go s.monitor(clientConn)
+	return s, nil
+}
+
+/*
+Open a new tunnel in the session. It fails for a tunnel without a Domain whose type
+differs from the session Config. Domain tunnels are HTTP and need a session of type
+HTTP, they get the http and https endpoints of their domain.
+*/
+func (s *Session) Listen(tc TunnelConfig) (PinggyListener, error) {
+	conf := *s.conf
+	conf.TcpForwardingAddr = tc.TcpForwardingAddr
+	conf.UdpForwardingAddr = tc.UdpForwardingAddr
+	conf.ForwardedConnectionConf = tc.ForwardedConnectionConf
+
+	bindAddr := primaryBindAddr
+	if tc.Domain == "" {
+		if (tc.Type != "" || tc.AltType != "") && (tc.Type != s.conf.Type || tc.AltType != s.conf.AltType) {
+			return nil, fmt.Errorf("the session is for %s tunnels, another type needs its own session", s.tunnelType())
+		}
+		conf.IpWhiteList = tc.IpWhiteList
+		conf.HeaderManipulationAndAuth = tc.HeaderManipulationAndAuth
+	} else {
+		if (tc.Type != "" && tc.Type != HTTP) || tc.AltType != "" {
+			return nil, fmt.Errorf("tunnels of the domains can only be %s", HTTP)
+		}
+		if s.conf.Type != HTTP || s.conf.AltType != "" {
+			// The server serves the domains like the http tunnel of the connection.
+			return nil, fmt.Errorf("tunnels of the domains need a session of type %s", HTTP)
+		}
+		if len(tc.IpWhiteList) > 0 || tc.HeaderManipulationAndAuth != nil ||
+			(tc.ForwardedConnectionConf != nil && tc.ForwardedConnectionConf.TlsLocalServer) {
+			return nil, fmt.Errorf("ip whitelist, header manipulation and local tls apply to the whole connection, set them for the tunnel without a domain")
+		}
+		conf.Type = HTTP
+		conf.AltType = ""
+		conf.IpWhiteList = nil
+		conf.HeaderManipulationAndAuth = nil
+
+		host, port, err := net.SplitHostPort(tc.Domain)
+		if err != nil {
+			host = tc.Domain
+			port = "0"
+		}
+		bindAddr = net.JoinHostPort(host, port)
+	}
+	conf.verifyTunnel()
+
+	s.lock.Lock()
+	for _, pl := range s.listeners {
+		if pl.bindAddr == bindAddr {
+			s.lock.Unlock()
+			if tc.Domain == "" {
+				return nil, fmt.Errorf("tunnel of type %s already exists in the session", s.tunnelType())
+			}
+			return nil, fmt.Errorf("tunnel of domain %s already exists in the session", tc.Domain)
+		}
+	}
+	s.lock.Unlock()
+
+	return s.listen(conf, bindAddr)
+}
+
+func (s *Session) tunnelType() string {
+	typ := string(s.conf.Type)
+	if s.conf.AltType != "" {
+		if typ != "" {
+			typ += "+"
+		}
+		typ += string(s.conf.AltType)
+	}
+	return typ
+}
+
+func (s *Session) listen(conf Config, bindAddr string) (*pinggyListener, error) {
+	s.reconnectLock.Lock()
+	defer s.reconnectLock.Unlock()
+
+	s.lock.Lock()
+	shutdown := s.shutdown
+	s.lock.Unlock()
+	if shutdown {
+		return nil, fmt.Errorf("session is closed")
+	}
+
+	list, err := newPinggyListener(s, conf, bindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.listeners = append(s.listeners, list)
+	s.lock.Unlock()
+
+	return list, nil
+}
+
+func (s *Session) remove(pl *pinggyListener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, l := range s.listeners {
+		if l == pl {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Session) client() *ssh.Client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.clientConn
+}
+
+/*
+Reconnect opens a new ssh connection with the same configuration and moves all the
+tunnels of the session over to it. The old connection is closed once the new one is ready.
+*/
+func (s *Session) Reconnect() error {
+	if s.conf.ServerConnection != nil {
+		return fmt.Errorf("cannot reconnect a tunnel created with ServerConnection")
+	}
+
+	s.reconnectLock.Lock()
+	defer s.reconnectLock.Unlock()
+
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		return fmt.Errorf("session is closed")
+	}
+	listeners := append([]*pinggyListener{}, s.listeners...)
+	s.lock.Unlock()
+
+	s.conf.Logger.Println("Reconnecting to the server")
+	clientConn, err := s.dial()
+	if err != nil {
+		s.conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
+		return err
+	}
+
+	fresh := make([]*pinggyListener, len(listeners))
+	for i, pl := range listeners {
+		fresh[i] = pl.detachedCopy()
+		err = fresh[i].attach(clientConn)
+		if err != nil {
+			clientConn.Close()
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		clientConn.Close()
+		return fmt.Errorf("session is closed")
+	}
+	oldClient := s.clientConn
+	s.clientConn = clientConn
+	s.lock.Unlock()
+
+	go s.monitor(clientConn)
+
+	for i, pl := range listeners {
+		pl.adopt(fresh[i])
+	}
+
+	s.lock.Lock()
+	if !s.shutdown {
+		close(s.connChanged)
+		s.connChanged = make(chan struct{})
+	}
+	s.lock.Unlock()
+
+	oldClient.Close()
+
+	return nil
+}
+
+/*
+Close the ssh connection along with all the tunnels.
+*/
+func (s *Session) Close() error {
+	s.lock.Lock()
+	if !s.shutdown {
+		close(s.connChanged)
+	}
+	s.shutdown = true
+	listeners := append([]*pinggyListener{}, s.listeners...)
+	clientConn := s.clientConn
+	s.lock.Unlock()
+
+	for _, pl := range listeners {
+		pl.lock.Lock()
+		pl.shutdown = true
+		pl.lock.Unlock()
+		pl.closeLocal()
+	}
+
+	return clientConn.Close()
+}
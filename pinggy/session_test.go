@@ -0,0 +1,163 @@
+package pinggy_test
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+func newSession(t *testing.T, conf pinggy.Config) (*pinggytest.Server, *pinggy.Session) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	sconf := srv.Config()
+	sconf.Type = conf.Type
+	sconf.AltType = conf.AltType
+	sconf.Logger = log.New(io.Discard, "", 0)
+	sess, err := pinggy.NewSession(sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	return srv, sess
+}
+
+// acceptVisitor dials the tunnel of host and waits for pl to accept the visitor.
+func acceptVisitor(t *testing.T, srv *pinggytest.Server, host string, pl pinggy.PinggyListener) {
+	t.Helper()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	tun := srv.Tunnel(host)
+	if tun == nil {
+		t.Fatalf("no tunnel for %s", host)
+	}
+	visitor, err := tun.DialTCP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("visitor of %s was not accepted", host)
+	}
+}
+
+func TestSession(t *testing.T) {
+	srv, sess := newSession(t, pinggy.Config{Type: pinggy.HTTP})
+
+	primary, err := sess.Listen(pinggy.TunnelConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := sess.Listen(pinggy.TunnelConfig{Domain: "api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ipNet, _ := net.ParseCIDR("203.0.113.0/24")
+	for _, tc := range []pinggy.TunnelConfig{
+		{},
+		{Type: pinggy.TCP},
+		{Domain: "api.example.com"},
+		{Domain: "other.example.com", Type: pinggy.TCP},
+		{Domain: "other.example.com", AltType: pinggy.UDP},
+		{Domain: "other.example.com", IpWhiteList: []*net.IPNet{ipNet}},
+	} {
+		if _, err := sess.Listen(tc); err == nil {
+			t.Errorf("%+v: expected an error", tc)
+		}
+	}
+
+	if tunnels := srv.Tunnels(); len(tunnels) != 2 || tunnels[0].Token != tunnels[1].Token {
+		t.Fatalf("unexpected tunnels %+v", tunnels)
+	}
+	urls := api.RemoteUrls()
+	if len(urls) != 2 || urls[0] != "http://api.example.com" || urls[1] != "https://api.example.com" {
+		t.Fatalf("unexpected urls of the domain %v", urls)
+	}
+	host := srv.Tunnels()[0].Host
+	if addr := primary.Addr().String(); addr != host+":443" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+	if addr := api.PublicAddr(); addr == nil || addr.String() != "api.example.com:443" || api.Addr().String() != addr.String() {
+		t.Fatalf("unexpected address of the domain %v", addr)
+	}
+	acceptVisitor(t, srv, host, primary)
+	acceptVisitor(t, srv, "api.example.com", api)
+
+	// Both tunnels move to the new connection.
+	err = sess.Reconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.Tunnel(host) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("old connection was not closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	acceptVisitor(t, srv, primary.Addr().String(), primary)
+	acceptVisitor(t, srv, "api.example.com", api)
+
+	// Closing a tunnel keeps the other one.
+	api.Close()
+	if _, err := api.Accept(); err == nil {
+		t.Fatal("accepted on a closed tunnel")
+	}
+	acceptVisitor(t, srv, primary.Addr().String(), primary)
+
+	sess.Close()
+	if _, err := primary.Accept(); err == nil {
+		t.Fatal("accepted after the session was closed")
+	}
+}
+
+func TestSessionDomainNeedsHttp(t *testing.T) {
+	_, sess := newSession(t, pinggy.Config{Type: pinggy.TCP})
+	if _, err := sess.Listen(pinggy.TunnelConfig{Domain: "api.example.com"}); err == nil {
+		t.Fatal("domain tunnel opened in a tcp session")
+	}
+}
+
+func TestSessionCloseDebugForward(t *testing.T) {
+	_, sess := newSession(t, pinggy.Config{Type: pinggy.HTTP})
+	pl, err := sess.Listen(pinggy.TunnelConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	err = pl.InitiateDebugForward(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess.Close()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("debug forwarding is still listening after the session was closed")
+	}
+}
@@ -0,0 +1,20 @@
+package socks
+
+import (
+	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks/codec"
+)
+
+/*
+Addr is an address as carried in socks requests, replies and udp datagrams. Either
+IP or Host is set, Host being a domain name.
+*/
+type Addr = codec.Addr
+
+/*
+AddrFromNetAddr converts a net.Addr into Addr. Unresolved host names are kept as domain.
+*/
+func AddrFromNetAddr(addr net.Addr) (*Addr, error) {
+	return codec.FromNetAddr(addr)
+}
@@ -0,0 +1,129 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+type AuthMethod byte
+
+const (
+	AuthMethod_NoAuth       AuthMethod = 0
+	AuthMethod_GssApi       AuthMethod = 1
+	AuthMethod_UserPass     AuthMethod = 2
+	AuthMethod_NoAcceptable AuthMethod = 255
+)
+
+const (
+	userPassVersion       = 1
+	userPassStatusSuccess = 0
+	userPassStatusFailure = 1
+)
+
+/*
+CredentialValidator checks the username and password sent by the client with the
+username/password authentication (rfc1929).
+*/
+type CredentialValidator interface {
+	Validate(username, password string) bool
+}
+
+/*
+CredentialValidatorFunc adapts a function to CredentialValidator.
+*/
+type CredentialValidatorFunc func(username, password string) bool
+
+func (f CredentialValidatorFunc) Validate(username, password string) bool {
+	return f(username, password)
+}
+
+/*
+StaticCredentials is a CredentialValidator with a fixed map of username to password.
+*/
+type StaticCredentials map[string]string
+
+func (sc StaticCredentials) Validate(username, password string) bool {
+	expected, ok := sc[username]
+	return ok && expected == password
+}
+
+/*
+selectMethod picks the authentication method among the ones offered by the client.
+Username/password is required when a validator is set, no authentication otherwise.
+GSSAPI is never selected.
+*/
+func selectMethod(methods []byte, validator CredentialValidator) AuthMethod {
+	wanted := AuthMethod_NoAuth
+	if validator != nil {
+		wanted = AuthMethod_UserPass
+	}
+	for _, m := range methods {
+		if AuthMethod(m) == wanted {
+			return wanted
+		}
+	}
+	return AuthMethod_NoAcceptable
+}
+
+/*
+negotiateAuth reads the method selection message after the version byte, replies
+with the selected method and runs the sub-negotiation if required.
+*/
+func negotiateAuth(conn net.Conn, nmethods byte, validator CredentialValidator) error {
+	methods := make([]byte, nmethods)
+	_, err := io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+
+	method := selectMethod(methods, validator)
+	_, err = conn.Write([]byte{5, byte(method)})
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case AuthMethod_NoAuth:
+		return nil
+	case AuthMethod_UserPass:
+		return authenticateUserPass(conn, validator)
+	}
+	return fmt.Errorf("no acceptable authentication method offered: %v", methods)
+}
+
+func authenticateUserPass(conn net.Conn, validator CredentialValidator) error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != userPassVersion {
+		conn.Write([]byte{userPassVersion, userPassStatusFailure})
+		return fmt.Errorf("unsupported username/password auth version: %d", header[0])
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return err
+	}
+
+	plen := make([]byte, 1)
+	_, err = io.ReadFull(conn, plen)
+	if err != nil {
+		return err
+	}
+	password := make([]byte, plen[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+
+	if !validator.Validate(string(username), string(password)) {
+		conn.Write([]byte{userPassVersion, userPassStatusFailure})
+		return fmt.Errorf("authentication failed for user %q", username)
+	}
+
+	_, err = conn.Write([]byte{userPassVersion, userPassStatusSuccess})
+	return err
+}
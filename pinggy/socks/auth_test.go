@@ -0,0 +1,87 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSelectMethod(t *testing.T) {
+	validator := StaticCredentials{"user": "pass"}
+	tests := []struct {
+		methods   []byte
+		validator CredentialValidator
+		want      AuthMethod
+	}{
+		{[]byte{0}, nil, AuthMethod_NoAuth},
+		{[]byte{1, 2, 0}, nil, AuthMethod_NoAuth},
+		{[]byte{1, 2}, nil, AuthMethod_NoAcceptable},
+		{[]byte{0, 2}, validator, AuthMethod_UserPass},
+		{[]byte{0}, validator, AuthMethod_NoAcceptable},
+		{[]byte{1}, validator, AuthMethod_NoAcceptable},
+		{nil, nil, AuthMethod_NoAcceptable},
+	}
+	for _, test := range tests {
+		if got := selectMethod(test.methods, test.validator); got != test.want {
+			t.Errorf("%v (validator %v): selected %d, expected %d", test.methods, test.validator != nil, got, test.want)
+		}
+	}
+}
+
+/*
+negotiate runs negotiateAuth against a client which sends the given bytes and
+returns the error and everything the server replied.
+*/
+func negotiate(t *testing.T, validator CredentialValidator, methods []byte, client []byte) ([]byte, error) {
+	t.Helper()
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- negotiateAuth(server, byte(len(methods)), validator)
+		server.Close()
+	}()
+
+	go func() {
+		conn.Write(append(append([]byte{}, methods...), client...))
+	}()
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	return reply, <-done
+}
+
+func userPass(version byte, username, password string) []byte {
+	b := []byte{version, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func TestNegotiateAuth(t *testing.T) {
+	validator := StaticCredentials{"user": "pass"}
+	tests := []struct {
+		name      string
+		validator CredentialValidator
+		methods   []byte
+		client    []byte
+		reply     []byte
+		ok        bool
+	}{
+		{"no auth", nil, []byte{0}, nil, []byte{5, 0}, true},
+		{"gssapi only", nil, []byte{1}, nil, []byte{5, 0xff}, false},
+		{"no auth offered", validator, []byte{0}, nil, []byte{5, 0xff}, false},
+		{"credentials", validator, []byte{0, 2}, userPass(1, "user", "pass"), []byte{5, 2, 1, 0}, true},
+		{"bad password", validator, []byte{2}, userPass(1, "user", "wrong"), []byte{5, 2, 1, 1}, false},
+		{"unknown user", validator, []byte{2}, userPass(1, "other", "pass"), []byte{5, 2, 1, 1}, false},
+		{"version", validator, []byte{2}, userPass(5, "user", "pass"), []byte{5, 2, 1, 1}, false},
+	}
+	for _, test := range tests {
+		reply, err := negotiate(t, test.validator, test.methods, test.client)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !bytes.Equal(reply, test.reply) {
+			t.Errorf("%s: replied %v, expected %v", test.name, reply, test.reply)
+		}
+	}
+}
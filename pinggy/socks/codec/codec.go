@@ -0,0 +1,274 @@
+/*
+Package codec encodes and decodes the messages of the socks5 protocol (rfc1928):
+requests, replies and the udp request header. IPv4, IPv6 and domain name
+addresses are supported.
+*/
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const Version = 5
+
+const (
+	AddrTypeIPv4   = 1
+	AddrTypeDomain = 3
+	AddrTypeIPv6   = 4
+)
+
+/*
+Addr is an address as carried in socks requests, replies and udp datagrams. Either
+IP or Host is set, Host being a domain name.
+*/
+type Addr struct {
+	IP   net.IP
+	Host string
+	Port int
+}
+
+func (a *Addr) Network() string { return "socks5" }
+
+func (a *Addr) String() string {
+	host := a.Host
+	if a.IP != nil {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+/*
+UDPAddr returns the address as *net.UDPAddr. Domain names are returned as *Addr
+as they are not resolved.
+*/
+func (a *Addr) UDPAddr() net.Addr {
+	if a.IP == nil {
+		return a
+	}
+	return &net.UDPAddr{IP: a.IP, Port: a.Port}
+}
+
+/*
+TCPAddr returns the address as *net.TCPAddr. Domain names are returned as *Addr
+as they are not resolved.
+*/
+func (a *Addr) TCPAddr() net.Addr {
+	if a.IP == nil {
+		return a
+	}
+	return &net.TCPAddr{IP: a.IP, Port: a.Port}
+}
+
+/*
+ParseAddr parses "host:port". Hosts which are not ip addresses are kept as domain
+names.
+*/
+func ParseAddr(hostport string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", hostport)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &Addr{IP: ip, Port: port}, nil
+	}
+	return &Addr{Host: host, Port: port}, nil
+}
+
+/*
+FromNetAddr converts a net.Addr into Addr. Unresolved host names are kept as domain.
+*/
+func FromNetAddr(addr net.Addr) (*Addr, error) {
+	switch a := addr.(type) {
+	case *Addr:
+		return a, nil
+	case *net.UDPAddr:
+		return &Addr{IP: a.IP, Port: a.Port}, nil
+	case *net.TCPAddr:
+		return &Addr{IP: a.IP, Port: a.Port}, nil
+	}
+	return ParseAddr(addr.String())
+}
+
+/*
+ReadAddr reads ATYP, address and port.
+*/
+func ReadAddr(r io.Reader) (*Addr, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &Addr{}
+	switch atyp[0] {
+	case AddrTypeIPv4:
+		ip := make([]byte, net.IPv4len)
+		_, err = io.ReadFull(r, ip)
+		addr.IP = net.IP(ip)
+	case AddrTypeIPv6:
+		ip := make([]byte, net.IPv6len)
+		_, err = io.ReadFull(r, ip)
+		addr.IP = net.IP(ip)
+	case AddrTypeDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err != nil {
+			return nil, err
+		}
+		if length[0] == 0 {
+			return nil, fmt.Errorf("empty domain name")
+		}
+		host := make([]byte, length[0])
+		_, err = io.ReadFull(r, host)
+		addr.Host = string(host)
+	default:
+		return nil, fmt.Errorf("unsupported address type: %d", atyp[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port))
+	return addr, nil
+}
+
+/*
+AppendAddr appends ATYP, address and port to b. Nil addr is encoded as 0.0.0.0:0.
+*/
+func AppendAddr(b []byte, addr *Addr) ([]byte, error) {
+	if addr == nil {
+		addr = &Addr{IP: net.IPv4zero}
+	}
+	if addr.Port < 0 || addr.Port > 65535 {
+		return nil, fmt.Errorf("invalid port: %d", addr.Port)
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, AddrTypeIPv4)
+		b = append(b, ip4...)
+	} else if ip6 := addr.IP.To16(); ip6 != nil {
+		b = append(b, AddrTypeIPv6)
+		b = append(b, ip6...)
+	} else if addr.IP != nil {
+		return nil, fmt.Errorf("invalid ip address: %v", addr.IP)
+	} else {
+		if len(addr.Host) == 0 || len(addr.Host) > 255 {
+			return nil, fmt.Errorf("invalid domain name: %q", addr.Host)
+		}
+		b = append(b, AddrTypeDomain, byte(len(addr.Host)))
+		b = append(b, addr.Host...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port)), nil
+}
+
+/*
+Request sent by the client after the authentication.
+*/
+type Request struct {
+	Cmd byte
+	Dst *Addr
+}
+
+/*
+ReadRequest reads VER, CMD, RSV and the destination address.
+*/
+func ReadRequest(r io.Reader) (*Request, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	dst, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Cmd: header[1], Dst: dst}, nil
+}
+
+/*
+AppendRequest appends the encoded request to b.
+*/
+func AppendRequest(b []byte, req *Request) ([]byte, error) {
+	return AppendAddr(append(b, Version, req.Cmd, 0), req.Dst)
+}
+
+/*
+Reply sent by the server to a request. Bound is the address the server bound for
+the request. Nil Bound is encoded as 0.0.0.0:0.
+*/
+type Reply struct {
+	Code  byte
+	Bound *Addr
+}
+
+/*
+ReadReply reads VER, REP, RSV and the bound address.
+*/
+func ReadReply(r io.Reader) (*Reply, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	bound, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{Code: header[1], Bound: bound}, nil
+}
+
+/*
+AppendReply appends the encoded reply to b.
+*/
+func AppendReply(b []byte, rep *Reply) ([]byte, error) {
+	return AppendAddr(append(b, Version, rep.Code, 0), rep.Bound)
+}
+
+/*
+ParseDatagram parses an udp datagram with the udp request header. Payload shares
+the memory of b.
+*/
+func ParseDatagram(b []byte) (dst *Addr, frag byte, payload []byte, err error) {
+	if len(b) < 4 {
+		return nil, 0, nil, fmt.Errorf("datagram too short: %d bytes", len(b))
+	}
+	frag = b[2]
+	reader := bytes.NewReader(b[3:])
+	dst, err = ReadAddr(reader)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	payload = b[len(b)-reader.Len():]
+	return dst, frag, payload, nil
+}
+
+/*
+AppendDatagram appends an udp datagram with the udp request header to b. FRAG is
+always 0.
+*/
+func AppendDatagram(b []byte, dst *Addr, payload []byte) ([]byte, error) {
+	b, err := AppendAddr(append(b, 0, 0, 0), dst)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     Request
+		encoded []byte
+	}{
+		{"ipv4", Request{Cmd: 1, Dst: &Addr{IP: net.IPv4(192, 168, 1, 10), Port: 8080}},
+			[]byte{5, 1, 0, 1, 192, 168, 1, 10, 0x1f, 0x90}},
+		{"ipv6", Request{Cmd: 3, Dst: &Addr{IP: net.ParseIP("2001:db8::1"), Port: 53}},
+			[]byte{5, 3, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}},
+		{"domain", Request{Cmd: 4, Dst: &Addr{Host: "example.com", Port: 443}},
+			append(append([]byte{5, 4, 0, 3, 11}, "example.com"...), 1, 0xbb)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := AppendRequest(nil, &tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.encoded) {
+				t.Fatalf("encoded %v, want %v", b, tt.encoded)
+			}
+			req, err := ReadRequest(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Cmd != tt.req.Cmd || req.Dst.String() != tt.req.Dst.String() {
+				t.Fatalf("decoded %d %v, want %d %v", req.Cmd, req.Dst, tt.req.Cmd, tt.req.Dst)
+			}
+		})
+	}
+}
+
+func TestReplyBoundAddr(t *testing.T) {
+	b, err := AppendReply(nil, &Reply{Code: 0, Bound: &Addr{IP: net.ParseIP("10.1.2.3"), Port: 1080}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Bound.String() != "10.1.2.3:1080" {
+		t.Fatalf("bound %v", rep.Bound)
+	}
+
+	b, _ = AppendReply(nil, &Reply{Code: 7})
+	if !bytes.Equal(b, []byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("encoded %v", b)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	invalid := [][]byte{
+		{},
+		{4, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+		{5, 1, 0, 2, 1, 2, 3, 4, 0, 80},
+		{5, 1, 0, 1, 1, 2, 3, 4, 0},
+		{5, 1, 0, 3, 0, 0, 80},
+		{5, 1, 0, 3, 5, 'a', 'b'},
+	}
+	for _, b := range invalid {
+		if _, err := ReadRequest(bytes.NewReader(b)); err == nil {
+			t.Errorf("request %v decoded without error", b)
+		}
+	}
+	if _, err := AppendAddr(nil, &Addr{Port: 80}); err == nil {
+		t.Error("empty domain encoded without error")
+	}
+	if _, err := AppendAddr(nil, &Addr{IP: net.IPv4(1, 2, 3, 4), Port: 65536}); err == nil {
+		t.Error("invalid port encoded without error")
+	}
+}
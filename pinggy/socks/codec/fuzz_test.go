@@ -0,0 +1,91 @@
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkRoundTrip decodes b, encodes the result and decodes it again.
+func checkRoundTrip(t *testing.T, dst *Addr, encode func() ([]byte, error), decode func([]byte) (*Addr, error)) {
+	b, err := encode()
+	if err != nil {
+		t.Fatalf("cannot encode %v: %v", dst, err)
+	}
+	again, err := decode(b)
+	if err != nil {
+		t.Fatalf("cannot decode %v: %v", b, err)
+	}
+	if again.String() != dst.String() {
+		t.Fatalf("round trip changed %v into %v", dst, again)
+	}
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 3, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0})
+	f.Add(append(append([]byte{5, 1, 0, 3, 9}, "pinggy.io"...), 1, 0xbb))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		checkRoundTrip(t, req.Dst, func() ([]byte, error) {
+			return AppendRequest(nil, req)
+		}, func(b []byte) (*Addr, error) {
+			again, err := ReadRequest(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			if again.Cmd != req.Cmd {
+				t.Fatalf("round trip changed cmd %d into %d", req.Cmd, again.Cmd)
+			}
+			return again.Dst, nil
+		})
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	f.Add([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{5, 5, 0, 4, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 0x38})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rep, err := ReadReply(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		checkRoundTrip(t, rep.Bound, func() ([]byte, error) {
+			return AppendReply(nil, rep)
+		}, func(b []byte) (*Addr, error) {
+			again, err := ReadReply(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return again.Bound, nil
+		})
+	})
+}
+
+func FuzzParseDatagram(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53, 'h', 'i'})
+	f.Add(append(append([]byte{0, 0, 1, 3, 4}, "host"...), 0, 7))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		dst, _, payload, err := ParseDatagram(b)
+		if err != nil {
+			return
+		}
+		checkRoundTrip(t, dst, func() ([]byte, error) {
+			return AppendDatagram(nil, dst, payload)
+		}, func(b []byte) (*Addr, error) {
+			again, frag, p, err := ParseDatagram(b)
+			if err != nil {
+				return nil, err
+			}
+			if frag != 0 || !bytes.Equal(p, payload) {
+				t.Fatalf("round trip changed payload %v into %v", payload, p)
+			}
+			return again, nil
+		})
+	})
+}
@@ -8,12 +8,19 @@ const (
 	ConnType_NONE ConnType = 0
 	ConnType_TCP  ConnType = 1
 	ConnType_UDP  ConnType = 2
+
+	// UDP ASSOCIATE of rfc1928. The datagrams are relayed over udp.
+	ConnType_UdpAssociate ConnType = 3
 )
 
 type SocksCmd byte
 
 const (
-	SocksCmd_Connect    SocksCmd = 1
+	SocksCmd_Connect      SocksCmd = 1
+	SocksCmd_Bind         SocksCmd = 2
+	SocksCmd_UdpAssociate SocksCmd = 3
+
+	// Pinggy specific. Datagrams are sent over the same stream with two byte length framing.
 	SocksCmd_UdpConnect SocksCmd = 4
 )
 
@@ -31,11 +38,31 @@ const (
 	ReplyType_AddressTypeNotSupported ReplyType = 8
 )
 
+/*
+Configuration of the socks layer.
+*/
+type Socks5uConfig struct {
+	// Validator for username/password authentication. No authentication is required if it is nil.
+	Validator CredentialValidator
+
+	// Accept UDP ASSOCIATE requests (rfc1928). The udp flows with pinggy framing
+	// (SocksCmd_UdpConnect) are accepted regardless.
+	UdpAssociate bool
+
+	// Address to bind the udp relays to. Default is the local ip of the control
+	// connection with a random port. The reply carries the local address of the
+	// relay, so the clients must be able to reach it directly. A relay is never
+	// reachable through a pinggy tunnel; set an address of a public interface or
+	// keep UdpAssociate off when the listener is a tunnel.
+	UdpRelayAddr string
+}
+
 type Socks5u interface {
 	net.Listener
 
 	AcceptTcp() (net.Conn, net.Addr, error)
 	AcceptUdp() (net.Conn, net.Addr, error)
+	AcceptUdpAssociate() (*UdpAssociation, error)
 	StripSockFromConn(net.Conn) (net.Addr, ConnType, error)
 	AcceptAndStripSock(net.Listener) (net.Conn, net.Addr, ConnType, error)
 	Start()
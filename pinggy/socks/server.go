@@ -0,0 +1,465 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
+)
+
+/*
+Rule allows or denies destinations. A rule matches when all of its non-empty
+fields match the destination.
+*/
+type Rule struct {
+	Allow bool
+
+	// Destination network, such as 10.0.0.0/8.
+	Network *net.IPNet
+
+	// Destination domain. A leading dot matches all the subdomains, such as
+	// `.internal`, otherwise the name has to match exactly. Domain rules are
+	// checked only when the client sends a domain name.
+	Domain string
+
+	// Destination port range. Zero PortMax means PortMin only.
+	PortMin int
+	PortMax int
+}
+
+func (r *Rule) matchPort(port int) bool {
+	if r.PortMin == 0 && r.PortMax == 0 {
+		return true
+	}
+	max := r.PortMax
+	if max == 0 {
+		max = r.PortMin
+	}
+	return port >= r.PortMin && port <= max
+}
+
+func (r *Rule) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain := strings.ToLower(r.Domain)
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(host, domain) || host == domain[1:]
+	}
+	return host == domain
+}
+
+/*
+ServerConfig configures the socks5 server.
+*/
+type ServerConfig struct {
+	// Validator for username/password authentication. No authentication is required if it is nil.
+	Validator CredentialValidator
+
+	// Rules are checked in order and the first matching one decides. Destinations
+	// matching no rule are allowed unless DefaultDeny is set. The server refuses
+	// to serve when none of Validator, Rules and DefaultDeny is set.
+	//
+	// Loopback, link-local (including the cloud metadata address 169.254.169.254)
+	// and unspecified destinations are denied unless an allow rule with a Network
+	// containing them matches.
+	Rules       []Rule
+	DefaultDeny bool
+
+	// Commands enabled in addition to CONNECT.
+	EnableBind         bool
+	EnableUdpAssociate bool
+
+	// Address to listen on for BIND. Default is any address with a random port.
+	BindAddr string
+
+	// Address to bind the udp relays to. Default is the local ip of the control
+	// connection with a random port. The clients send their datagrams to the relay
+	// directly, it is not reachable through a pinggy tunnel. Only the replies from
+	// the destinations the client sent to are relayed back.
+	UdpRelayAddr string
+
+	// Timeout for dialing the destinations and for waiting the incoming
+	// connection of BIND. Default 30 seconds.
+	Timeout time.Duration
+
+	// Used for dialing the destinations. Default is net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger for the destinations and their usage. Default logger is used if it is nil.
+	Logger *log.Logger
+}
+
+/*
+Server is a socks5 server supporting CONNECT, BIND and UDP ASSOCIATE.
+*/
+type Server struct {
+	conf ServerConfig
+}
+
+func NewServer(conf ServerConfig) *Server {
+	if conf.Timeout <= 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	if conf.Dial == nil {
+		dialer := &net.Dialer{Timeout: conf.Timeout}
+		conf.Dial = dialer.DialContext
+	}
+	if conf.Logger == nil {
+		conf.Logger = log.Default()
+	}
+	return &Server{conf: conf}
+}
+
+// open reports whether anyone reaching the server could use it for any destination.
+func (s *Server) open() bool {
+	return s.conf.Validator == nil && len(s.conf.Rules) == 0 && !s.conf.DefaultDeny
+}
+
+/*
+Serve accepts the connections from the listener and serves them. It returns the
+error from Accept.
+*/
+func (s *Server) Serve(listener net.Listener) error {
+	if s.open() {
+		return fmt.Errorf("socks server needs a Validator, Rules or DefaultDeny")
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+/*
+ServeConn serves a single client connection and closes it when done.
+*/
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	if s.open() {
+		return fmt.Errorf("socks server needs a Validator, Rules or DefaultDeny")
+	}
+	client := conn.RemoteAddr().String()
+
+	version, nmethods, err := readHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if version != 5 {
+		return fmt.Errorf("unsupported socks version: %d", version)
+	}
+	err = negotiateAuth(conn, nmethods, s.conf.Validator)
+	if err != nil {
+		s.conf.Logger.Printf("socks: %s: %v\n", client, err)
+		return err
+	}
+
+	cmd, dst, err := readRequestAddr(conn)
+	if err != nil {
+		writeReply(conn, ReplyType_GeneralFailure, nil)
+		return err
+	}
+
+	switch SocksCmd(cmd) {
+	case SocksCmd_Connect:
+		return s.connect(conn, client, dst)
+	case SocksCmd_Bind:
+		if s.conf.EnableBind {
+			return s.bind(conn, client, dst)
+		}
+	case SocksCmd_UdpAssociate:
+		if s.conf.EnableUdpAssociate {
+			return s.associate(conn, client, dst)
+		}
+	}
+	writeReply(conn, ReplyType_CommandNotSupported, nil)
+	return fmt.Errorf("unsupported command: %d", cmd)
+}
+
+/*
+resolve checks the destination against the rules and returns the address to dial.
+Domain names are resolved here so that the checked ip is the one dialed.
+*/
+func (s *Server) resolve(ctx context.Context, dst *Addr) (*Addr, ReplyType, error) {
+	if dst.IP == nil {
+		for i := range s.conf.Rules {
+			r := &s.conf.Rules[i]
+			if r.Domain != "" && r.Network == nil && r.matchDomain(dst.Host) && r.matchPort(dst.Port) {
+				if !r.Allow {
+					return nil, ReplyType_NotAllowed, fmt.Errorf("denied by rule for %s", r.Domain)
+				}
+				break
+			}
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, dst.Host)
+		if err != nil || len(ips) == 0 {
+			return nil, ReplyType_HostUnreachable, fmt.Errorf("cannot resolve %s: %v", dst.Host, err)
+		}
+		var lastErr error
+		for _, ip := range ips {
+			resolved := &Addr{IP: ip.IP, Host: dst.Host, Port: dst.Port}
+			if _, err := s.check(resolved); err != nil {
+				lastErr = err
+				continue
+			}
+			return &Addr{IP: ip.IP, Port: dst.Port}, ReplyType_Success, nil
+		}
+		return nil, ReplyType_NotAllowed, lastErr
+	}
+
+	reply, err := s.check(dst)
+	if err != nil {
+		return nil, reply, err
+	}
+	return dst, ReplyType_Success, nil
+}
+
+// isLocal reports whether the ip is on this machine or its link, such as the metadata service.
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// check applies the rules to the destination. Host is set when the ip was resolved from it.
+func (s *Server) check(dst *Addr) (ReplyType, error) {
+	local := isLocal(dst.IP)
+	for i := range s.conf.Rules {
+		r := &s.conf.Rules[i]
+		if !r.matchPort(dst.Port) {
+			continue
+		}
+		if r.Network != nil && !r.Network.Contains(dst.IP) {
+			continue
+		}
+		if r.Domain != "" && (dst.Host == "" || !r.matchDomain(dst.Host)) {
+			continue
+		}
+		if r.Allow {
+			if local && r.Network == nil {
+				continue
+			}
+			return ReplyType_Success, nil
+		}
+		return ReplyType_NotAllowed, fmt.Errorf("denied by rule")
+	}
+	if local {
+		return ReplyType_NotAllowed, fmt.Errorf("local destination")
+	}
+	if s.conf.DefaultDeny {
+		return ReplyType_NotAllowed, fmt.Errorf("no rule allows it")
+	}
+	return ReplyType_Success, nil
+}
+
+func (s *Server) connect(conn net.Conn, client string, dst *Addr) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.Timeout)
+	defer cancel()
+
+	target, reply, err := s.resolve(ctx, dst)
+	if err != nil {
+		s.conf.Logger.Printf("socks: %s CONNECT %s denied: %v\n", client, dst, err)
+		writeReply(conn, reply, nil)
+		return err
+	}
+
+	remote, err := s.conf.Dial(ctx, "tcp", target.String())
+	if err != nil {
+		s.conf.Logger.Printf("socks: %s CONNECT %s failed: %v\n", client, dst, err)
+		writeReply(conn, dialErrorReply(err), nil)
+		return err
+	}
+	defer remote.Close()
+
+	err = writeReply(conn, ReplyType_Success, remote.LocalAddr())
+	if err != nil {
+		return err
+	}
+
+	s.conf.Logger.Printf("socks: %s CONNECT %s\n", client, dst)
+	up, down := relay(conn, remote)
+	s.conf.Logger.Printf("socks: %s CONNECT %s closed, sent %d bytes, received %d bytes\n", client, dst, up, down)
+	return nil
+}
+
+func (s *Server) bind(conn net.Conn, client string, dst *Addr) error {
+	// DST.ADDR of BIND is the peer expected to connect.
+	if dst.IP != nil && !dst.IP.IsUnspecified() {
+		if reply, err := s.check(dst); err != nil {
+			s.conf.Logger.Printf("socks: %s BIND %s denied: %v\n", client, dst, err)
+			writeReply(conn, reply, nil)
+			return err
+		}
+	}
+
+	bindAddr := s.conf.BindAddr
+	if bindAddr == "" {
+		bindAddr = ":0"
+	}
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		writeReply(conn, ReplyType_GeneralFailure, nil)
+		return err
+	}
+	defer listener.Close()
+
+	err = writeReply(conn, ReplyType_Success, listener.Addr())
+	if err != nil {
+		return err
+	}
+	s.conf.Logger.Printf("socks: %s BIND %s listening at %s\n", client, dst, listener.Addr())
+
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(s.conf.Timeout))
+	}
+	var peer net.Conn
+	for {
+		peer, err = listener.Accept()
+		if err != nil {
+			writeReply(conn, ReplyType_TtlExpired, nil)
+			return err
+		}
+		peerAddr, _ := peer.RemoteAddr().(*net.TCPAddr)
+		if dst.IP == nil || dst.IP.IsUnspecified() || (peerAddr != nil && peerAddr.IP.Equal(dst.IP)) {
+			break
+		}
+		// Connection from an unexpected peer.
+		peer.Close()
+	}
+	defer peer.Close()
+
+	err = writeReply(conn, ReplyType_Success, peer.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	up, down := relay(conn, peer)
+	s.conf.Logger.Printf("socks: %s BIND %s closed, sent %d bytes, received %d bytes\n", client, peer.RemoteAddr(), up, down)
+	return nil
+}
+
+func (s *Server) associate(conn net.Conn, client string, dst *Addr) error {
+	relayConn, err := listenRelay(conn, s.conf.UdpRelayAddr)
+	if err != nil {
+		writeReply(conn, ReplyType_GeneralFailure, nil)
+		return err
+	}
+	outbound, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		relayConn.Close()
+		writeReply(conn, ReplyType_GeneralFailure, nil)
+		return err
+	}
+	defer outbound.Close()
+
+	err = writeReply(conn, ReplyType_Success, relayConn.LocalAddr())
+	if err != nil {
+		relayConn.Close()
+		return err
+	}
+
+	assoc := newUdpAssociation(conn, relayConn, dst)
+	defer assoc.Close()
+	s.conf.Logger.Printf("socks: %s UDP ASSOCIATE relay at %s\n", client, relayConn.LocalAddr())
+
+	// Destinations the client sent to. Only their replies reach the client.
+	var sentLock sync.Mutex
+	sent := make(map[string]bool)
+
+	// Replies from the destinations to the client.
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := outbound.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sentLock.Lock()
+			ok := sent[from.String()]
+			sentLock.Unlock()
+			if !ok {
+				continue
+			}
+			if _, err := assoc.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Cache of the checked destinations. Domain names are resolved once.
+	allowed := make(map[string]net.Addr)
+	buf := make([]byte, 65535)
+	for {
+		n, target, err := assoc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		key := target.String()
+		udpAddr, ok := allowed[key]
+		if !ok {
+			dstAddr, _ := AddrFromNetAddr(target)
+			ctx, cancel := context.WithTimeout(context.Background(), s.conf.Timeout)
+			resolved, _, err := s.resolve(ctx, dstAddr)
+			cancel()
+			if err != nil {
+				s.conf.Logger.Printf("socks: %s UDP %s denied: %v\n", client, key, err)
+				continue
+			}
+			s.conf.Logger.Printf("socks: %s UDP %s\n", client, key)
+			udpAddr = &net.UDPAddr{IP: resolved.IP, Port: resolved.Port}
+			allowed[key] = udpAddr
+			sentLock.Lock()
+			sent[udpAddr.String()] = true
+			sentLock.Unlock()
+		}
+		outbound.WriteTo(buf[:n], udpAddr)
+	}
+}
+
+func dialErrorReply(err error) ReplyType {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyType_ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyType_NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyType_HostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return ReplyType_HostUnreachable
+	}
+	return ReplyType_GeneralFailure
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies in both directions with tunnel.Copy until both sides are done and
+// returns the byte counts.
+func relay(client, remote net.Conn) (up, down int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		up, _ = tunnel.Copy(remote, client)
+		if cw, ok := remote.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			remote.Close()
+		}
+	}()
+	down, _ = tunnel.Copy(client, remote)
+	if cw, ok := client.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		client.Close()
+	}
+	wg.Wait()
+	return
+}
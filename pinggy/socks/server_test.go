@@ -0,0 +1,305 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks/codec"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// loopback allows the destinations of the tests, which are all on this machine.
+var loopback = Rule{Allow: true, Network: mustCIDR("127.0.0.0/8")}
+
+func startServer(t *testing.T, conf ServerConfig) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if conf.Logger == nil {
+		conf.Logger = log.New(io.Discard, "", 0)
+	}
+	go NewServer(conf).Serve(l)
+	return l.Addr().String()
+}
+
+// request connects to the server without authentication, sends the command and returns the first reply.
+func request(t *testing.T, server string, cmd SocksCmd, dst *Addr) (net.Conn, *codec.Reply) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b, err := codec.AppendRequest([]byte{5, 1, 0}, &codec.Request{Cmd: byte(cmd), Dst: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != byte(AuthMethod_NoAuth) {
+		t.Fatalf("method selection %v: %v", method, err)
+	}
+	reply, err := codec.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply
+}
+
+func echoServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func expectEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	echo := echoServer(t)
+	server := startServer(t, ServerConfig{Rules: []Rule{loopback}})
+
+	conn, reply := request(t, server, SocksCmd_Connect, &Addr{IP: echo.IP, Port: echo.Port})
+	if reply.Code != byte(ReplyType_Success) {
+		t.Fatalf("reply %d", reply.Code)
+	}
+	expectEcho(t, conn, "hello")
+
+	// The server resolves the domain names itself.
+	conn, reply = request(t, server, SocksCmd_Connect, &Addr{Host: "localhost", Port: echo.Port})
+	if reply.Code != byte(ReplyType_Success) {
+		t.Fatalf("reply %d for localhost", reply.Code)
+	}
+	expectEcho(t, conn, "domain")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().(*net.TCPAddr)
+	l.Close()
+	if _, reply := request(t, server, SocksCmd_Connect, &Addr{IP: closed.IP, Port: closed.Port}); reply.Code != byte(ReplyType_ConnectionRefused) {
+		t.Fatalf("reply %d for a closed port", reply.Code)
+	}
+}
+
+func TestServerRules(t *testing.T) {
+	echo := echoServer(t)
+	dst := &Addr{IP: echo.IP, Port: echo.Port}
+	tests := []struct {
+		name  string
+		conf  ServerConfig
+		dst   *Addr
+		reply ReplyType
+	}{
+		{"network allowed", ServerConfig{Rules: []Rule{loopback}}, dst, ReplyType_Success},
+		{"port denied", ServerConfig{Rules: []Rule{{Network: loopback.Network, PortMin: echo.Port}, loopback}}, dst, ReplyType_NotAllowed},
+		{"other port allowed", ServerConfig{Rules: []Rule{{Network: loopback.Network, PortMin: echo.Port + 1, PortMax: echo.Port + 10}, loopback}}, dst, ReplyType_Success},
+		{"domain denied", ServerConfig{Rules: []Rule{{Domain: ".localhost"}, loopback}}, &Addr{Host: "localhost", Port: echo.Port}, ReplyType_NotAllowed},
+		{"default deny", ServerConfig{DefaultDeny: true}, &Addr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, ReplyType_NotAllowed},
+		{"loopback", ServerConfig{Rules: []Rule{{Allow: true}}}, dst, ReplyType_NotAllowed},
+		{"loopback by domain", ServerConfig{Rules: []Rule{{Allow: true, Domain: "localhost"}}}, &Addr{Host: "localhost", Port: echo.Port}, ReplyType_NotAllowed},
+		{"metadata", ServerConfig{Rules: []Rule{{Allow: true}}}, &Addr{IP: net.IPv4(169, 254, 169, 254), Port: 80}, ReplyType_NotAllowed},
+		{"ipv6 link-local", ServerConfig{Rules: []Rule{{Allow: true}}}, &Addr{IP: net.ParseIP("fe80::1"), Port: 80}, ReplyType_NotAllowed},
+		{"unspecified", ServerConfig{Rules: []Rule{{Allow: true}}}, &Addr{IP: net.IPv4zero, Port: echo.Port}, ReplyType_NotAllowed},
+	}
+	for _, test := range tests {
+		server := startServer(t, test.conf)
+		if _, reply := request(t, server, SocksCmd_Connect, test.dst); reply.Code != byte(test.reply) {
+			t.Errorf("%s: reply %d, expected %d", test.name, reply.Code, test.reply)
+		}
+	}
+
+	// Anyone reaching an unrestricted server could use it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := NewServer(ServerConfig{}).Serve(l); err == nil {
+		t.Fatal("served without a Validator, Rules or DefaultDeny")
+	}
+}
+
+func TestServerBind(t *testing.T) {
+	server := startServer(t, ServerConfig{Rules: []Rule{loopback}, EnableBind: true, BindAddr: "127.0.0.1:0"})
+
+	conn, reply := request(t, server, SocksCmd_Bind, &Addr{IP: net.IPv4zero})
+	if reply.Code != byte(ReplyType_Success) {
+		t.Fatalf("reply %d", reply.Code)
+	}
+	peer, err := net.Dial("tcp", reply.Bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err = codec.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != byte(ReplyType_Success) || reply.Bound.String() != peer.LocalAddr().String() {
+		t.Fatalf("second reply %d with %v, expected the peer %v", reply.Code, reply.Bound, peer.LocalAddr())
+	}
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+
+	// Disabled by default.
+	server = startServer(t, ServerConfig{Rules: []Rule{loopback}})
+	if _, reply := request(t, server, SocksCmd_Bind, &Addr{IP: net.IPv4zero}); reply.Code != byte(ReplyType_CommandNotSupported) {
+		t.Fatalf("reply %d without EnableBind", reply.Code)
+	}
+}
+
+func TestServerUdpAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	server := startServer(t, ServerConfig{Rules: []Rule{loopback}, EnableUdpAssociate: true, UdpRelayAddr: "127.0.0.1:0"})
+	_, reply := request(t, server, SocksCmd_UdpAssociate, &Addr{IP: net.IPv4zero})
+	if reply.Code != byte(ReplyType_Success) {
+		t.Fatalf("reply %d", reply.Code)
+	}
+	client, err := net.Dial("udp", reply.Bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echoAddr, _ := AddrFromNetAddr(echo.LocalAddr())
+	datagram, _ := AppendUdpDatagram(nil, echoAddr, []byte("hello"))
+	if _, err := client.Write(datagram); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _, payload, err := ParseUdpDatagram(buf[:n])
+	if err != nil || string(payload) != "hello" || src.String() != echo.LocalAddr().String() {
+		t.Fatalf("received %q from %v: %v", payload, src, err)
+	}
+
+	// Only the destinations the client sent to can answer through the relay.
+	peerAddr, _ := AddrFromNetAddr(peer.LocalAddr())
+	datagram, _ = AppendUdpDatagram(nil, peerAddr, []byte("probe"))
+	client.Write(datagram)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, outbound, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger.WriteTo([]byte("unsolicited"), outbound)
+	peer.WriteTo(buf[:n], outbound)
+
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _, payload, err = ParseUdpDatagram(buf[:n])
+	if err != nil || string(payload) != "probe" || src.String() != peer.LocalAddr().String() {
+		t.Fatalf("received %q from %v: %v", payload, src, err)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialErrorReply(t *testing.T) {
+	tests := []struct {
+		err   error
+		reply ReplyType
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ReplyType_ConnectionRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, ReplyType_NetworkUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, ReplyType_HostUnreachable},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, ReplyType_HostUnreachable},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ReplyType_HostUnreachable},
+		{errors.New("connection refused by policy"), ReplyType_GeneralFailure},
+	}
+	for _, test := range tests {
+		if reply := dialErrorReply(test.err); reply != test.reply {
+			t.Errorf("%v: reply %d, expected %d", test.err, reply, test.reply)
+		}
+	}
+}
@@ -5,20 +5,24 @@ import (
 	"io"
 	"log"
 	"net"
-	"strings"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks/codec"
 )
 
 type strippedConn struct {
-	conn net.Conn
-	addr net.Addr
-	err  error
+	conn  net.Conn
+	addr  net.Addr
+	assoc *UdpAssociation
+	err   error
 }
 
 type socksStriper struct {
 	listener net.Listener
+	conf     Socks5uConfig
 
-	udpConnections chan *strippedConn
-	tcpConnections chan *strippedConn
+	udpConnections  chan *strippedConn
+	tcpConnections  chan *strippedConn
+	udpAssociations chan *strippedConn
 }
 
 func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cType ConnType, err error) {
@@ -39,33 +43,14 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 		return
 	}
 
-	methods := make([]byte, nmethods)
-	// Read and discard methods
-	_, err = io.ReadFull(clientConn, methods)
+	err = negotiateAuth(clientConn, nmethods, s.conf.Validator)
 	if err != nil {
-		log.Println("Error reading methods:", err)
-		return
-	}
-	acceptedMethod := byte(255)
-	for m := range methods {
-		if m == 0 {
-			acceptedMethod = 0
-		}
-	}
-	// Respond to the client with a "no authentication required" message
-	_, err = clientConn.Write([]byte{5, acceptedMethod})
-	if err != nil {
-		log.Println("Error responding to client:", err)
-		return
-	}
-
-	if acceptedMethod == 255 {
-		err = fmt.Errorf("no acceptable authentication found")
+		log.Println("Error during authentication:", err)
 		return
 	}
 
 	// Read the request
-	cmd, addrStr, err := readRequest(clientConn)
+	req, err := codec.ReadRequest(clientConn)
 	if err != nil {
 		log.Println("Error reading request:", err)
 		return
@@ -73,35 +58,72 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 
 	reply := ReplyType_Success
 
-	if SocksCmd_Connect == SocksCmd(cmd) {
+	switch SocksCmd(req.Cmd) {
+	case SocksCmd_Connect:
 		cType = ConnType_TCP
-		addr, err = net.ResolveTCPAddr("tcp", addrStr)
-		if err != nil {
-			reply = ReplyType_AddressTypeNotSupported
+		addr, err = resolveAddr("tcp", req.Dst)
+	case SocksCmd_UdpAssociate:
+		if !s.conf.UdpAssociate {
+			err = fmt.Errorf("udp associate is not enabled")
+			reply = ReplyType_CommandNotSupported
+			break
 		}
-	} else if SocksCmd_UdpConnect == SocksCmd(cmd) {
+		return s.associate(clientConn, req.Dst)
+	case SocksCmd_UdpConnect:
 		cType = ConnType_UDP
-		addr, err = net.ResolveUDPAddr("udp", addrStr)
-		if err != nil {
-			reply = ReplyType_AddressTypeNotSupported
-		}
-	} else {
-		err = fmt.Errorf("unsupported command. Ignoring")
+		addr, err = resolveAddr("udp", req.Dst)
+	default:
+		err = fmt.Errorf("unsupported command %d. Ignoring", req.Cmd)
 		reply = ReplyType_CommandNotSupported
 	}
+	if err != nil && reply == ReplyType_Success {
+		reply = ReplyType_HostUnreachable
+	}
 
-	// Respond to the client that the connection is established
-	_, err1 := clientConn.Write([]byte{5, byte(reply), 0, 1, 0, 0, 0, 0, 0, 0})
+	// Respond to the client with the address the connection is bound to
+	var bound net.Addr
+	if reply == ReplyType_Success {
+		bound = clientConn.LocalAddr()
+	}
+	err1 := writeReply(clientConn, reply, bound)
 	if err1 != nil {
 		err = err1
 		log.Println("Error responding to client:", err)
 		return
 	}
+	if err != nil {
+		return
+	}
 
 	log.Println("Striping done")
 	return
 }
 
+/*
+associate binds the relay for UDP ASSOCIATE and replies with its address. The
+association is delivered through AcceptUdpAssociate.
+*/
+func (s *socksStriper) associate(clientConn net.Conn, declared *Addr) (addr net.Addr, cType ConnType, err error) {
+	cType = ConnType_UdpAssociate
+
+	relay, err := listenRelay(clientConn, s.conf.UdpRelayAddr)
+	if err != nil {
+		writeReply(clientConn, ReplyType_GeneralFailure, nil)
+		return
+	}
+
+	err = writeReply(clientConn, ReplyType_Success, relay.LocalAddr())
+	if err != nil {
+		relay.Close()
+		return
+	}
+
+	addr = relay.LocalAddr()
+	s.udpAssociations <- &strippedConn{conn: clientConn, addr: addr, assoc: newUdpAssociation(clientConn, relay, declared)}
+	log.Println("Udp association ready at", addr)
+	return
+}
+
 func (s *socksStriper) AcceptAndStripSock(listener net.Listener) (clientConn net.Conn, addr net.Addr, cType ConnType, err error) {
 	clientConn, addr, cType, err = nil, nil, ConnType_NONE, nil
 
@@ -128,6 +150,9 @@ func (s *socksStriper) Start() {
 			log.Println("Error while accepting a connection: ", err)
 			s.udpConnections <- &strippedConn{err: err}
 			s.tcpConnections <- &strippedConn{err: err}
+			if s.conf.UdpAssociate {
+				s.udpAssociations <- &strippedConn{err: err}
+			}
 			return
 		}
 
@@ -141,6 +166,7 @@ func (s *socksStriper) Start() {
 				return
 			}
 			log.Println("Connection striped, ", addr, " ", cType, " ")
+			// Udp associations are queued by StripSockFromConn itself.
 			if ConnType_UDP == cType {
 				s.udpConnections <- &strippedConn{conn: clientConn, addr: addr}
 			} else if ConnType_TCP == cType {
@@ -162,6 +188,15 @@ func (s *socksStriper) AcceptUdp() (net.Conn, net.Addr, error) {
 	return sock.conn, sock.addr, sock.err
 }
 
+/*
+AcceptUdpAssociate returns the next udp association. Associations are accepted
+only if enabled with Socks5uConfig.UdpAssociate.
+*/
+func (s *socksStriper) AcceptUdpAssociate() (*UdpAssociation, error) {
+	sock := <-s.udpAssociations
+	return sock.assoc, sock.err
+}
+
 func (s *socksStriper) Accept() (net.Conn, error) {
 	c, _, err := s.AcceptTcp()
 	return c, err
@@ -176,10 +211,25 @@ func (s *socksStriper) Addr() net.Addr {
 }
 
 func InitiatateSocks5u(listener net.Listener) Socks5u {
+	return InitiatateSocks5uWithAuth(listener, nil)
+}
+
+/*
+Same as InitiatateSocks5u, but the clients have to authenticate with username and
+password (rfc1929) which are checked with the validator. No authentication is
+required if the validator is nil.
+*/
+func InitiatateSocks5uWithAuth(listener net.Listener, validator CredentialValidator) Socks5u {
+	return InitiatateSocks5uWithConfig(listener, Socks5uConfig{Validator: validator})
+}
+
+func InitiatateSocks5uWithConfig(listener net.Listener, conf Socks5uConfig) Socks5u {
 	return &socksStriper{
-		listener:       listener,
-		udpConnections: make(chan *strippedConn, 5),
-		tcpConnections: make(chan *strippedConn, 5),
+		listener:        listener,
+		conf:            conf,
+		udpConnections:  make(chan *strippedConn, 5),
+		tcpConnections:  make(chan *strippedConn, 5),
+		udpAssociations: make(chan *strippedConn, 5),
 	}
 }
 
@@ -194,50 +244,55 @@ func readHandshake(conn net.Conn) (version, nmethods byte, err error) {
 	return
 }
 
-func readRequest(conn net.Conn) (cmd byte, addr string, err error) {
-	request := make([]byte, 5)
-	_, err = io.ReadFull(conn, request)
+func readRequestAddr(conn net.Conn) (cmd byte, dst *Addr, err error) {
+	req, err := codec.ReadRequest(conn)
 	if err != nil {
 		return
 	}
+	return req.Cmd, req.Dst, nil
+}
 
-	cmd = request[1]
-
-	switch request[3] {
-	case 1: // IPv4 address
-		ip := make([]byte, 5) //1 byte already read
-		_, err = io.ReadFull(conn, ip)
-		if err != nil {
-			return
+// resolveAddr converts dst into a tcp or udp address. Domain names are resolved.
+func resolveAddr(network string, dst *Addr) (net.Addr, error) {
+	if dst.IP == nil {
+		if network == "udp" {
+			return net.ResolveUDPAddr(network, dst.String())
 		}
-		addr = fmt.Sprintf("%d.%d.%d.%d:%d", request[4], ip[0], ip[1], ip[2], (int(request[3])<<8)+int(request[4]))
-	case 3: // Domain name
-		domainLen := int(request[4])
-		domain := make([]byte, domainLen+2)
-		_, err = io.ReadFull(conn, domain)
-		if err != nil {
-			return
-		}
-		addr = fmt.Sprintf("%s:%d", domain[:domainLen], (int(domain[domainLen])<<8)+int(domain[domainLen+1]))
-	case 4: // IPv6 address
-		ip := make([]byte, 18) //1byte already read
-		ip[0] = request[4]
-		_, err = io.ReadFull(conn, ip[:17])
+		return net.ResolveTCPAddr(network, dst.String())
+	}
+	if network == "udp" {
+		return dst.UDPAddr(), nil
+	}
+	return dst.TCPAddr(), nil
+}
+
+/*
+writeReply writes a reply with the bound address. Zero address is used if bound is
+nil or cannot be encoded.
+*/
+func writeReply(conn net.Conn, reply ReplyType, bound net.Addr) error {
+	var addr *Addr
+	if bound != nil {
+		addr, _ = AddrFromNetAddr(bound)
+	}
+	b, err := codec.AppendReply(nil, &codec.Reply{Code: byte(reply), Bound: addr})
+	if err != nil {
+		b, err = codec.AppendReply(nil, &codec.Reply{Code: byte(reply)})
 		if err != nil {
-			return
+			return err
 		}
-
-		addr = fmt.Sprintf("[%s]:%d", formatIPv6(ip), (int(ip[16])<<8)+int(ip[17]))
-	default:
-		err = fmt.Errorf("unsupported address type: %d", request[3])
 	}
-	return
+	_, err = conn.Write(b)
+	return err
 }
 
-func formatIPv6(ip []byte) string {
-	var sections []string
-	for i := 0; i < 16; i += 2 {
-		sections = append(sections, fmt.Sprintf("%x%x", ip[i], ip[i+1]))
+// listenRelay binds the udp relay for an association on the control connection.
+func listenRelay(control net.Conn, relayAddr string) (net.PacketConn, error) {
+	if relayAddr == "" {
+		relayAddr = ":0"
+		if tcpAddr, ok := control.LocalAddr().(*net.TCPAddr); ok && !tcpAddr.IP.IsUnspecified() {
+			relayAddr = net.JoinHostPort(tcpAddr.IP.String(), "0")
+		}
 	}
-	return strings.Join(sections, ":")
+	return net.ListenPacket("udp", relayAddr)
 }
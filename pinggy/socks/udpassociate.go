@@ -0,0 +1,191 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks/codec"
+)
+
+/*
+Parse an udp datagram with the rfc1928 udp request header. Payload shares the
+memory of b.
+*/
+func ParseUdpDatagram(b []byte) (dst *Addr, frag byte, payload []byte, err error) {
+	return codec.ParseDatagram(b)
+}
+
+/*
+Append an udp datagram with the rfc1928 udp request header to b. Fragmentation is
+not supported, FRAG is always 0.
+*/
+func AppendUdpDatagram(b []byte, dst *Addr, payload []byte) ([]byte, error) {
+	return codec.AppendDatagram(b, dst, payload)
+}
+
+/*
+UdpAssociation is an udp relay set up by the UDP ASSOCIATE command (rfc1928). It is
+a net.PacketConn: ReadFrom returns the payload sent by the client along with its
+destination, and WriteTo sends a payload to the client as if it came from addr.
+
+The association ends when the control connection is closed. Datagrams from other
+sources than the client and fragmented datagrams are dropped.
+*/
+type UdpAssociation struct {
+	control net.Conn
+	relay   net.PacketConn
+
+	// Client address declared in the request. Zero ip or port means any.
+	declared *Addr
+
+	lock   sync.Mutex
+	client *net.UDPAddr
+
+	readLock sync.Mutex
+	readBuf  []byte
+
+	droppedFragments uint64
+	droppedForeign   uint64
+
+	closeOnce sync.Once
+}
+
+func newUdpAssociation(control net.Conn, relay net.PacketConn, declared *Addr) *UdpAssociation {
+	ua := &UdpAssociation{
+		control:  control,
+		relay:    relay,
+		declared: declared,
+		readBuf:  make([]byte, 65535),
+	}
+	go func() {
+		io.Copy(io.Discard, control)
+		ua.Close()
+	}()
+	return ua
+}
+
+// accepts checks the source of a datagram against the client of the association.
+func (ua *UdpAssociation) accepts(from *net.UDPAddr) bool {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+
+	if ua.client != nil {
+		return ua.client.IP.Equal(from.IP) && ua.client.Port == from.Port
+	}
+	if d := ua.declared; d != nil {
+		if d.IP != nil && !d.IP.IsUnspecified() && !d.IP.Equal(from.IP) {
+			return false
+		}
+		if d.Port != 0 && d.Port != from.Port {
+			return false
+		}
+	}
+	ua.client = from
+	return true
+}
+
+func (ua *UdpAssociation) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	ua.readLock.Lock()
+	defer ua.readLock.Unlock()
+
+	for {
+		length, from, err := ua.relay.ReadFrom(ua.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		udpFrom, ok := from.(*net.UDPAddr)
+		if !ok || !ua.accepts(udpFrom) {
+			atomic.AddUint64(&ua.droppedForeign, 1)
+			continue
+		}
+		dst, frag, payload, err := ParseUdpDatagram(ua.readBuf[:length])
+		if err != nil {
+			continue
+		}
+		if frag != 0 {
+			atomic.AddUint64(&ua.droppedFragments, 1)
+			continue
+		}
+		return copy(p, payload), dst.UDPAddr(), nil
+	}
+}
+
+func (ua *UdpAssociation) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	ua.lock.Lock()
+	client := ua.client
+	ua.lock.Unlock()
+	if client == nil {
+		return 0, fmt.Errorf("client address of the association is not known yet")
+	}
+
+	src, err := AddrFromNetAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	datagram, err := AppendUdpDatagram(make([]byte, 0, len(p)+22), src, p)
+	if err != nil {
+		return 0, err
+	}
+	_, err = ua.relay.WriteTo(datagram, client)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+Close the relay and the control connection.
+*/
+func (ua *UdpAssociation) Close() error {
+	var err error
+	ua.closeOnce.Do(func() {
+		err = ua.relay.Close()
+		ua.control.Close()
+	})
+	return err
+}
+
+/*
+LocalAddr returns the address of the relay.
+*/
+func (ua *UdpAssociation) LocalAddr() net.Addr { return ua.relay.LocalAddr() }
+
+func (ua *UdpAssociation) SetDeadline(t time.Time) error      { return ua.relay.SetDeadline(t) }
+func (ua *UdpAssociation) SetReadDeadline(t time.Time) error  { return ua.relay.SetReadDeadline(t) }
+func (ua *UdpAssociation) SetWriteDeadline(t time.Time) error { return ua.relay.SetWriteDeadline(t) }
+
+/*
+ControlConn returns the tcp connection which carried the UDP ASSOCIATE request.
+*/
+func (ua *UdpAssociation) ControlConn() net.Conn { return ua.control }
+
+/*
+ClientAddr returns the udp address of the client. It is nil until the first
+datagram is received.
+*/
+func (ua *UdpAssociation) ClientAddr() net.Addr {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+	if ua.client == nil {
+		return nil
+	}
+	return ua.client
+}
+
+/*
+Number of datagrams dropped because they were fragmented.
+*/
+func (ua *UdpAssociation) DroppedFragments() uint64 {
+	return atomic.LoadUint64(&ua.droppedFragments)
+}
+
+/*
+Number of datagrams dropped because they did not come from the client.
+*/
+func (ua *UdpAssociation) DroppedForeign() uint64 {
+	return atomic.LoadUint64(&ua.droppedForeign)
+}
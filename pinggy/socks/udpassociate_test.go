@@ -0,0 +1,130 @@
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestAssociation(t *testing.T, declared *Addr) (*UdpAssociation, net.Conn) {
+	t.Helper()
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, peer := net.Pipe()
+	ua := newUdpAssociation(control, relay, declared)
+	t.Cleanup(func() { ua.Close() })
+	ua.SetDeadline(time.Now().Add(5 * time.Second))
+	return ua, peer
+}
+
+func newTestClient(t *testing.T, ua *UdpAssociation) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, ua.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func sendDatagram(t *testing.T, conn *net.UDPConn, dst *Addr, payload string, frag byte) {
+	t.Helper()
+	datagram, err := AppendUdpDatagram(nil, dst, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram[2] = frag
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPayload(t *testing.T, ua *UdpAssociation) (string, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	n, addr, err := ua.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), addr
+}
+
+func TestUdpAssociationRelay(t *testing.T) {
+	ua, _ := newTestAssociation(t, nil)
+	client := newTestClient(t, ua)
+	dst := &Addr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+
+	sendDatagram(t, client, dst, "query", 0)
+	if payload, addr := readPayload(t, ua); payload != "query" || addr.String() != "192.0.2.1:53" {
+		t.Fatalf("read %q from %v", payload, addr)
+	}
+	if ua.ClientAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("client address %v, expected %v", ua.ClientAddr(), client.LocalAddr())
+	}
+
+	if _, err := ua.WriteTo([]byte("answer"), dst.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, frag, payload, err := ParseUdpDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag != 0 || string(payload) != "answer" || src.String() != "192.0.2.1:53" {
+		t.Fatalf("client received %q from %v, frag %d", payload, src, frag)
+	}
+}
+
+func TestUdpAssociationDrops(t *testing.T) {
+	ua, _ := newTestAssociation(t, nil)
+	client := newTestClient(t, ua)
+	foreign := newTestClient(t, ua)
+	dst := &Addr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+
+	// The first datagram locks the association to its source.
+	sendDatagram(t, client, dst, "first", 0)
+	if payload, _ := readPayload(t, ua); payload != "first" {
+		t.Fatalf("read %q", payload)
+	}
+
+	sendDatagram(t, foreign, dst, "foreign", 0)
+	sendDatagram(t, client, dst, "fragment", 1)
+	sendDatagram(t, client, dst, "second", 0)
+	if payload, _ := readPayload(t, ua); payload != "second" {
+		t.Fatalf("read %q", payload)
+	}
+	if ua.DroppedForeign() != 1 || ua.DroppedFragments() != 1 {
+		t.Fatalf("dropped %d foreign and %d fragmented datagrams", ua.DroppedForeign(), ua.DroppedFragments())
+	}
+}
+
+func TestUdpAssociationDeclaredClient(t *testing.T) {
+	ua, _ := newTestAssociation(t, &Addr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	other := newTestClient(t, ua)
+	dst := &Addr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+
+	// Only the port declared in the request can use the association.
+	sendDatagram(t, other, dst, "other", 0)
+	ua.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, addr, err := ua.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Fatalf("read %d bytes from %v", n, addr)
+	}
+	if ua.DroppedForeign() != 1 || ua.ClientAddr() != nil {
+		t.Fatalf("dropped %d datagrams, client %v", ua.DroppedForeign(), ua.ClientAddr())
+	}
+}
+
+func TestUdpAssociationControlClosed(t *testing.T) {
+	ua, peer := newTestAssociation(t, nil)
+	peer.Close()
+	if _, _, err := ua.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Fatal("association is open after the control connection closed")
+	}
+}
@@ -0,0 +1,572 @@
+package pinggy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/internal/headermanipulation"
+)
+
+/*
+SshCommand is the equivalent of an OpenSSH command line used with pinggy, such as
+
+	ssh -p 443 -R0:localhost:3000 -L4300:localhost:4300 token+tcp@a.pinggy.io "w:1.2.3.4/32 b:user:pass"
+*/
+type SshCommand struct {
+	Config Config
+
+	// Local address of the web debugger from the -L option. Empty if not present.
+	WebDebuggerAddr string
+}
+
+// ssh options which take an argument. These are accepted and ignored unless handled explicitly.
+const sshOptionsWithArg = "BcDEeFIiJlmOoQSWw"
+
+/*
+Parse an ssh command line. The line is split the way a posix shell would split it.
+*/
+func ParseSshCommand(cmdline string) (*SshCommand, error) {
+	args, err := splitCommandLine(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSshArgs(args)
+}
+
+/*
+Parse ssh command line arguments. The first argument can be `ssh` or the arguments
+can start with the options directly.
+*/
+func ParseSshArgs(args []string) (*SshCommand, error) {
+	if len(args) > 0 && (args[0] == "ssh" || strings.HasSuffix(args[0], "/ssh")) {
+		args = args[1:]
+	}
+
+	cmd := &SshCommand{}
+	conf := &cmd.Config
+	port := ""
+	login := ""
+	var remoteForwards []string
+	destination := ""
+	var remoteCommand []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if destination != "" {
+			remoteCommand = append(remoteCommand, arg)
+			continue
+		}
+		if arg == "--" {
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			destination = arg
+			continue
+		}
+
+		flags := arg[1:]
+		for j := 0; j < len(flags); j++ {
+			opt := flags[j]
+			if !strings.ContainsRune("pRLlo"+sshOptionsWithArg, rune(opt)) {
+				// Flags without argument such as -t, -T, -N, -v are ignored.
+				continue
+			}
+			value := flags[j+1:]
+			if value == "" {
+				i++
+				if i >= len(args) {
+					return nil, fmt.Errorf("missing argument for -%c", opt)
+				}
+				value = args[i]
+			}
+			switch opt {
+			case 'p':
+				if _, err := strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid port: %s", value)
+				}
+				port = value
+			case 'R':
+				remoteForwards = append(remoteForwards, value)
+			case 'L':
+				addr, err := parseLocalForward(value)
+				if err != nil {
+					return nil, err
+				}
+				cmd.WebDebuggerAddr = addr
+			case 'l':
+				login = value
+			case 'o':
+				if strings.HasPrefix(strings.ToLower(value), "port=") {
+					port = value[len("port="):]
+				}
+			}
+			break
+		}
+	}
+
+	if destination == "" {
+		return nil, fmt.Errorf("server missing in ssh command")
+	}
+	user, host := login, destination
+	if at := strings.LastIndex(destination, "@"); at >= 0 {
+		user, host = destination[:at], destination[at+1:]
+	}
+	conf.Server = host
+	if port != "" {
+		conf.Server = net.JoinHostPort(host, port)
+	}
+
+	err := parseSshUser(conf, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var forwardTargets []string
+	for _, rf := range remoteForwards {
+		target, err := parseRemoteForward(rf)
+		if err != nil {
+			return nil, err
+		}
+		forwardTargets = append(forwardTargets, target)
+	}
+	switch {
+	case len(forwardTargets) == 0:
+	case conf.Type == "" && conf.AltType == UDP:
+		conf.UdpForwardingAddr = forwardTargets[0]
+	default:
+		conf.TcpForwardingAddr = forwardTargets[0]
+		if conf.AltType == UDP && len(forwardTargets) > 1 {
+			conf.UdpForwardingAddr = forwardTargets[1]
+		}
+	}
+	if len(forwardTargets) > 2 || (len(forwardTargets) > 1 && conf.AltType == "") {
+		return nil, fmt.Errorf("too many remote forwardings")
+	}
+
+	err = parseRemoteCommand(conf, strings.Join(remoteCommand, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+func parseSshUser(conf *Config, user string) error {
+	if user == "" {
+		return nil
+	}
+	for _, part := range strings.Split(user, "+") {
+		switch strings.ToLower(part) {
+		case "":
+		case string(HTTP), string(TCP), string(TLS), string(TLSTCP):
+			if conf.Type != "" {
+				return fmt.Errorf("more than one tunnel type in %s", user)
+			}
+			conf.Type = TunnelType(strings.ToLower(part))
+		case string(UDP):
+			conf.AltType = UDP
+		case "force":
+			conf.Force = true
+		case "auth":
+			// Added by the library itself.
+		default:
+			if conf.Token != "" {
+				return fmt.Errorf("unknown keyword %q in %s", part, user)
+			}
+			conf.Token = part
+		}
+	}
+	return nil
+}
+
+// parseRemoteForward returns the local target of `[bind_address:]port:host:hostport`.
+func parseRemoteForward(value string) (string, error) {
+	parts := splitForwardSpec(value)
+	if len(parts) == 4 {
+		// Bind address is the domain of the tunnel. It is not supported by Config.
+		return "", fmt.Errorf("remote forwarding with bind address is not supported: %s", value)
+	}
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid remote forwarding: %s", value)
+	}
+	if _, err := strconv.Atoi(parts[2]); err != nil {
+		return "", fmt.Errorf("invalid remote forwarding: %s", value)
+	}
+	return net.JoinHostPort(parts[1], parts[2]), nil
+}
+
+// parseLocalForward returns the local listening address of `[bind_address:]port:host:hostport`.
+func parseLocalForward(value string) (string, error) {
+	parts := splitForwardSpec(value)
+	switch len(parts) {
+	case 3:
+		return net.JoinHostPort("localhost", parts[0]), nil
+	case 4:
+		return net.JoinHostPort(parts[0], parts[1]), nil
+	}
+	return "", fmt.Errorf("invalid local forwarding: %s", value)
+}
+
+// splitForwardSpec splits on colon keeping the ipv6 addresses in brackets intact.
+func splitForwardSpec(value string) []string {
+	var parts []string
+	cur := ""
+	bracket := false
+	for _, c := range value {
+		switch {
+		case c == '[':
+			bracket = true
+		case c == ']':
+			bracket = false
+		case c == ':' && !bracket:
+			parts = append(parts, cur)
+			cur = ""
+		default:
+			cur += string(c)
+		}
+	}
+	return append(parts, cur)
+}
+
+func parseRemoteCommand(conf *Config, command string) error {
+	var hm HttpHeaderManipulationAndAuthConfig
+	headerManipulation := func() HttpHeaderManipulationAndAuthConfig {
+		if hm == nil {
+			hm = CreateHeaderManipulationAndAuthConfig()
+		}
+		return hm
+	}
+
+	for _, word := range strings.Fields(command) {
+		if len(word) < 2 || word[1] != ':' {
+			return fmt.Errorf("unknown keyword in command: %s", word)
+		}
+		value := word[2:]
+		var err error
+		switch word[0] {
+		case 'w':
+			for _, w := range strings.Split(value, ",") {
+				ipNet, e := parseCidr(w)
+				if e != nil {
+					return e
+				}
+				conf.IpWhiteList = append(conf.IpWhiteList, ipNet)
+			}
+		case 'b':
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("invalid basic auth: %s", word)
+			}
+			headerManipulation().AddBasicAuth(parts[0], parts[1])
+		case 'k':
+			headerManipulation().AddBearerAuth(value)
+		case 'a', 'u':
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("invalid header: %s", word)
+			}
+			if word[0] == 'a' {
+				err = headerManipulation().AddHeader(parts[0], parts[1])
+			} else {
+				err = headerManipulation().UpdateHeader(parts[0], parts[1])
+			}
+		case 'r':
+			err = headerManipulation().RemoveHeader(value)
+		case 'x':
+			err = parseExtraKeyword(conf, value, headerManipulation)
+		default:
+			return fmt.Errorf("unknown keyword in command: %s", word)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if hm != nil {
+		conf.HeaderManipulationAndAuth = hm
+	}
+	return nil
+}
+
+func parseExtraKeyword(conf *Config, value string, headerManipulation func() HttpHeaderManipulationAndAuthConfig) error {
+	parts := strings.SplitN(value, ":", 2)
+	arg := ""
+	if len(parts) > 1 {
+		arg = parts[1]
+	}
+	switch strings.ToLower(parts[0]) {
+	case "https":
+		headerManipulation().SetHttpsOnly(true)
+	case "xff":
+		if arg == "" {
+			headerManipulation().SetXFF()
+		} else {
+			headerManipulation().SetXFFHeader(arg)
+		}
+	case "fullurl":
+		headerManipulation().SetFullUrl(true)
+	case "passpreflight":
+		headerManipulation().SetPassPreflight(true)
+	case "noreverseproxy":
+		headerManipulation().SetNoReverseProxy()
+	case "localservertls":
+		conf.ForwardedConnectionConf = &ForwardedConnectionConf{TlsLocalServer: true, TlsLocalServerSNI: arg}
+	default:
+		return fmt.Errorf("unknown keyword in command: x:%s", value)
+	}
+	return nil
+}
+
+func parseCidr(w string) (*net.IPNet, error) {
+	if !strings.Contains(w, "/") {
+		ip := net.ParseIP(w)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip in whitelist: %s", w)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(w)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr in whitelist: %s", w)
+	}
+	return ipNet, nil
+}
+
+/*
+Args returns the arguments of the equivalent ssh command without the leading `ssh`.
+The hostname set with SetHostname or SetReverseProxy has no ssh equivalent and is
+not included.
+*/
+func (cmd *SshCommand) Args() []string {
+	conf := cmd.Config
+	host, port := conf.Server, "443"
+	if host == "" {
+		host = "a.pinggy.io"
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	} else if conf.port > 0 {
+		port = strconv.Itoa(conf.port)
+	}
+
+	args := []string{"-p", port}
+	if conf.TcpForwardingAddr != "" {
+		args = append(args, "-R0:"+conf.TcpForwardingAddr)
+	}
+	if conf.UdpForwardingAddr != "" {
+		args = append(args, "-R0:"+conf.UdpForwardingAddr)
+	}
+	if cmd.WebDebuggerAddr != "" {
+		args = append(args, "-L"+localForwardSpec(cmd.WebDebuggerAddr))
+	}
+	args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "ServerAliveInterval=30")
+
+	user := []string{}
+	if conf.Token != "" {
+		user = append(user, conf.Token)
+	}
+	if conf.Type != "" {
+		user = append(user, string(conf.Type))
+	}
+	if conf.AltType != "" {
+		user = append(user, string(conf.AltType))
+	}
+	if conf.Force {
+		user = append(user, "force")
+	}
+	destination := host
+	if len(user) > 0 {
+		destination = strings.Join(user, "+") + "@" + host
+	}
+	args = append(args, destination)
+
+	if command := remoteCommand(&conf); command != "" {
+		args = append(args, command)
+	}
+	return args
+}
+
+/*
+String returns the equivalent ssh command, quoted for a posix shell.
+*/
+func (cmd *SshCommand) String() string {
+	words := []string{"ssh"}
+	for _, arg := range cmd.Args() {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+/*
+Format the ssh command equivalent to the config.
+*/
+func FormatSshCommand(conf Config, webDebuggerAddr string) string {
+	cmd := &SshCommand{Config: conf, WebDebuggerAddr: webDebuggerAddr}
+	return cmd.String()
+}
+
+func localForwardSpec(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr + ":localhost:4300"
+	}
+	if host == "" || host == "localhost" {
+		return port + ":localhost:4300"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + port + ":localhost:4300"
+}
+
+func remoteCommand(conf *Config) string {
+	var words []string
+	for _, ipNet := range conf.IpWhiteList {
+		words = append(words, "w:"+ipNet.String())
+	}
+	if fc := conf.ForwardedConnectionConf; fc != nil && fc.TlsLocalServer {
+		word := "x:localServerTls"
+		if fc.TlsLocalServerSNI != "" {
+			word += ":" + fc.TlsLocalServerSNI
+		}
+		words = append(words, word)
+	}
+	if conf.HeaderManipulationAndAuth != nil {
+		words = append(words, headerManipulationKeywords(conf.HeaderManipulationAndAuth)...)
+	}
+	return strings.Join(words, " ")
+}
+
+func headerManipulationKeywords(hmc HttpHeaderManipulationAndAuthConfig) []string {
+	data, err := hmc.ListHeaderManipulations()
+	if err != nil {
+		return nil
+	}
+	var hm headermanipulation.HttpHeaderManipulationAndAuthConfig
+	if json.Unmarshal(data, &hm) != nil {
+		return nil
+	}
+
+	var words []string
+	for _, encoded := range sortedKeys(hm.BasicAuths) {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			words = append(words, "b:"+string(decoded))
+		}
+	}
+	for _, key := range sortedKeys(hm.BearerAuths) {
+		words = append(words, "k:"+key)
+	}
+
+	names := make([]string, 0, len(hm.Headers))
+	for name := range hm.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := hm.Headers[name]
+		values := header.NewValues
+		if header.Remove {
+			if len(values) == 0 {
+				words = append(words, "r:"+header.Key)
+				continue
+			}
+			words = append(words, "u:"+header.Key+":"+values[0])
+			values = values[1:]
+		}
+		for _, value := range values {
+			words = append(words, "a:"+header.Key+":"+value)
+		}
+	}
+
+	if !hm.XFH && !hm.XFP && !hm.Forwarded && hm.XFF == "" {
+		words = append(words, "x:noreverseproxy")
+	} else if hm.XFF != "" && hm.XFF != "X-Forwarded-For" {
+		words = append(words, "x:xff:"+hm.XFF)
+	}
+	if hm.HttpsOnly {
+		words = append(words, "x:https")
+	}
+	if hm.FullRequestUrl {
+		words = append(words, "x:fullurl")
+	}
+	if hm.PassPreflight {
+		words = append(words, "x:passpreflight")
+	}
+	return words
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.,:/@+=%[]", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func splitCommandLine(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord := false
+	quote := rune(0)
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in command line")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,157 @@
+package pinggy_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/internal/headermanipulation"
+)
+
+// parsedCommand holds the fields of an SshCommand in a comparable form.
+type parsedCommand struct {
+	Server            string
+	Token             string
+	Type              pinggy.TunnelType
+	AltType           pinggy.UDPTunnelType
+	Force             bool
+	TcpForwardingAddr string
+	UdpForwardingAddr string
+	WebDebuggerAddr   string
+	IpWhiteList       []string
+	LocalServerTls    bool
+	LocalServerSNI    string
+	Headers           *headermanipulation.HttpHeaderManipulationAndAuthConfig
+}
+
+func parsed(t *testing.T, cmd *pinggy.SshCommand) parsedCommand {
+	t.Helper()
+	conf := cmd.Config
+	pc := parsedCommand{
+		Server:            conf.Server,
+		Token:             conf.Token,
+		Type:              conf.Type,
+		AltType:           conf.AltType,
+		Force:             conf.Force,
+		TcpForwardingAddr: conf.TcpForwardingAddr,
+		UdpForwardingAddr: conf.UdpForwardingAddr,
+		WebDebuggerAddr:   cmd.WebDebuggerAddr,
+	}
+	for _, ipNet := range conf.IpWhiteList {
+		pc.IpWhiteList = append(pc.IpWhiteList, ipNet.String())
+	}
+	if fc := conf.ForwardedConnectionConf; fc != nil {
+		pc.LocalServerTls = fc.TlsLocalServer
+		pc.LocalServerSNI = fc.TlsLocalServerSNI
+	}
+	if conf.HeaderManipulationAndAuth != nil {
+		data, err := conf.HeaderManipulationAndAuth.ListHeaderManipulations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc.Headers = &headermanipulation.HttpHeaderManipulationAndAuthConfig{}
+		if err := json.Unmarshal(data, pc.Headers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pc
+}
+
+// headers returns the header manipulation created by the library with changes applied.
+func headers(change func(hm *headermanipulation.HttpHeaderManipulationAndAuthConfig)) *headermanipulation.HttpHeaderManipulationAndAuthConfig {
+	hm := headermanipulation.NewHeaderManipulationAndAuthConfig()
+	change(hm)
+	return hm
+}
+
+func TestParseSshCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		want parsedCommand
+	}{
+		{
+			`ssh -p 443 -R0:localhost:3000 -L4300:localhost:4300 -o StrictHostKeyChecking=no -o ServerAliveInterval=30 tok+tcp+udp+force@a.pinggy.io`,
+			parsedCommand{Server: "a.pinggy.io:443", Token: "tok", Type: pinggy.TCP, AltType: pinggy.UDP, Force: true,
+				TcpForwardingAddr: "localhost:3000", WebDebuggerAddr: "localhost:4300"},
+		},
+		{
+			`ssh -p 443 -R0:localhost:3000 -R0:localhost:53 -L4300:localhost:4300 tok+tcp+udp+force@a.pinggy.io "w:1.2.3.4"`,
+			parsedCommand{Server: "a.pinggy.io:443", Token: "tok", Type: pinggy.TCP, AltType: pinggy.UDP, Force: true,
+				TcpForwardingAddr: "localhost:3000", UdpForwardingAddr: "localhost:53", WebDebuggerAddr: "localhost:4300",
+				IpWhiteList: []string{"1.2.3.4/32"}},
+		},
+		{
+			`ssh -o Port=8443 -l tok+udp -R 0:127.0.0.1:5353 -L 127.0.0.1:4301:localhost:4300 -tN eu.pinggy.io`,
+			parsedCommand{Server: "eu.pinggy.io:8443", Token: "tok", AltType: pinggy.UDP,
+				UdpForwardingAddr: "127.0.0.1:5353", WebDebuggerAddr: "127.0.0.1:4301"},
+		},
+		{
+			`ssh -p443 -R0:[::1]:443 tls@eu.pinggy.io x:localServerTls:example.com`,
+			parsedCommand{Server: "eu.pinggy.io:443", Type: pinggy.TLS, TcpForwardingAddr: "[::1]:443",
+				LocalServerTls: true, LocalServerSNI: "example.com"},
+		},
+		{
+			`ssh -p 443 -R0:localhost:8000 http@a.pinggy.io 'w:10.0.0.0/8,2001:db8::1 b:user:pass k:key a:X-Foo:bar r:X-Bar u:X-Baz:1 x:https x:passpreflight x:fullurl x:xff:X-Real-IP'`,
+			parsedCommand{Server: "a.pinggy.io:443", Type: pinggy.HTTP, TcpForwardingAddr: "localhost:8000",
+				IpWhiteList: []string{"10.0.0.0/8", "2001:db8::1/128"},
+				Headers: headers(func(hm *headermanipulation.HttpHeaderManipulationAndAuthConfig) {
+					hm.AddBasicAuth("user", "pass")
+					hm.AddBearerAuth("key")
+					hm.AddHeader("X-Foo", "bar")
+					hm.RemoveHeader("X-Bar")
+					hm.UpdateHeader("X-Baz", "1")
+					hm.SetHttpsOnly(true)
+					hm.SetPassPreflight(true)
+					hm.SetFullUrl(true)
+					hm.SetXFFHeader("X-Real-IP")
+				})},
+		},
+		{
+			`ssh -p 443 -R0:localhost:8000 a.pinggy.io x:noreverseproxy`,
+			parsedCommand{Server: "a.pinggy.io:443", TcpForwardingAddr: "localhost:8000",
+				Headers: headers(func(hm *headermanipulation.HttpHeaderManipulationAndAuthConfig) {
+					hm.SetNoReverseProxy()
+				})},
+		},
+	}
+	for _, test := range tests {
+		cmd, err := pinggy.ParseSshCommand(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if got := parsed(t, cmd); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\nparsed   %+v\nexpected %+v", test.line, got, test.want)
+		}
+
+		// The formatted command is parsed to the same configuration.
+		again, err := pinggy.ParseSshCommand(cmd.String())
+		if err != nil {
+			t.Errorf("%s: %v", cmd.String(), err)
+			continue
+		}
+		if got := parsed(t, again); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("round trip of %s:\nparsed   %+v\nexpected %+v", cmd.String(), got, test.want)
+		}
+	}
+
+	for _, line := range []string{
+		`ssh -p 443 -R0:localhost:3000`,
+		`ssh -p port a.pinggy.io`,
+		`ssh -p`,
+		`ssh tcp+tls@a.pinggy.io`,
+		`ssh tok+other@a.pinggy.io`,
+		`ssh -R example.com:0:localhost:3000 a.pinggy.io`,
+		`ssh -R0:localhost:3000 -R0:localhost:4000 tcp@a.pinggy.io`,
+		`ssh a.pinggy.io w:1.2.3`,
+		`ssh a.pinggy.io b:user`,
+		`ssh a.pinggy.io r:Host`,
+		`ssh a.pinggy.io x:unknown`,
+		`ssh a.pinggy.io z:1`,
+	} {
+		if _, err := pinggy.ParseSshCommand(line); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
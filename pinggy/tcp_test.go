@@ -0,0 +1,68 @@
+package pinggy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+// BenchmarkTcpForwarding measures a visitor stream carried over the ssh channel
+// and copied to the local server by StartForwarding.
+func BenchmarkTcpForwarding(b *testing.B) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	b.Cleanup(srv.Close)
+
+	const chunk = 32 * 1024
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer local.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.CopyN(ioutil.Discard, conn, int64(b.N)*chunk)
+		received <- n
+	}()
+
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	conf.TcpForwardingAddr = local.Addr().String()
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pl.Close()
+	go pl.StartForwarding()
+
+	visitor, err := srv.Tunnels()[0].DialTCP("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer visitor.Close()
+
+	buf := make([]byte, chunk)
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := visitor.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if n := <-received; n != int64(b.N)*chunk {
+		b.Fatalf("local server received %d bytes", n)
+	}
+}
@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Size of the pooled copy buffers. Ssh channels deliver up to 32KiB at once, so
+// a larger buffer lets a read take everything which is available.
+const copyBufferSize = 64 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+/*
+isKernelSocket tells if the connection is a socket which the net package can
+splice from or to.
+*/
+func isKernelSocket(v interface{}) bool {
+	switch v.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+/*
+Copy copies from src to dst until EOF on src, like io.Copy, and returns the
+number of bytes copied. The fastest way available is used:
+
+  - If dst is a *net.TCPConn and src is a *net.TCPConn or *net.UnixConn, the data
+    is spliced in the kernel on Linux by the ReadFrom of dst.
+  - If src implements io.WriterTo or dst implements io.ReaderFrom, they are used.
+    Kernel sockets are excluded here, as their fallback allocates a buffer.
+  - Otherwise a pooled buffer is used, so that copying does not allocate.
+*/
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	if tcp, ok := dst.(*net.TCPConn); ok && isKernelSocket(src) {
+		return tcp.ReadFrom(src)
+	}
+	if wt, ok := src.(io.WriterTo); ok && !isKernelSocket(src) {
+		return wt.WriteTo(dst)
+	}
+	if rf, ok := dst.(io.ReaderFrom); ok && !isKernelSocket(dst) {
+		return rf.ReadFrom(src)
+	}
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return copyBuffer(dst, src, *buf)
+}
+
+// copyBuffer is io.CopyBuffer without its WriterTo and ReaderFrom checks.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+/*
+Join copies between a and b in both directions with Copy. When one direction
+ends, it is half-closed on the other side if possible. Both connections are
+closed when both directions are done or one of them fails.
+*/
+func Join(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	defer closeBoth()
+
+	pipe := func(dst, src net.Conn) {
+		_, err := Copy(dst, src)
+		if err != nil {
+			closeBoth()
+			return
+		}
+		closeWrite(dst)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pipe(a, b)
+	}()
+	pipe(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback tcp connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// plainWriter and plainReader hide the fast paths, like an ssh channel.
+type plainWriter struct{ w io.Writer }
+
+func (p plainWriter) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+type plainReader struct{ r io.Reader }
+
+func (p plainReader) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	// Pooled buffer.
+	var out bytes.Buffer
+	n, err := Copy(plainWriter{&out}, plainReader{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("plain copy: %d %v", n, err)
+	}
+
+	// Kernel sockets.
+	srcW, srcR := tcpPair(t)
+	dstW, dstR := tcpPair(t)
+	go func() {
+		srcW.Write(data)
+		srcW.CloseWrite()
+	}()
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(dstR)
+		received <- b
+	}()
+	n, err = Copy(dstW, srcR)
+	dstW.CloseWrite()
+	if err != nil || n != int64(len(data)) || !bytes.Equal(<-received, data) {
+		t.Fatalf("socket copy: %d %v", n, err)
+	}
+}
+
+// pattern is an endless reader without any fast path.
+type pattern struct{}
+
+func (pattern) Read(b []byte) (int, error) { return len(b), nil }
+
+func BenchmarkCopy(b *testing.B) {
+	copies := []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"Copy", Copy},
+	}
+
+	const size = 256 * 1024
+	for _, c := range copies {
+		b.Run("stream/"+c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.copy(plainWriter{ioutil.Discard}, io.LimitReader(pattern{}, size))
+			}
+		})
+	}
+
+	const chunk = 32 * 1024
+	for _, c := range copies {
+		b.Run("socket/"+c.name, func(b *testing.B) {
+			srcW, srcR := tcpPair(b)
+			dstW, dstR := tcpPair(b)
+			go func() {
+				buf := make([]byte, chunk)
+				for i := 0; i < b.N; i++ {
+					srcW.Write(buf)
+				}
+				srcW.CloseWrite()
+			}()
+			go io.Copy(ioutil.Discard, dstR)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			c.copy(dstW, srcR)
+		})
+	}
+}
+
+func BenchmarkTcpForwarding(b *testing.B) {
+	const chunk = 32 * 1024
+	for _, options := range []struct {
+		name    string
+		options TcpOptions
+	}{
+		{"plain", TcpOptions{}},
+		{"idle", TcpOptions{IdleTimeout: time.Minute}},
+	} {
+		b.Run(options.name, func(b *testing.B) {
+			done := make(chan struct{})
+			addr := startTcpTunnel(b, options.options, func(conn net.Conn) {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+				close(done)
+			})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			buf := make([]byte, chunk)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn.Write(buf)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			<-done
+		})
+	}
+}
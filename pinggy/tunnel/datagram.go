@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+Largest datagram which fits into the two byte length prefix of the udp framing.
+*/
+const MaxDatagramSize = 65535
+
+/*
+ErrDatagramTooLarge is returned by ReadDatagram when the datagram does not fit
+into the buffer. The datagram is consumed from the stream.
+*/
+var ErrDatagramTooLarge = fmt.Errorf("datagram too large")
+
+/*
+UdpStats counts the datagrams forwarded by an udp tunnel. In is the direction from
+the visitors to the local server.
+*/
+type UdpStats struct {
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
+
+	// Datagrams larger than the max datagram size, in either direction.
+	DroppedOversize uint64
+
+	// Datagrams from the addresses other than the local server.
+	DroppedForeign uint64
+
+	// Datagrams over the bandwidth limits.
+	DroppedLimited uint64
+
+	// Flows rejected because the maximum number of flows was reached or because no
+	// target could be found for them.
+	RejectedFlows uint64
+}
+
+var datagramPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxDatagramSize+2)
+		return &b
+	},
+}
+
+func getDatagramBuffer() *[]byte { return datagramPool.Get().(*[]byte) }
+
+func putDatagramBuffer(b *[]byte) { datagramPool.Put(b) }
+
+/*
+ReadDatagram reads a length prefixed datagram from r into buf and returns its
+length. If the datagram is larger than buf, it is discarded and the error is
+ErrDatagramTooLarge with n being the size of the datagram.
+*/
+func ReadDatagram(r io.Reader, buf []byte) (n int, err error) {
+	var lengthBytes [2]byte
+	_, err = io.ReadFull(r, lengthBytes[:])
+	if err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(lengthBytes[:]))
+	if length > len(buf) {
+		_, err = io.CopyN(io.Discard, r, int64(length))
+		if err != nil {
+			return 0, err
+		}
+		return length, ErrDatagramTooLarge
+	}
+	_, err = io.ReadFull(r, buf[:length])
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+/*
+WriteDatagram writes p to w with the two byte length prefix in a single write.
+*/
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	buf := getDatagramBuffer()
+	defer putDatagramBuffer(buf)
+	frame := (*buf)[:len(p)+2]
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
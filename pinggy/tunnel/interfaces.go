@@ -11,4 +11,5 @@ type TunnelManager interface {
 	StartForwarding()
 	AcceptAndForward() error
 	GetDialer() Dialer
+	Close() error
 }
@@ -0,0 +1,388 @@
+package tunnel
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+TokenBucket is a token bucket rate limiter. Tokens are added at rate per second up
+to burst. A rate of zero or less means no limit.
+*/
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+/*
+NewTokenBucket returns a full bucket. If burst is zero or less, it is the rate
+of one second.
+*/
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+/*
+SetRate changes the rate and the burst. The tokens which are already in the bucket
+are kept up to the new burst.
+*/
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	if burst <= 0 {
+		b.burst = math.Ceil(rate)
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// available refills the bucket and tells if n tokens can be taken. Called with the lock held.
+func (b *TokenBucket) available(now time.Time, n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= float64(n)
+}
+
+// take removes n tokens. Called with the lock held.
+func (b *TokenBucket) take(n int) {
+	if b.rate > 0 {
+		b.tokens -= float64(n)
+	}
+}
+
+/*
+Allow takes n tokens if they are available.
+*/
+func (b *TokenBucket) Allow(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.available(time.Now(), n) {
+		return false
+	}
+	b.take(n)
+	return true
+}
+
+/*
+allowBoth takes n tokens from both buckets if both have them, otherwise none. The
+bucket of a connection is always locked before the one of its limiter.
+*/
+func allowBoth(conn, all *TokenBucket, n int) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	all.lock.Lock()
+	defer all.lock.Unlock()
+	now := time.Now()
+	if !conn.available(now, n) || !all.available(now, n) {
+		return false
+	}
+	conn.take(n)
+	all.take(n)
+	return true
+}
+
+/*
+Wait takes n tokens, waiting until they are available. Requests larger than the
+burst are allowed; they wait for the time they would take at the rate.
+*/
+func (b *TokenBucket) Wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+/*
+Limits of the connections forwarded by a tunnel. Zero values mean no limit. For
+udp tunnels a flow counts as a connection and the datagrams over the limit are
+dropped.
+*/
+type Limits struct {
+	// Bytes per second over all the connections, in each direction.
+	Bandwidth int64
+
+	// Bytes per second of a single connection, in each direction.
+	ConnBandwidth int64
+
+	// Maximum number of concurrent connections.
+	MaxConns int
+
+	// New connections per second from a single visitor ip. Burst is the number of
+	// connections allowed at once, default is the rate rounded up.
+	NewConnsPerIP      float64
+	NewConnsPerIPBurst int
+}
+
+/*
+LimiterStats counts the connections seen by a Limiter.
+*/
+type LimiterStats struct {
+	ActiveConns int
+
+	// Connections rejected because MaxConns was reached.
+	RejectedMaxConns uint64
+
+	// Connections rejected because of NewConnsPerIP.
+	RejectedRate uint64
+}
+
+/*
+Limiter applies Limits to the connections of a tunnel. The limits can be changed
+at any time with SetLimits, the active limited connections follow the new limits.
+*/
+type Limiter struct {
+	rejectedMaxConns uint64
+	rejectedRate     uint64
+
+	lock   sync.Mutex
+	limits Limits
+	in     *TokenBucket
+	out    *TokenBucket
+	conns  map[*connLimit]struct{}
+	ips    map[string]*ipBucket
+	pruned time.Time
+}
+
+type ipBucket struct {
+	bucket   *TokenBucket
+	lastUsed time.Time
+}
+
+// connLimit holds the buckets of a single connection.
+type connLimit struct {
+	limiter *Limiter
+	in      *TokenBucket
+	out     *TokenBucket
+	once    sync.Once
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{
+		in:    NewTokenBucket(0, 0),
+		out:   NewTokenBucket(0, 0),
+		conns: make(map[*connLimit]struct{}),
+		ips:   make(map[string]*ipBucket),
+	}
+	l.SetLimits(limits)
+	return l
+}
+
+func (l *Limiter) SetLimits(limits Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+	l.in.SetRate(float64(limits.Bandwidth), 0)
+	l.out.SetRate(float64(limits.Bandwidth), 0)
+	for cl := range l.conns {
+		cl.in.SetRate(float64(limits.ConnBandwidth), 0)
+		cl.out.SetRate(float64(limits.ConnBandwidth), 0)
+	}
+	for _, ib := range l.ips {
+		ib.bucket.SetRate(limits.NewConnsPerIP, limits.NewConnsPerIPBurst)
+	}
+}
+
+func (l *Limiter) Limits() Limits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.lock.Lock()
+	active := len(l.conns)
+	l.lock.Unlock()
+	return LimiterStats{
+		ActiveConns:      active,
+		RejectedMaxConns: atomic.LoadUint64(&l.rejectedMaxConns),
+		RejectedRate:     atomic.LoadUint64(&l.rejectedRate),
+	}
+}
+
+// allowIp checks the new connection rate of the visitor ip. Called with the lock held.
+func (l *Limiter) allowIp(remote net.Addr) bool {
+	if l.limits.NewConnsPerIP <= 0 {
+		return true
+	}
+	ip := addrIP(remote)
+	if ip == nil {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.pruned) > time.Minute {
+		for key, ib := range l.ips {
+			if now.Sub(ib.lastUsed) > time.Minute {
+				delete(l.ips, key)
+			}
+		}
+		l.pruned = now
+	}
+
+	ib, ok := l.ips[ip.String()]
+	if !ok {
+		ib = &ipBucket{bucket: NewTokenBucket(l.limits.NewConnsPerIP, l.limits.NewConnsPerIPBurst)}
+		l.ips[ip.String()] = ib
+	}
+	ib.lastUsed = now
+	return ib.bucket.Allow(1)
+}
+
+// admit reserves a connection slot for the visitor.
+func (l *Limiter) admit(remote net.Addr) (*connLimit, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limits.MaxConns > 0 && len(l.conns) >= l.limits.MaxConns {
+		atomic.AddUint64(&l.rejectedMaxConns, 1)
+		return nil, fmt.Errorf("too many connections")
+	}
+	if !l.allowIp(remote) {
+		atomic.AddUint64(&l.rejectedRate, 1)
+		return nil, fmt.Errorf("too many new connections from %v", remote)
+	}
+	cl := &connLimit{
+		limiter: l,
+		in:      NewTokenBucket(float64(l.limits.ConnBandwidth), 0),
+		out:     NewTokenBucket(float64(l.limits.ConnBandwidth), 0),
+	}
+	l.conns[cl] = struct{}{}
+	return cl, nil
+}
+
+func (cl *connLimit) release() {
+	cl.once.Do(func() {
+		cl.limiter.lock.Lock()
+		delete(cl.limiter.conns, cl)
+		cl.limiter.lock.Unlock()
+	})
+}
+
+func (cl *connLimit) waitIn(n int) {
+	cl.in.Wait(n)
+	cl.limiter.in.Wait(n)
+}
+
+func (cl *connLimit) waitOut(n int) {
+	cl.out.Wait(n)
+	cl.limiter.out.Wait(n)
+}
+
+func (cl *connLimit) allowIn(n int) bool {
+	return allowBoth(cl.in, cl.limiter.in, n)
+}
+
+func (cl *connLimit) allowOut(n int) bool {
+	return allowBoth(cl.out, cl.limiter.out, n)
+}
+
+/*
+Conn admits a visitor connection. Reads from the returned connection are limited
+as incoming traffic and writes as outgoing traffic. Closing it frees the slot.
+An error is returned if the connection is over the limits; conn is not closed.
+
+While all the limits are zero conn is returned as it is, so that the copy can use
+the fast paths of the underlying connection. Such a connection is not counted and
+the limits set later do not apply to it.
+*/
+func (l *Limiter) Conn(conn net.Conn) (net.Conn, error) {
+	if l.Limits() == (Limits{}) {
+		return conn, nil
+	}
+	cl, err := l.admit(conn.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, limit: cl}, nil
+}
+
+// Largest chunk read or written at once, so that a single call does not take the
+// whole bandwidth for long.
+const limitedChunk = 16 * 1024
+
+type limitedConn struct {
+	net.Conn
+	limit *connLimit
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > limitedChunk {
+		p = p[:limitedChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limit.waitIn(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > limitedChunk {
+			chunk = chunk[:limitedChunk]
+		}
+		c.limit.waitOut(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+/*
+CloseWrite half-closes the underlying connection if it supports it. The slot is
+kept until Close.
+*/
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("half-close not supported")
+}
+
+func (c *limitedConn) Close() error {
+	c.limit.release()
+	return c.Conn.Close()
+}
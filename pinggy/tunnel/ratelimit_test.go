@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func visitorConn(ip string) net.Conn {
+	conn, _ := net.Pipe()
+	return &addrConn{Conn: conn, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(100*1024, 10*1024)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		b.Wait(10 * 1024)
+	}
+	// The first 10KiB are the burst, the rest takes 0.5s at the rate.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("60KiB at 100KiB/s took %v", elapsed)
+	}
+	if b.Allow(10 * 1024) {
+		t.Fatal("empty bucket allowed a request")
+	}
+	b.SetRate(0, 0)
+	if !b.Allow(1 << 30) {
+		t.Fatal("unlimited bucket denied a request")
+	}
+}
+
+func TestLimiterConns(t *testing.T) {
+	l := NewLimiter(Limits{MaxConns: 1})
+	first, err := l.Conn(visitorConn("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Conn(visitorConn("192.0.2.2")); err == nil {
+		t.Fatal("connection over MaxConns was admitted")
+	}
+	first.Close()
+	if _, err := l.Conn(visitorConn("192.0.2.2")); err != nil {
+		t.Fatalf("connection after close was rejected: %v", err)
+	}
+
+	l.SetLimits(Limits{NewConnsPerIP: 1})
+	if _, err := l.Conn(visitorConn("192.0.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Conn(visitorConn("192.0.2.3")); err == nil {
+		t.Fatal("connection over NewConnsPerIP was admitted")
+	}
+	if _, err := l.Conn(visitorConn("192.0.2.4")); err != nil {
+		t.Fatalf("connection from another ip was rejected: %v", err)
+	}
+	stats := l.Stats()
+	if stats.RejectedMaxConns != 1 || stats.RejectedRate != 1 || stats.ActiveConns != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// Without limits the connection is not wrapped.
+	l.SetLimits(Limits{})
+	conn := visitorConn("192.0.2.5")
+	if unlimited, err := l.Conn(conn); err != nil || unlimited != conn {
+		t.Fatalf("unlimited connection was wrapped: %T %v", unlimited, err)
+	}
+}
+
+func TestAllowBoth(t *testing.T) {
+	total := NewTokenBucket(1000, 0)
+	first, second := NewTokenBucket(600, 0), NewTokenBucket(600, 0)
+	if !allowBoth(first, total, 600) {
+		t.Fatal("datagram within the limits was dropped")
+	}
+	// Only 400 bytes are left in total. The dropped datagram must not use up the
+	// bucket of the connection.
+	if allowBoth(second, total, 600) {
+		t.Fatal("datagram over the total bandwidth was allowed")
+	}
+	if !allowBoth(second, total, 400) {
+		t.Fatal("datagram within the limits was dropped after another was dropped")
+	}
+}
@@ -1,9 +1,13 @@
 package tunnel
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TcpDialer interface {
@@ -15,9 +19,44 @@ type tcpDialer struct {
 	addr *net.TCPAddr
 }
 
+/*
+Options of a tcp tunnel manager.
+*/
+type TcpOptions struct {
+	// Limiter for the forwarded connections. No limit if it is nil.
+	Limiter *Limiter
+
+	// Connections without any data in either direction for this duration are
+	// closed. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// Connections are closed after this duration even if they are active. Zero
+	// means no limit.
+	MaxLifetime time.Duration
+
+	// Keep dialing the local server for this duration if it is unreachable, such
+	// as while it restarts. Zero means a single attempt.
+	DialRetryTimeout time.Duration
+
+	// Delay before the first retry. It doubles on each retry up to 2 seconds.
+	// Default is 100 milliseconds.
+	DialRetryBackoff time.Duration
+
+	// Maximum number of connections waiting for the local server. The others fail
+	// at once. Zero means no limit.
+	MaxWaiting int
+
+	// Called with the visitor connection when the local server could not be
+	// reached, instead of closing it. The connection is closed after it returns.
+	Unavailable func(conn net.Conn)
+}
+
 type tcpTunnelManager struct {
+	waiting int64
+
 	dialer       TcpDialer
 	connListener net.Listener
+	options      TcpOptions
 }
 
 func (t *tcpDialer) Dial() (net.Conn, error) {
@@ -28,21 +67,201 @@ func (t *tcpDialer) GetAddr() net.Addr {
 	return t.addr
 }
 
-func (t *tcpTunnelManager) copy(dst, src net.Conn) {
-	defer src.Close()
-	defer dst.Close()
-	io.Copy(dst, src)
+/*
+closeWriter is implemented by the connections which support half-close, such as
+*net.TCPConn and the ssh channels.
+*/
+type closeWriter interface {
+	CloseWrite() error
 }
 
-func (t *tcpTunnelManager) StartTunnel(streamConn net.Conn) {
+/*
+closeWrite tells the peer that nothing more will be written. The connection is
+closed if it does not support half-close.
+*/
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+		return
+	}
+	conn.Close()
+}
+
+/*
+forwardedConn is a visitor connection together with its local connection.
+*/
+type forwardedConn struct {
+	// Unix nano time of the last data, in either direction.
+	lastActive int64
+
+	visitor net.Conn
+	local   net.Conn
+	once    sync.Once
+}
+
+func (fc *forwardedConn) close() {
+	fc.once.Do(func() {
+		fc.visitor.Close()
+		fc.local.Close()
+	})
+}
+
+func (fc *forwardedConn) touch() {
+	atomic.StoreInt64(&fc.lastActive, time.Now().UnixNano())
+}
+
+func (fc *forwardedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&fc.lastActive)))
+}
+
+// activityReader marks the connection active on every read.
+type activityReader struct {
+	conn *forwardedConn
+	src  io.Reader
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.conn.touch()
+	}
+	return n, err
+}
+
+/*
+copy forwards src to dst with Copy. The reads are tracked only if there is an
+idle timeout, as the tracking disables splicing. When src ends, the end is
+passed on to dst with a half-close, so the other direction keeps working. A
+failure closes both.
+*/
+func (t *tcpTunnelManager) copy(fc *forwardedConn, dst, src net.Conn) {
+	var reader io.Reader = src
+	if t.options.IdleTimeout > 0 {
+		reader = &activityReader{conn: fc, src: src}
+	}
+	_, err := Copy(dst, reader)
+	if err != nil {
+		fc.close()
+		return
+	}
+	closeWrite(dst)
+}
+
+/*
+watch closes the connection when it has been idle for IdleTimeout or open for
+MaxLifetime. The returned function stops watching.
+*/
+func (t *tcpTunnelManager) watch(fc *forwardedConn) (stop func()) {
+	var timers []*time.Timer
+	var lock sync.Mutex
+	if t.options.MaxLifetime > 0 {
+		timers = append(timers, time.AfterFunc(t.options.MaxLifetime, func() {
+			log.Println("Closing connection from", fc.visitor.RemoteAddr(), "after max lifetime", t.options.MaxLifetime)
+			fc.close()
+		}))
+	}
+	if idleTimeout := t.options.IdleTimeout; idleTimeout > 0 {
+		// The lock is held until idleTimer is set, the callback resets it.
+		var idleTimer *time.Timer
+		lock.Lock()
+		idleTimer = time.AfterFunc(idleTimeout, func() {
+			idle := fc.idle()
+			if idle < idleTimeout {
+				lock.Lock()
+				idleTimer.Reset(idleTimeout - idle)
+				lock.Unlock()
+				return
+			}
+			log.Println("Closing connection from", fc.visitor.RemoteAddr(), "after idle timeout", idleTimeout)
+			fc.close()
+		})
+		timers = append(timers, idleTimer)
+		lock.Unlock()
+	}
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+}
+
+const maxDialRetryBackoff = 2 * time.Second
+
+/*
+dial connects to the local server, retrying with backoff for DialRetryTimeout.
+*/
+func (t *tcpTunnelManager) dial() (net.Conn, error) {
 	conn, err := t.dialer.Dial()
+	if err == nil || t.options.DialRetryTimeout <= 0 {
+		return conn, err
+	}
+
+	waiting := atomic.AddInt64(&t.waiting, 1)
+	defer atomic.AddInt64(&t.waiting, -1)
+	if t.options.MaxWaiting > 0 && waiting > int64(t.options.MaxWaiting) {
+		return nil, fmt.Errorf("too many connections waiting: %v", err)
+	}
+
+	backoff := t.options.DialRetryBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	deadline := time.Now().Add(t.options.DialRetryTimeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		conn, err = t.dialer.Dial()
+		if err == nil {
+			return conn, nil
+		}
+		backoff *= 2
+		if backoff > maxDialRetryBackoff {
+			backoff = maxDialRetryBackoff
+		}
+	}
+}
+
+func (t *tcpTunnelManager) StartTunnel(streamConn net.Conn) {
+	if t.options.Limiter != nil {
+		limited, err := t.options.Limiter.Conn(streamConn)
+		if err != nil {
+			streamConn.Close()
+			log.Println("Rejecting connection from", streamConn.RemoteAddr(), err)
+			return
+		}
+		streamConn = limited
+	}
+	conn, err := t.dial()
 	if err != nil {
+		log.Println("Error: could not connect to ", t.dialer.GetAddr().String(), err)
+		if t.options.Unavailable != nil {
+			t.options.Unavailable(streamConn)
+		}
 		streamConn.Close()
-		log.Println("Error: could not connect to ", t.dialer.GetAddr().String())
 		return
 	}
-	go t.copy(streamConn, conn)
-	t.copy(conn, streamConn)
+
+	fc := &forwardedConn{visitor: streamConn, local: conn}
+	fc.touch()
+	stop := t.watch(fc)
+	defer stop()
+	defer fc.close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.copy(fc, streamConn, conn)
+	}()
+	t.copy(fc, conn, streamConn)
+	wg.Wait()
 }
 
 func (t *tcpDialer) UpdateAddr(addr net.Addr) {
@@ -83,10 +302,18 @@ func (t *tcpTunnelManager) GetDialer() Dialer {
 	return t.dialer
 }
 
+func (t *tcpTunnelManager) Close() error {
+	return t.connListener.Close()
+}
+
 func NewTcpTunnelMangerDialer(listener net.Listener, dialer TcpDialer) TunnelManager {
 	return &tcpTunnelManager{connListener: listener, dialer: dialer}
 }
 
+func NewTcpTunnelMangerWithOptions(listener net.Listener, dialer TcpDialer, options TcpOptions) TunnelManager {
+	return &tcpTunnelManager{connListener: listener, dialer: dialer, options: options}
+}
+
 func NewTcpTunnelMangerAddr(listener net.Listener, forwardAddr *net.TCPAddr) TunnelManager {
 	return &tcpTunnelManager{connListener: listener, dialer: NewTcpDialer(forwardAddr)}
 }
@@ -0,0 +1,191 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+startTcpTunnel forwards the connections to a listener on the returned address to
+a local server which is served by handle.
+*/
+func startTcpTunnel(t testing.TB, options TcpOptions, handle func(net.Conn)) string {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { local.Close() })
+	go serveLocal(local, handle)
+	return startTcpForwarding(t, options, local.Addr().(*net.TCPAddr))
+}
+
+func serveLocal(local net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+func startTcpForwarding(t testing.TB, options TcpOptions, local *net.TCPAddr) string {
+	visitors, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := NewTcpTunnelMangerWithOptions(visitors, NewTcpDialer(local), options)
+	t.Cleanup(func() { man.Close() })
+	go man.StartForwarding()
+	return visitors.Addr().String()
+}
+
+func TestTcpHalfClose(t *testing.T) {
+	// The local server answers after the request is complete.
+	addr := startTcpTunnel(t, TcpOptions{Limiter: NewLimiter(Limits{})}, func(conn net.Conn) {
+		defer conn.Close()
+		request, _ := ioutil.ReadAll(conn)
+		conn.Write([]byte("got " + string(request)))
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "got request" {
+		t.Fatalf("unexpected response %q", response)
+	}
+}
+
+func TestTcpTimeouts(t *testing.T) {
+	echo := func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}
+	dial := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// active echoes through conn every 50ms for d and fails if it stops working.
+	active := func(conn net.Conn, d time.Duration) error {
+		buf := make([]byte, 1)
+		for start := time.Now(); time.Since(start) < d; {
+			conn.Write([]byte("x"))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+	// waitClosed returns how long it took until the tunnel closed conn.
+	waitClosed := func(conn net.Conn) time.Duration {
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if err == nil || isTimeout(err) {
+			t.Fatalf("connection was not closed: %v", err)
+		}
+		return time.Since(start)
+	}
+
+	addr := startTcpTunnel(t, TcpOptions{IdleTimeout: 300 * time.Millisecond}, echo)
+	conn := dial(addr)
+	if err := active(conn, 600*time.Millisecond); err != nil {
+		t.Fatalf("active connection closed: %v", err)
+	}
+	if d := waitClosed(conn); d < 200*time.Millisecond || d > time.Second {
+		t.Fatalf("idle connection closed after %v", d)
+	}
+
+	addr = startTcpTunnel(t, TcpOptions{MaxLifetime: 300 * time.Millisecond}, echo)
+	conn = dial(addr)
+	start := time.Now()
+	active(conn, 2*time.Second)
+	if d := time.Since(start); d < 250*time.Millisecond || d > 1500*time.Millisecond {
+		t.Fatalf("connection closed after %v", d)
+	}
+}
+
+func TestTcpDialRetry(t *testing.T) {
+	// Reserve a port for the local server which is started later.
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := local.Addr().(*net.TCPAddr)
+	local.Close()
+
+	addr := startTcpForwarding(t, TcpOptions{
+		DialRetryTimeout: 3 * time.Second,
+		MaxWaiting:       1,
+		Unavailable:      HttpUnavailable(""),
+	}, localAddr)
+
+	waiting, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	waiting.Write([]byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	// The queue is full, the next visitor gets the page at once.
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(refused), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != DefaultStartingPage {
+		t.Fatalf("unexpected response %v %q", resp.Status, body)
+	}
+
+	local, err = net.ListenTCP("tcp", localAddr)
+	if err != nil {
+		t.Skip("cannot listen on the reserved port:", err)
+	}
+	t.Cleanup(func() { local.Close() })
+	go serveLocal(local, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+
+	buf := make([]byte, 5)
+	waiting.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = io.ReadFull(waiting, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
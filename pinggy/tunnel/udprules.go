@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+/*
+UdpRule chooses the local server for udp flows. A flow matches the rule if it
+matches all of the criteria which are set. The first matching rule is used.
+*/
+type UdpRule struct {
+	// Address of the local server for the matching flows.
+	Target string
+
+	// Match the visitors from this network. Nil matches any visitor.
+	Visitors *net.IPNet
+
+	// Match the destination port requested in the socks header of the flow. Zero
+	// matches any flow. Flows which are not wrapped in socks have no such port.
+	SocksPort int
+
+	// Match the flows for which Classify returns true. It is called with the first
+	// datagram of the flow, before anything is sent to the local server.
+	Classify func(visitor net.Addr, first []byte) bool
+}
+
+/*
+SocksConn is implemented by the stream connections which were wrapped in socks.
+SocksAddr returns the address of the socks request.
+*/
+type SocksConn interface {
+	SocksAddr() net.Addr
+}
+
+type udpRoute struct {
+	rule   UdpRule
+	target *net.UDPAddr
+}
+
+func compileUdpRules(rules []UdpRule) ([]*udpRoute, error) {
+	routes := make([]*udpRoute, 0, len(rules))
+	for i, rule := range rules {
+		target, err := net.ResolveUDPAddr("udp", rule.Target)
+		if err != nil {
+			return nil, fmt.Errorf("udp rule %d: %v", i, err)
+		}
+		if rule.SocksPort < 0 || rule.SocksPort > 65535 {
+			return nil, fmt.Errorf("udp rule %d: invalid port %d", i, rule.SocksPort)
+		}
+		routes = append(routes, &udpRoute{rule: rule, target: target})
+	}
+	return routes, nil
+}
+
+func (r *udpRoute) matches(visitor, socksAddr net.Addr, first []byte) bool {
+	rule := &r.rule
+	if rule.Visitors != nil {
+		ip := addrIP(visitor)
+		if ip == nil || !rule.Visitors.Contains(ip) {
+			return false
+		}
+	}
+	if rule.SocksPort != 0 && addrPort(socksAddr) != rule.SocksPort {
+		return false
+	}
+	if rule.Classify != nil && !rule.Classify(visitor, first) {
+		return false
+	}
+	return true
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+/*
+SetRules replaces the rules of the manager. The flows which do not match any rule
+are sent to the address of the dialer. The running flows are not affected.
+*/
+func (t *udpTunnelManager) SetRules(rules []UdpRule) error {
+	routes, err := compileUdpRules(rules)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.routes = routes
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *udpTunnelManager) Rules() []UdpRule {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rules := make([]UdpRule, 0, len(t.routes))
+	for _, route := range t.routes {
+		rules = append(rules, route.rule)
+	}
+	return rules
+}
+
+// needsFirstDatagram tells if the rules have to see the first datagram of a flow.
+func (t *udpTunnelManager) needsFirstDatagram() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, route := range t.routes {
+		if route.rule.Classify != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the target of the first matching rule, or nil.
+func (t *udpTunnelManager) route(streamConn net.Conn, first []byte) *net.UDPAddr {
+	t.lock.Lock()
+	routes := t.routes
+	t.lock.Unlock()
+
+	var socksAddr net.Addr
+	if sc, ok := streamConn.(SocksConn); ok {
+		socksAddr = sc.SocksAddr()
+	}
+	for _, route := range routes {
+		if route.matches(streamConn.RemoteAddr(), socksAddr, first) {
+			return route.target
+		}
+	}
+	return nil
+}
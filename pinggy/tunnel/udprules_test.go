@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type socksConn struct {
+	addrConn
+	socks net.Addr
+}
+
+func (c *socksConn) SocksAddr() net.Addr { return c.socks }
+
+func TestUdpRules(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("203.0.113.0/24")
+	tm := &udpTunnelManager{}
+	err := tm.SetRules([]UdpRule{
+		{Target: "127.0.0.1:1001", SocksPort: 53},
+		{Target: "127.0.0.1:1002", SocksPort: 5000, Visitors: lan},
+		{Target: "127.0.0.1:1003", Classify: func(visitor net.Addr, first []byte) bool { return bytes.HasPrefix(first, []byte("rtp")) }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tm.needsFirstDatagram() {
+		t.Fatal("classifier does not get the first datagram")
+	}
+
+	visitor := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 5), Port: 4000}
+	tests := []struct {
+		name   string
+		conn   net.Conn
+		first  string
+		target string
+	}{
+		{"socks port", &socksConn{addrConn{remote: other}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}}, "", "127.0.0.1:1001"},
+		{"socks port and visitor", &socksConn{addrConn{remote: visitor}, &net.UDPAddr{Port: 5000}}, "", "127.0.0.1:1002"},
+		{"socks port of other visitor", &socksConn{addrConn{remote: other}, &net.UDPAddr{Port: 5000}}, "", ""},
+		{"other socks port", &socksConn{addrConn{remote: other}, &net.UDPAddr{Port: 54}}, "rtp", "127.0.0.1:1003"},
+		{"no socks header", &addrConn{remote: visitor}, "data", ""},
+		{"no socks header classified", &addrConn{remote: visitor}, "rtp1", "127.0.0.1:1003"},
+	}
+	for _, test := range tests {
+		got := ""
+		if target := tm.route(test.conn, []byte(test.first)); target != nil {
+			got = target.String()
+		}
+		if got != test.target {
+			t.Errorf("%s: routed to %q, expected %q", test.name, got, test.target)
+		}
+	}
+
+	for _, rule := range []UdpRule{{Target: "127.0.0.1:1001", SocksPort: 70000}, {Target: "nowhere"}} {
+		if err := tm.SetRules([]UdpRule{rule}); err == nil {
+			t.Errorf("%+v: expected an error", rule)
+		}
+	}
+}
@@ -3,75 +3,221 @@ package tunnel
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UdpDialer interface {
 	Dialer
 	Dial() (*net.UDPConn, error)
 }
+
+/*
+udpTunnel is a flow between a visitor stream and the local server. It works like
+a NAT mapping: the datagrams from the visitor are sent from the socket of the
+flow and the datagrams received on that socket are sent back to the visitor.
+*/
 type udpTunnel struct {
+	// Updated atomically. Kept first for the 64 bit alignment.
+	lastActive int64
+	packetsIn  uint64
+	packetsOut uint64
+	bytesIn    uint64
+	bytesOut   uint64
+
 	packetConn *net.UDPConn
 	streamConn net.Conn
-	toAddr     net.Addr
+
+	// toAddr is nil if packetConn is connected by a custom dialer.
+	toAddr  *net.UDPAddr
+	visitor net.Addr
+	started time.Time
+
+	// First datagram of the visitor, read before the flow is routed. It is sent
+	// before anything else. nil if it was not read.
+	first    *[]byte
+	firstLen int
+
+	// limit is nil if the manager has no limiter.
+	limit     *connLimit
+	man       *udpTunnelManager
+	closeOnce sync.Once
+}
+
+// udpCounters are the atomic counterpart of UdpStats.
+type udpCounters struct {
+	packetsIn       uint64
+	packetsOut      uint64
+	bytesIn         uint64
+	bytesOut        uint64
+	droppedOversize uint64
+	droppedForeign  uint64
+	droppedLimited  uint64
+	rejectedFlows   uint64
+}
+
+func (c *udpCounters) load() UdpStats {
+	return UdpStats{
+		PacketsIn:       atomic.LoadUint64(&c.packetsIn),
+		PacketsOut:      atomic.LoadUint64(&c.packetsOut),
+		BytesIn:         atomic.LoadUint64(&c.bytesIn),
+		BytesOut:        atomic.LoadUint64(&c.bytesOut),
+		DroppedOversize: atomic.LoadUint64(&c.droppedOversize),
+		DroppedForeign:  atomic.LoadUint64(&c.droppedForeign),
+		DroppedLimited:  atomic.LoadUint64(&c.droppedLimited),
+		RejectedFlows:   atomic.LoadUint64(&c.rejectedFlows),
+	}
 }
 
 func (c *udpTunnel) close() {
-	c.packetConn.Close()
-	c.streamConn.Close()
+	c.closeOnce.Do(func() {
+		c.packetConn.Close()
+		c.streamConn.Close()
+		c.man.removeFlow(c)
+		if c.limit != nil {
+			c.limit.release()
+		}
+	})
+}
+
+func (c *udpTunnel) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *udpTunnel) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
+
+func (c *udpTunnel) flowStats() UdpFlowStats {
+	target := net.Addr(c.toAddr)
+	if c.toAddr == nil {
+		target = c.packetConn.RemoteAddr()
+	}
+	return UdpFlowStats{
+		Visitor:    c.visitor,
+		Local:      c.packetConn.LocalAddr(),
+		Target:     target,
+		Started:    c.started,
+		LastActive: c.idleSince(),
+		PacketsIn:  atomic.LoadUint64(&c.packetsIn),
+		PacketsOut: atomic.LoadUint64(&c.packetsOut),
+		BytesIn:    atomic.LoadUint64(&c.bytesIn),
+		BytesOut:   atomic.LoadUint64(&c.bytesOut),
+	}
+}
+
+// accepts checks the source of a datagram received on the socket of the flow. A
+// target without an ip, as in ":5000", is on a local address which is not known.
+func (c *udpTunnel) accepts(from *net.UDPAddr) bool {
+	if c.man.options.AcceptAnySource || c.toAddr.IP == nil || c.toAddr.IP.IsUnspecified() {
+		return true
+	}
+	return from.IP.Equal(c.toAddr.IP)
 }
 
 func (c *udpTunnel) copyToTcp() {
 	defer c.close()
-	buffer := make([]byte, 2048)
+	stats := &c.man.stats
+	buf := getDatagramBuffer()
+	defer putDatagramBuffer(buf)
+	// The datagram is read after the space for the length, so that the frame is
+	// written without copying.
+	frame := *buf
 	for {
-		n, _, err := c.packetConn.ReadFrom(buffer)
+		var n int
+		var err error
+		if c.toAddr == nil {
+			n, err = c.packetConn.Read(frame[2:])
+		} else {
+			var from *net.UDPAddr
+			n, from, err = c.packetConn.ReadFromUDP(frame[2:])
+			if err == nil && !c.accepts(from) {
+				atomic.AddUint64(&stats.droppedForeign, 1)
+				continue
+			}
+		}
 		if err != nil {
 			break
 		}
-		if n <= 0 {
-			break
+		if n > c.man.options.MaxDatagramSize {
+			atomic.AddUint64(&stats.droppedOversize, 1)
+			continue
 		}
-		if n >= (len(buffer) - 2) {
-			continue //ignoring frame size more than 2045
+		if c.limit != nil && !c.limit.allowOut(n) {
+			atomic.AddUint64(&stats.droppedLimited, 1)
+			continue
 		}
-		lengthBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(lengthBytes, uint16(n))
-		packet := append(lengthBytes, buffer[:n]...)
+		binary.BigEndian.PutUint16(frame, uint16(n))
 		// fmt.Println("Writing ", n+2, "bytes to TCP")
-		_, err = c.streamConn.Write(packet)
+		_, err = c.streamConn.Write(frame[:n+2])
 		if err != nil {
 			log.Println("Error while writing packet to tcp, ", err)
 			break
 		}
+		c.touch()
+		atomic.AddUint64(&c.packetsOut, 1)
+		atomic.AddUint64(&c.bytesOut, uint64(n))
+		atomic.AddUint64(&stats.packetsOut, 1)
+		atomic.AddUint64(&stats.bytesOut, uint64(n))
 	}
 }
 
+// send sends a datagram of the visitor to the local server.
+func (c *udpTunnel) send(p []byte) error {
+	if c.limit != nil && !c.limit.allowIn(len(p)) {
+		atomic.AddUint64(&c.man.stats.droppedLimited, 1)
+		return nil
+	}
+	var err error
+	if c.toAddr == nil {
+		_, err = c.packetConn.Write(p)
+	} else {
+		_, err = c.packetConn.WriteToUDP(p, c.toAddr)
+	}
+	if err != nil {
+		return err
+	}
+	c.touch()
+	atomic.AddUint64(&c.packetsIn, 1)
+	atomic.AddUint64(&c.bytesIn, uint64(len(p)))
+	atomic.AddUint64(&c.man.stats.packetsIn, 1)
+	atomic.AddUint64(&c.man.stats.bytesIn, uint64(len(p)))
+	return nil
+}
+
 func (c *udpTunnel) copyToUdp() {
 	defer c.close()
-	buffer := make([]byte, 2048)
-	for {
-		// Read the length of the UDP packet
-		_, err := io.ReadFull(c.streamConn, buffer[:2])
+	if c.first != nil {
+		err := c.send((*c.first)[:c.firstLen])
+		putDatagramBuffer(c.first)
+		c.first = nil
 		if err != nil {
-			break
+			log.Println("Error while writing packet to udp, ", err)
+			return
 		}
+	}
 
-		// Extract the length information
-		length := binary.BigEndian.Uint16(buffer[:2])
-
-		// Read the rest of the UDP packet
-		_, err = io.ReadFull(c.streamConn, buffer[:length])
+	buf := getDatagramBuffer()
+	defer putDatagramBuffer(buf)
+	buffer := (*buf)[:c.man.options.MaxDatagramSize]
+	for {
+		length, err := ReadDatagram(c.streamConn, buffer)
+		if err == ErrDatagramTooLarge {
+			atomic.AddUint64(&c.man.stats.droppedOversize, 1)
+			continue
+		}
 		if err != nil {
 			break
 		}
 
 		// fmt.Println("Writing ", length, "bytes to UDP", c.toAddr.String())
 
-		// Write the data to the TCP connection
-		_, err = c.packetConn.Write(buffer[:length])
+		// Write the data to the UDP connection
+		err = c.send(buffer[:length])
 		if err != nil {
 			log.Println("Error while writing packet to udp, ", err)
 			break
@@ -80,14 +226,21 @@ func (c *udpTunnel) copyToUdp() {
 }
 
 type udpDialer struct {
+	lock    sync.Mutex
 	udpAddr *net.UDPAddr
 }
 
 func (u *udpDialer) Dial() (*net.UDPConn, error) {
-	return net.DialUDP("udp", nil, u.udpAddr)
+	return net.DialUDP("udp", nil, u.addr())
 }
 
 func (u *udpDialer) GetAddr() net.Addr {
+	return u.addr()
+}
+
+func (u *udpDialer) addr() *net.UDPAddr {
+	u.lock.Lock()
+	defer u.lock.Unlock()
 	return u.udpAddr
 }
 
@@ -99,21 +252,281 @@ func (u *udpDialer) UpdateAddr(addr net.Addr) {
 	if !ok {
 		return
 	}
+	u.lock.Lock()
 	u.udpAddr = udpAddr
+	u.lock.Unlock()
+}
+
+/*
+Options of an udp tunnel manager.
+*/
+type UdpOptions struct {
+	// Datagrams larger than this are dropped and counted. Default and maximum is
+	// MaxDatagramSize.
+	MaxDatagramSize int
+
+	// Flows without any datagram for this duration are closed. Default is 2 minutes.
+	// Negative value disables it.
+	IdleTimeout time.Duration
+
+	// Maximum number of concurrent flows. New flows are rejected once it is
+	// reached. Zero means no limit.
+	MaxFlows int
+
+	// Send the datagrams of a visitor from the same port as the visitor, if that
+	// port is free on this machine. A random port is used otherwise.
+	PreserveSourcePort bool
+
+	// Accept replies from any address. By default only the datagrams from the ip
+	// of the local server are sent back to the visitor, from any of its ports.
+	AcceptAnySource bool
+
+	// Limiter for the flows and their datagrams. No limit if it is nil.
+	Limiter *Limiter
+}
+
+const defaultUdpIdleTimeout = 2 * time.Minute
+
+/*
+UdpFlowStats describes an active flow of an udp tunnel manager.
+*/
+type UdpFlowStats struct {
+	// Address of the visitor if it is known.
+	Visitor net.Addr
+
+	// Local address of the socket used for the flow.
+	Local net.Addr
+
+	// Address of the local server.
+	Target net.Addr
+
+	Started    time.Time
+	LastActive time.Time
+
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
+}
+
+/*
+UdpTunnelManager is a TunnelManager which forwards udp flows.
+*/
+type UdpTunnelManager interface {
+	TunnelManager
+
+	// Stats returns the counters summed over all the flows.
+	Stats() UdpStats
+
+	// Flows returns the active flows, oldest first.
+	Flows() []UdpFlowStats
+
+	// SetRules replaces the rules choosing the local server of the new flows.
+	SetRules(rules []UdpRule) error
+	Rules() []UdpRule
 }
 
 type udpTunnelManager struct {
+	stats udpCounters
+
 	dialer       UdpDialer
 	connListener net.Listener
+	options      UdpOptions
+
+	lock   sync.Mutex
+	flows  map[*udpTunnel]struct{}
+	routes []*udpRoute
+
+	reaperOnce   sync.Once
+	closeOnce    sync.Once
+	closeChannel chan struct{}
+}
+
+// listen opens the socket of a flow to toAddr.
+func (t *udpTunnelManager) listen(visitor net.Addr) (*net.UDPConn, error) {
+	if t.options.PreserveSourcePort {
+		if port := addrPort(visitor); port > 0 {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+			if err == nil {
+				return conn, nil
+			}
+			log.Printf("Could not preserve source port %d: %v\n", port, err)
+		}
+	}
+	return net.ListenUDP("udp", nil)
+}
+
+/*
+open opens the socket of a flow. The target is chosen by the rules, falling back
+to the dialer. The socket of a custom dialer is used as it is.
+*/
+func (t *udpTunnelManager) open(streamConn net.Conn, first []byte) (*net.UDPConn, *net.UDPAddr, error) {
+	toAddr := t.route(streamConn, first)
+	if toAddr == nil {
+		dialer, ok := t.dialer.(*udpDialer)
+		if !ok {
+			conn, err := t.dialer.Dial()
+			return conn, nil, err
+		}
+		toAddr = dialer.addr()
+		if toAddr == nil {
+			return nil, nil, fmt.Errorf("no target for the flow of %v", streamConn.RemoteAddr())
+		}
+	}
+	conn, err := t.listen(streamConn.RemoteAddr())
+	return conn, toAddr, err
+}
+
+// readFirst reads the first datagram which is not oversized.
+func (t *udpTunnelManager) readFirst(streamConn net.Conn) (*[]byte, int, error) {
+	buf := getDatagramBuffer()
+	for {
+		n, err := ReadDatagram(streamConn, (*buf)[:t.options.MaxDatagramSize])
+		if err == ErrDatagramTooLarge {
+			atomic.AddUint64(&t.stats.droppedOversize, 1)
+			continue
+		}
+		if err != nil {
+			putDatagramBuffer(buf)
+			return nil, 0, err
+		}
+		return buf, n, nil
+	}
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+func (t *udpTunnelManager) addFlow(tun *udpTunnel) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.options.MaxFlows > 0 && len(t.flows) >= t.options.MaxFlows {
+		return false
+	}
+	t.flows[tun] = struct{}{}
+	return true
+}
+
+func (t *udpTunnelManager) removeFlow(tun *udpTunnel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.flows, tun)
+}
+
+func (t *udpTunnelManager) activeFlows() []*udpTunnel {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	flows := make([]*udpTunnel, 0, len(t.flows))
+	for tun := range t.flows {
+		flows = append(flows, tun)
+	}
+	return flows
+}
+
+/*
+reapIdleFlows closes the flows which have not seen any datagram for the idle timeout.
+*/
+func (t *udpTunnelManager) reapIdleFlows() {
+	interval := t.options.IdleTimeout / 4
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.closeChannel:
+			return
+		}
+		for _, tun := range t.activeFlows() {
+			if time.Since(tun.idleSince()) >= t.options.IdleTimeout {
+				tun.close()
+			}
+		}
+	}
 }
 
 func (t *udpTunnelManager) StartTunnel(streamConn net.Conn) {
-	packetConn, err := t.dialer.Dial()
+	if t.options.IdleTimeout > 0 {
+		t.reaperOnce.Do(func() { go t.reapIdleFlows() })
+	}
+
+	visitor := streamConn.RemoteAddr()
+	var limit *connLimit
+	if t.options.Limiter != nil {
+		var err error
+		limit, err = t.options.Limiter.admit(visitor)
+		if err != nil {
+			log.Println("Rejecting udp flow from", visitor, err)
+			atomic.AddUint64(&t.stats.rejectedFlows, 1)
+			streamConn.Close()
+			return
+		}
+	}
+	var first *[]byte
+	firstLen := 0
+	if t.needsFirstDatagram() {
+		var err error
+		first, firstLen, err = t.readFirst(streamConn)
+		if err != nil {
+			if limit != nil {
+				limit.release()
+			}
+			streamConn.Close()
+			return
+		}
+	}
+	var firstBytes []byte
+	if first != nil {
+		firstBytes = (*first)[:firstLen]
+	}
+
+	packetConn, toAddr, err := t.open(streamConn, firstBytes)
 	if err != nil {
+		log.Println("Error: could not open udp socket for ", visitor, err)
+		if first != nil {
+			putDatagramBuffer(first)
+		}
+		if limit != nil {
+			limit.release()
+		}
+		atomic.AddUint64(&t.stats.rejectedFlows, 1)
+		streamConn.Close()
+		return
+	}
+	tun := &udpTunnel{
+		packetConn: packetConn,
+		streamConn: streamConn,
+		toAddr:     toAddr,
+		visitor:    visitor,
+		started:    time.Now(),
+		first:      first,
+		firstLen:   firstLen,
+		limit:      limit,
+		man:        t,
+	}
+	tun.touch()
+	if !t.addFlow(tun) {
+		atomic.AddUint64(&t.stats.rejectedFlows, 1)
+		log.Println("Rejecting udp flow from", visitor, "too many flows")
+		if first != nil {
+			putDatagramBuffer(first)
+		}
+		if limit != nil {
+			limit.release()
+		}
+		packetConn.Close()
 		streamConn.Close()
 		return
 	}
-	tun := udpTunnel{packetConn: packetConn, streamConn: streamConn, toAddr: t.dialer.GetAddr()}
 	// fmt.Println("Fowarding new con")
 	go tun.copyToTcp()
 	tun.copyToUdp()
@@ -143,12 +556,53 @@ func (u *udpTunnelManager) GetDialer() Dialer {
 	return u.dialer
 }
 
+func (u *udpTunnelManager) Stats() UdpStats {
+	return u.stats.load()
+}
+
+func (u *udpTunnelManager) Flows() []UdpFlowStats {
+	flows := make([]UdpFlowStats, 0)
+	for _, tun := range u.activeFlows() {
+		flows = append(flows, tun.flowStats())
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Started.Before(flows[j].Started) })
+	return flows
+}
+
+/*
+Close stops accepting new flows and closes the active ones.
+*/
+func (u *udpTunnelManager) Close() error {
+	err := u.connListener.Close()
+	u.closeOnce.Do(func() { close(u.closeChannel) })
+	for _, tun := range u.activeFlows() {
+		tun.close()
+	}
+	return err
+}
+
 func NewUdpDialer(forwardAddr *net.UDPAddr) UdpDialer {
 	return &udpDialer{udpAddr: forwardAddr}
 }
 
 func NewUdpTunnelMangerWithDialer(listener net.Listener, dialer UdpDialer) TunnelManager {
-	tunMan := &udpTunnelManager{connListener: listener, dialer: dialer}
+	return NewUdpTunnelMangerWithOptions(listener, dialer, UdpOptions{})
+}
+
+func NewUdpTunnelMangerWithOptions(listener net.Listener, dialer UdpDialer, options UdpOptions) UdpTunnelManager {
+	if options.MaxDatagramSize <= 0 || options.MaxDatagramSize > MaxDatagramSize {
+		options.MaxDatagramSize = MaxDatagramSize
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = defaultUdpIdleTimeout
+	}
+	tunMan := &udpTunnelManager{
+		connListener: listener,
+		dialer:       dialer,
+		options:      options,
+		flows:        make(map[*udpTunnel]struct{}),
+		closeChannel: make(chan struct{}),
+	}
 	return tunMan
 }
 
@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+DefaultStartingPage is the page served by HttpUnavailable if no page is given.
+It reloads itself until the local server is up.
+*/
+const DefaultStartingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>Service starting</title>
+</head>
+<body>
+<h1>Service starting</h1>
+<p>The service is not reachable yet. This page reloads automatically.</p>
+</body>
+</html>
+`
+
+/*
+HttpUnavailable returns a handler for TcpOptions.Unavailable which answers the
+http request of the visitor with 503 Service Unavailable and the html page.
+*/
+func HttpUnavailable(page string) func(conn net.Conn) {
+	if page == "" {
+		page = DefaultStartingPage
+	}
+	return func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		body := page
+		if req.Method == http.MethodHead {
+			body = ""
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\n"+
+			"Content-Type: text/html; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Retry-After: 2\r\n"+
+			"Cache-Control: no-store\r\n"+
+			"Connection: close\r\n\r\n%s", len(page), body)
+	}
+}
@@ -0,0 +1,284 @@
+package tunnelfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+node is a decoded value along with the line it was found at. Values are one of
+string, bool, int64, float64, []*node or map[string]*node.
+*/
+type node struct {
+	line  int
+	value interface{}
+	keys  []string // keys of a map in the order of appearance
+}
+
+func (n *node) kind() string {
+	switch n.value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case []*node:
+		return "list"
+	case map[string]*node:
+		return "map"
+	case nil:
+		return "null"
+	}
+	return "unknown"
+}
+
+// plain converts the node back to plain go values. It is used to build json.
+func (n *node) plain() interface{} {
+	switch v := n.value.(type) {
+	case []*node:
+		list := make([]interface{}, len(v))
+		for i, c := range v {
+			list[i] = c.plain()
+		}
+		return list
+	case map[string]*node:
+		m := make(map[string]interface{}, len(v))
+		for k, c := range v {
+			m[k] = c.plain()
+		}
+		return m
+	}
+	return n.value
+}
+
+// decodeYaml decodes yaml as well as json, json being a subset of yaml.
+func decodeYaml(data []byte) (*node, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		return &node{line: 1, value: map[string]*node{}}, nil
+	}
+	return fromYaml(&doc)
+}
+
+func fromYaml(yn *yaml.Node) (*node, error) {
+	switch yn.Kind {
+	case yaml.DocumentNode:
+		if len(yn.Content) == 0 {
+			return &node{line: yn.Line, value: map[string]*node{}}, nil
+		}
+		return fromYaml(yn.Content[0])
+	case yaml.AliasNode:
+		return fromYaml(yn.Alias)
+	case yaml.SequenceNode:
+		list := make([]*node, 0, len(yn.Content))
+		for _, c := range yn.Content {
+			cn, err := fromYaml(c)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, cn)
+		}
+		return &node{line: yn.Line, value: list}, nil
+	case yaml.MappingNode:
+		m := make(map[string]*node)
+		n := &node{line: yn.Line, value: m}
+		for i := 0; i+1 < len(yn.Content); i += 2 {
+			k, v := yn.Content[i], yn.Content[i+1]
+			if _, ok := m[k.Value]; ok {
+				return nil, fmt.Errorf("line %d: duplicate key %q", k.Line, k.Value)
+			}
+			cn, err := fromYaml(v)
+			if err != nil {
+				return nil, err
+			}
+			// Point to the key rather than the value, a multiline value starts on the next line.
+			cn.line = k.Line
+			m[k.Value] = cn
+			n.keys = append(n.keys, k.Value)
+		}
+		return n, nil
+	case yaml.ScalarNode:
+		n := &node{line: yn.Line}
+		switch yn.ShortTag() {
+		case "!!null":
+			n.value = nil
+		case "!!bool":
+			var b bool
+			if err := yn.Decode(&b); err != nil {
+				return nil, fmt.Errorf("line %d: %v", yn.Line, err)
+			}
+			n.value = b
+		case "!!int":
+			var i int64
+			if err := yn.Decode(&i); err != nil {
+				return nil, fmt.Errorf("line %d: %v", yn.Line, err)
+			}
+			n.value = i
+		case "!!float":
+			var f float64
+			if err := yn.Decode(&f); err != nil {
+				return nil, fmt.Errorf("line %d: %v", yn.Line, err)
+			}
+			n.value = f
+		default:
+			n.value = yn.Value
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported yaml node", yn.Line)
+}
+
+func decodeToml(data []byte) (*node, error) {
+	var m map[string]interface{}
+	_, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	lines := tomlKeyLines(data)
+	return fromToml(m, "", lines, 1), nil
+}
+
+func fromToml(value interface{}, path string, lines map[string]int, parentLine int) *node {
+	line, ok := lines[path]
+	if !ok {
+		line = parentLine
+	}
+	n := &node{line: line}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]*node, len(v))
+		for k, c := range v {
+			m[k] = fromToml(c, joinPath(path, k), lines, line)
+			n.keys = append(n.keys, k)
+		}
+		// toml does not keep the order, sort by the line instead.
+		sort.SliceStable(n.keys, func(i, j int) bool { return m[n.keys[i]].line < m[n.keys[j]].line })
+		n.value = m
+	case []map[string]interface{}:
+		list := make([]*node, len(v))
+		for i, c := range v {
+			list[i] = fromToml(c, joinPath(path, strconv.Itoa(i)), lines, line)
+		}
+		n.value = list
+	case []interface{}:
+		list := make([]*node, len(v))
+		for i, c := range v {
+			list[i] = fromToml(c, joinPath(path, strconv.Itoa(i)), lines, line)
+		}
+		n.value = list
+	case time.Time:
+		n.value = v.String()
+	default:
+		n.value = v
+	}
+	return n
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+/*
+tomlKeyLines finds the line of the keys and tables in a toml document. The toml
+decoder does not expose the positions, so it follows the table headers and key
+assignments line by line. Array of tables are indexed in the order of appearance.
+Keys within inline tables are not indexed, the line of the enclosing key is used for them.
+*/
+func tomlKeyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	arrays := make(map[string]int)
+	prefix := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			end := strings.Index(line, "]]")
+			if end < 0 {
+				continue
+			}
+			segments := splitTomlKey(line[2:end])
+			path := resolveTomlPath(segments, arrays)
+			idx, ok := arrays[path]
+			if ok {
+				idx++
+			}
+			arrays[path] = idx
+			if _, ok := lines[path]; !ok {
+				lines[path] = lineNo
+			}
+			prefix = joinPath(path, strconv.Itoa(idx))
+			lines[prefix] = lineNo
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			prefix = resolveTomlPath(splitTomlKey(line[1:end]), arrays)
+			lines[prefix] = lineNo
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		path := prefix
+		for _, seg := range splitTomlKey(line[:eq]) {
+			path = joinPath(path, seg)
+			if _, ok := lines[path]; !ok {
+				lines[path] = lineNo
+			}
+		}
+	}
+	return lines
+}
+
+// resolveTomlPath adds the current index of the array of tables in the path.
+func resolveTomlPath(segments []string, arrays map[string]int) string {
+	path := ""
+	for i, seg := range segments {
+		path = joinPath(path, seg)
+		if i == len(segments)-1 {
+			break
+		}
+		if idx, ok := arrays[path]; ok {
+			path = joinPath(path, strconv.Itoa(idx))
+		}
+	}
+	return path
+}
+
+func splitTomlKey(key string) []string {
+	var segments []string
+	for _, seg := range strings.Split(key, ".") {
+		seg = strings.TrimSpace(seg)
+		seg = strings.Trim(seg, `"'`)
+		segments = append(segments, seg)
+	}
+	return segments
+}
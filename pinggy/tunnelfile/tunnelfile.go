@@ -0,0 +1,606 @@
+/*
+Package tunnelfile loads tunnels from a yaml, json or toml file and starts them.
+
+A yaml file looks like:
+
+	tunnels:
+	  - name: web
+	    type: http
+	    token: mytoken
+	    forwardTo: localhost:3000
+	    whitelist: [10.0.0.0/8, 1.2.3.4/32]
+	    basicAuth:
+	      - username: alice
+	        password: secret
+	    bearerAuth: [somekey]
+	    headers:
+	      - action: add
+	        name: X-Env
+	        value: staging
+	      - action: remove
+	        name: X-Internal
+	    reverseProxy: localhost:3000
+	    webDebugger: localhost:4300
+	  - name: ssh
+	    type: tcp
+	    token: mytoken
+	    forwardTo: localhost:22
+
+The `headerManipulation` key accepts the json produced by ListHeaderManipulations.
+The individual header and auth keys are applied on top of it.
+*/
+package tunnelfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+type Format string
+
+const (
+	YAML Format = "yaml"
+	JSON Format = "json"
+	TOML Format = "toml"
+)
+
+/*
+Tunnel is a tunnel described in the file.
+*/
+type Tunnel struct {
+	// Name of the tunnel. It defaults to the position of the tunnel in the file.
+	Name string
+
+	Config pinggy.Config
+
+	// Address where the web debugger would listen. Empty disables it.
+	WebDebuggerAddr string
+
+	// Line of the tunnel in the file.
+	Line int
+}
+
+type File struct {
+	Path    string
+	Tunnels []*Tunnel
+}
+
+/*
+LineError is a problem in the file along with its position.
+*/
+type LineError struct {
+	Path string
+	Line int
+	Msg  string
+}
+
+func (e *LineError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "<input>"
+	}
+	return fmt.Sprintf("%s:%d: %s", path, e.Line, e.Msg)
+}
+
+/*
+ErrorList contains all the problems found while validating a file.
+*/
+type ErrorList []*LineError
+
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+/*
+Load the file. The format is decided by the extension (.yaml, .yml, .json or .toml).
+*/
+func Load(path string) (*File, error) {
+	var format Format
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = YAML
+	case ".json":
+		format = JSON
+	case ".toml":
+		format = TOML
+	default:
+		return nil, fmt.Errorf("unknown tunnel file format: %s", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := Parse(data, format)
+	if err != nil {
+		if el, ok := err.(ErrorList); ok {
+			for _, e := range el {
+				e.Path = path
+			}
+			return nil, el
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	file.Path = path
+	return file, nil
+}
+
+/*
+Parse and validate the data in the given format. Validation problems are returned
+as ErrorList.
+*/
+func Parse(data []byte, format Format) (*File, error) {
+	var root *node
+	var err error
+	switch format {
+	case YAML, JSON:
+		root, err = decodeYaml(data)
+	case TOML:
+		root, err = decodeToml(data)
+	default:
+		return nil, fmt.Errorf("unknown tunnel file format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{}
+	file := p.parseFile(root)
+	if len(p.errs) > 0 {
+		sort.SliceStable(p.errs, func(i, j int) bool { return p.errs[i].Line < p.errs[j].Line })
+		return nil, p.errs
+	}
+	return file, nil
+}
+
+type parser struct {
+	errs ErrorList
+}
+
+func (p *parser) errorf(n *node, format string, args ...interface{}) {
+	p.errs = append(p.errs, &LineError{Line: n.line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) mapping(n *node, what string) map[string]*node {
+	m, ok := n.value.(map[string]*node)
+	if !ok {
+		p.errorf(n, "%s must be a map, found %s", what, n.kind())
+		return nil
+	}
+	return m
+}
+
+func (p *parser) list(n *node, what string) []*node {
+	switch v := n.value.(type) {
+	case []*node:
+		return v
+	case string:
+		// Allow a single value in place of a list.
+		return []*node{n}
+	}
+	p.errorf(n, "%s must be a list, found %s", what, n.kind())
+	return nil
+}
+
+func (p *parser) str(n *node, key string) string {
+	switch v := n.value.(type) {
+	case string:
+		return v
+	case int64:
+		return fmt.Sprint(v)
+	}
+	p.errorf(n, "%s must be a string, found %s", key, n.kind())
+	return ""
+}
+
+func (p *parser) boolean(n *node, key string) bool {
+	v, ok := n.value.(bool)
+	if !ok {
+		p.errorf(n, "%s must be true or false, found %s", key, n.kind())
+	}
+	return v
+}
+
+func (p *parser) duration(n *node, key string) time.Duration {
+	switch v := n.value.(type) {
+	case int64:
+		return time.Duration(v) * time.Second
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			p.errorf(n, "invalid duration for %s: %q", key, v)
+		}
+		return d
+	}
+	p.errorf(n, "%s must be a duration, found %s", key, n.kind())
+	return 0
+}
+
+func (p *parser) hostPort(n *node, key string) string {
+	addr := p.str(n, key)
+	if addr == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		p.errorf(n, "invalid address for %s: %q", key, addr)
+	}
+	return addr
+}
+
+func (p *parser) parseFile(root *node) *File {
+	file := &File{}
+	m := p.mapping(root, "tunnel file")
+	if m == nil {
+		return file
+	}
+	for _, key := range root.keys {
+		if key != "tunnels" {
+			p.errorf(m[key], "unknown key %q", key)
+		}
+	}
+	tunnels, ok := m["tunnels"]
+	if !ok {
+		p.errorf(root, "no tunnels found")
+		return file
+	}
+	names := make(map[string]bool)
+	for i, tn := range p.list(tunnels, "tunnels") {
+		tunnel := p.parseTunnel(tn)
+		if tunnel == nil {
+			continue
+		}
+		if tunnel.Name == "" {
+			tunnel.Name = fmt.Sprintf("tunnel%d", i)
+		}
+		if names[tunnel.Name] {
+			p.errorf(tn, "duplicate tunnel name %q", tunnel.Name)
+		}
+		names[tunnel.Name] = true
+		file.Tunnels = append(file.Tunnels, tunnel)
+	}
+	return file
+}
+
+func (p *parser) parseTunnel(tn *node) *Tunnel {
+	m := p.mapping(tn, "tunnel")
+	if m == nil {
+		return nil
+	}
+	tunnel := &Tunnel{Line: tn.line}
+	conf := &tunnel.Config
+	var hm pinggy.HttpHeaderManipulationAndAuthConfig
+	headerManipulation := func() pinggy.HttpHeaderManipulationAndAuthConfig {
+		if hm == nil {
+			hm = pinggy.CreateHeaderManipulationAndAuthConfig()
+		}
+		return hm
+	}
+	var httpOnly []*node
+
+	// headerManipulation has to be applied before the individual keys.
+	if n, ok := m["headerManipulation"]; ok {
+		data, err := json.Marshal(n.plain())
+		if err == nil {
+			err = headerManipulation().ReconstructHeaderManipulationDataFromJson(data)
+		}
+		if err != nil {
+			p.errorf(n, "invalid headerManipulation: %v", err)
+		}
+		httpOnly = append(httpOnly, n)
+	}
+
+	for _, key := range tn.keys {
+		n := m[key]
+		switch key {
+		case "name":
+			tunnel.Name = p.str(n, key)
+		case "type":
+			typ := strings.ToLower(p.str(n, key))
+			switch pinggy.TunnelType(typ) {
+			case pinggy.HTTP, pinggy.TCP, pinggy.TLS, pinggy.TLSTCP:
+				conf.Type = pinggy.TunnelType(typ)
+			default:
+				if pinggy.UDPTunnelType(typ) == pinggy.UDP {
+					conf.AltType = pinggy.UDP
+				} else {
+					p.errorf(n, "unknown tunnel type %q", typ)
+				}
+			}
+		case "altType":
+			if pinggy.UDPTunnelType(strings.ToLower(p.str(n, key))) != pinggy.UDP {
+				p.errorf(n, "altType can only be %q", pinggy.UDP)
+			}
+			conf.AltType = pinggy.UDP
+		case "token":
+			conf.Token = p.str(n, key)
+		case "server":
+			conf.Server = p.str(n, key)
+		case "sshOverSsl":
+			conf.SshOverSsl = p.boolean(n, key)
+		case "force":
+			conf.Force = p.boolean(n, key)
+		case "proxy":
+			raw := p.str(n, key)
+			proxy, err := url.Parse(raw)
+			if err != nil || proxy.Hostname() == "" {
+				p.errorf(n, "invalid proxy url %q", raw)
+			}
+			conf.Proxy = proxy
+		case "timeout":
+			conf.Timeout = p.duration(n, key)
+		case "sshTimeout":
+			conf.SshTimeout = p.duration(n, key)
+		case "forwardTo":
+			conf.TcpForwardingAddr = p.hostPort(n, key)
+		case "udpForwardTo":
+			conf.UdpForwardingAddr = p.hostPort(n, key)
+		case "whitelist":
+			for _, cn := range p.list(n, key) {
+				ipNet := p.cidr(cn)
+				if ipNet != nil {
+					conf.IpWhiteList = append(conf.IpWhiteList, ipNet)
+				}
+			}
+		case "localServerTls":
+			if conf.ForwardedConnectionConf == nil {
+				conf.ForwardedConnectionConf = &pinggy.ForwardedConnectionConf{}
+			}
+			conf.ForwardedConnectionConf.TlsLocalServer = p.boolean(n, key)
+		case "localServerSni":
+			if conf.ForwardedConnectionConf == nil {
+				conf.ForwardedConnectionConf = &pinggy.ForwardedConnectionConf{}
+			}
+			conf.ForwardedConnectionConf.TlsLocalServerSNI = p.str(n, key)
+		case "webDebugger":
+			tunnel.WebDebuggerAddr = p.hostPort(n, key)
+		case "basicAuth":
+			for _, cn := range p.list(n, key) {
+				username, password := p.basicAuth(cn)
+				if username != "" {
+					headerManipulation().AddBasicAuth(username, password)
+				}
+			}
+			httpOnly = append(httpOnly, n)
+		case "bearerAuth":
+			for _, cn := range p.list(n, key) {
+				if k := p.str(cn, key); k != "" {
+					headerManipulation().AddBearerAuth(k)
+				}
+			}
+			httpOnly = append(httpOnly, n)
+		case "headers":
+			for _, cn := range p.list(n, key) {
+				p.headerRule(cn, headerManipulation())
+			}
+			httpOnly = append(httpOnly, n)
+		case "reverseProxy":
+			headerManipulation().SetReverseProxy(p.str(n, key))
+			httpOnly = append(httpOnly, n)
+		case "noReverseProxy":
+			if p.boolean(n, key) {
+				headerManipulation().SetNoReverseProxy()
+			}
+			httpOnly = append(httpOnly, n)
+		case "hostname":
+			headerManipulation().SetHostname(p.str(n, key))
+			httpOnly = append(httpOnly, n)
+		case "httpsOnly":
+			headerManipulation().SetHttpsOnly(p.boolean(n, key))
+			httpOnly = append(httpOnly, n)
+		case "fullUrl":
+			headerManipulation().SetFullUrl(p.boolean(n, key))
+			httpOnly = append(httpOnly, n)
+		case "passPreflight":
+			headerManipulation().SetPassPreflight(p.boolean(n, key))
+			httpOnly = append(httpOnly, n)
+		case "xff":
+			headerManipulation().SetXFFHeader(p.str(n, key))
+			httpOnly = append(httpOnly, n)
+		case "headerManipulation":
+			// already applied
+		default:
+			p.errorf(n, "unknown key %q", key)
+		}
+	}
+
+	if conf.Type == "" && conf.AltType == "" {
+		conf.Type = pinggy.HTTP
+	}
+	if conf.Type != pinggy.HTTP {
+		for _, n := range httpOnly {
+			p.errorf(n, "header manipulation and authentication are available only for %s tunnels", pinggy.HTTP)
+		}
+		if tunnel.WebDebuggerAddr != "" && conf.Type == "" {
+			p.errorf(m["webDebugger"], "web debugger is not available for %s only tunnels", pinggy.UDP)
+		}
+	}
+	if conf.UdpForwardingAddr != "" && conf.AltType == "" {
+		p.errorf(m["udpForwardTo"], "udpForwardTo requires altType %s", pinggy.UDP)
+	}
+	if conf.TcpForwardingAddr != "" && conf.Type == "" {
+		p.errorf(m["forwardTo"], "forwardTo is not available for %s only tunnels, use udpForwardTo", pinggy.UDP)
+	}
+	if hm != nil {
+		conf.HeaderManipulationAndAuth = hm
+	}
+
+	return tunnel
+}
+
+func (p *parser) cidr(n *node) *net.IPNet {
+	s := p.str(n, "whitelist")
+	if s == "" {
+		return nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			p.errorf(n, "invalid ip %q in whitelist", s)
+			return nil
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		p.errorf(n, "invalid cidr %q in whitelist", s)
+		return nil
+	}
+	return ipNet
+}
+
+// basicAuth accepts either "username:password" or a map with username and password.
+func (p *parser) basicAuth(n *node) (username, password string) {
+	if s, ok := n.value.(string); ok {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			p.errorf(n, "basicAuth must be in the form username:password")
+			return "", ""
+		}
+		return parts[0], parts[1]
+	}
+	m := p.mapping(n, "basicAuth")
+	if m == nil {
+		return "", ""
+	}
+	for _, key := range n.keys {
+		switch key {
+		case "username":
+			username = p.str(m[key], key)
+		case "password":
+			password = p.str(m[key], key)
+		default:
+			p.errorf(m[key], "unknown key %q in basicAuth", key)
+		}
+	}
+	if username == "" {
+		p.errorf(n, "username missing in basicAuth")
+	}
+	return
+}
+
+func (p *parser) headerRule(n *node, hm pinggy.HttpHeaderManipulationAndAuthConfig) {
+	m := p.mapping(n, "header rule")
+	if m == nil {
+		return
+	}
+	var action, name, value string
+	hasValue := false
+	for _, key := range n.keys {
+		switch key {
+		case "action":
+			action = strings.ToLower(p.str(m[key], key))
+		case "name":
+			name = p.str(m[key], key)
+		case "value":
+			value = p.str(m[key], key)
+			hasValue = true
+		default:
+			p.errorf(m[key], "unknown key %q in header rule", key)
+		}
+	}
+	if name == "" {
+		p.errorf(n, "name missing in header rule")
+		return
+	}
+
+	var err error
+	switch action {
+	case "add", "update":
+		if !hasValue {
+			p.errorf(n, "value missing in header rule")
+			return
+		}
+		if action == "add" {
+			err = hm.AddHeader(name, value)
+		} else {
+			err = hm.UpdateHeader(name, value)
+		}
+	case "remove":
+		if hasValue {
+			p.errorf(m["value"], "value is not allowed with remove")
+		}
+		err = hm.RemoveHeader(name)
+	default:
+		p.errorf(n, "header rule action must be one of add, remove or update")
+		return
+	}
+	if err != nil {
+		p.errorf(n, "%v", err)
+	}
+}
+
+/*
+Start all the tunnels in the file. The tunnels with a forwarding address start
+forwarding right away. If any of the tunnels fail, the tunnels already started
+are closed. The listeners are returned in the order of the tunnels in the file.
+*/
+func (f *File) Start() ([]pinggy.PinggyListener, error) {
+	listeners := make([]pinggy.PinggyListener, 0, len(f.Tunnels))
+	closeAll := func() {
+		for _, pl := range listeners {
+			pl.Close()
+		}
+	}
+
+	for _, tunnel := range f.Tunnels {
+		pl, err := pinggy.ConnectWithConfig(tunnel.Config)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("tunnel %s: %v", tunnel.Name, err)
+		}
+		listeners = append(listeners, pl)
+
+		if tunnel.WebDebuggerAddr != "" {
+			if tunnel.Config.Type == pinggy.HTTP {
+				err = pl.InitiateWebDebug(tunnel.WebDebuggerAddr)
+			} else {
+				err = pl.InitiateDebugForward(tunnel.WebDebuggerAddr)
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("tunnel %s: %v", tunnel.Name, err)
+			}
+		}
+
+		if tunnel.Config.TcpForwardingAddr != "" || tunnel.Config.UdpForwardingAddr != "" {
+			go func(name string, pl pinggy.PinggyListener) {
+				err := pl.StartForwarding()
+				if err != nil {
+					log.Printf("Forwarding stopped for %s: %v\n", name, err)
+				}
+			}(tunnel.Name, pl)
+		}
+	}
+
+	return listeners, nil
+}
+
+/*
+Load the file and start all the tunnels in it.
+*/
+func StartFile(path string) ([]pinggy.PinggyListener, error) {
+	file, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return file.Start()
+}
@@ -0,0 +1,91 @@
+package tunnelfile_test
+
+import (
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnelfile"
+)
+
+func TestParseFormats(t *testing.T) {
+	inputs := map[tunnelfile.Format]string{
+		tunnelfile.YAML: `
+tunnels:
+  - name: web
+    type: http
+    forwardTo: localhost:3000
+    whitelist: [10.0.0.0/8, 1.2.3.4]
+    basicAuth: [alice:secret]
+  - name: game
+    type: udp
+    udpForwardTo: localhost:7777
+`,
+		tunnelfile.JSON: `{"tunnels": [
+  {"name": "web", "type": "http", "forwardTo": "localhost:3000",
+   "whitelist": ["10.0.0.0/8", "1.2.3.4"], "basicAuth": ["alice:secret"]},
+  {"name": "game", "type": "udp", "udpForwardTo": "localhost:7777"}
+]}`,
+		tunnelfile.TOML: `
+[[tunnels]]
+name = "web"
+type = "http"
+forwardTo = "localhost:3000"
+whitelist = ["10.0.0.0/8", "1.2.3.4"]
+basicAuth = ["alice:secret"]
+
+[[tunnels]]
+name = "game"
+type = "udp"
+udpForwardTo = "localhost:7777"
+`,
+	}
+
+	for format, input := range inputs {
+		file, err := tunnelfile.Parse([]byte(input), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(file.Tunnels) != 2 {
+			t.Fatalf("%s: expected 2 tunnels, found %d", format, len(file.Tunnels))
+		}
+		web, game := file.Tunnels[0].Config, file.Tunnels[1].Config
+		if web.Type != pinggy.HTTP || web.TcpForwardingAddr != "localhost:3000" || len(web.IpWhiteList) != 2 {
+			t.Errorf("%s: unexpected config for web: %+v", format, web)
+		}
+		if web.HeaderManipulationAndAuth == nil {
+			t.Errorf("%s: basic auth not configured", format)
+		}
+		if game.AltType != pinggy.UDP || game.UdpForwardingAddr != "localhost:7777" {
+			t.Errorf("%s: unexpected config for game: %+v", format, game)
+		}
+	}
+}
+
+func TestParseErrorLines(t *testing.T) {
+	inputs := map[tunnelfile.Format]string{
+		tunnelfile.YAML: "tunnels:\n  - name: a\n    type: htp\n  - name: b\n    type: tcp\n    bearerAuth: [key]\n",
+		tunnelfile.JSON: "{\"tunnels\": [\n {\"name\": \"a\",\n  \"type\": \"htp\"},\n {\"name\": \"b\",\n  \"type\": \"tcp\",\n  \"bearerAuth\": [\"key\"]}\n]}\n",
+		tunnelfile.TOML: "[[tunnels]]\nname = \"a\"\ntype = \"htp\"\n[[tunnels]]\nname = \"b\"\ntype = \"tcp\"\nbearerAuth = [\"key\"]\n",
+	}
+	expected := map[tunnelfile.Format][]int{
+		tunnelfile.YAML: {3, 6},
+		tunnelfile.JSON: {3, 6},
+		tunnelfile.TOML: {3, 7},
+	}
+
+	for format, input := range inputs {
+		_, err := tunnelfile.Parse([]byte(input), format)
+		el, ok := err.(tunnelfile.ErrorList)
+		if !ok {
+			t.Fatalf("%s: expected ErrorList, got %v", format, err)
+		}
+		if len(el) != len(expected[format]) {
+			t.Fatalf("%s: unexpected errors: %v", format, el)
+		}
+		for i, line := range expected[format] {
+			if el[i].Line != line {
+				t.Errorf("%s: expected error at line %d, got %v", format, line, el[i])
+			}
+		}
+	}
+}
@@ -2,59 +2,269 @@ package pinggy
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 )
 
 type packet struct {
-	bytes  []byte
-	addr   net.Addr
-	closed bool
+	// bytes is a slice of the pooled buffer buf.
+	buf   *[]byte
+	bytes []byte
+	addr  net.Addr
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, tunnel.MaxDatagramSize+2)
+		return &b
+	},
+}
+
+func (pkt *packet) release() {
+	packetPool.Put(pkt.buf)
+	pkt.buf, pkt.bytes = nil, nil
+}
+
+/*
+UdpFlow describes an active udp flow of a visitor.
+*/
+type UdpFlow struct {
+	// Address of the visitor. ReadFrom returns the same address for its datagrams.
+	Visitor net.Addr
+
+	Started    time.Time
+	LastActive time.Time
+
+	// Datagrams and bytes received from the visitor and sent to it.
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesIn    uint64
+	BytesOut   uint64
 }
 
 type udpTunnel struct {
-	addr net.Addr
-	conn net.Conn
+	// Updated atomically. Kept first for the 64 bit alignment.
+	lastActive int64
+	packetsIn  uint64
+	packetsOut uint64
+	bytesIn    uint64
+	bytesOut   uint64
+
+	addr    net.Addr
+	conn    net.Conn
+	started time.Time
 
-	writeChannel chan []byte
-	closeChannel chan bool
-	closed       bool
+	// Length prefixed frames to be written to conn.
+	writeChannel chan *packet
+	closeChannel chan struct{}
+	closeOnce    sync.Once
 	pfh          *packetForwardingHandler
 }
 
 type packetForwardingHandler struct {
+	// Totals over all the flows. Updated atomically.
+	packetsIn       uint64
+	packetsOut      uint64
+	bytesIn         uint64
+	bytesOut        uint64
+	droppedOversize uint64
+	rejectedFlows   uint64
+
 	list        net.Listener
 	port        uint16
 	readChannel chan *packet
-	tunnels     map[string]udpTunnel
+
+	lock    sync.Mutex
+	tunnels map[string]*udpTunnel
+
+	// closeChannel is closed when the handler stops. closeErr is returned by the
+	// pending and later reads.
+	closeChannel chan struct{}
+	closeOnce    sync.Once
+	closeErr     error
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	idleTimeout time.Duration
+	maxSize     int
+	maxFlows    int
+}
+
+const defaultUdpFlowIdleTimeout = 2 * time.Minute
+
+func newPacketForwardingHandler(list net.Listener, idleTimeout time.Duration, maxSize, maxFlows int) *packetForwardingHandler {
+	if idleTimeout == 0 {
+		idleTimeout = defaultUdpFlowIdleTimeout
+	}
+	if maxSize <= 0 || maxSize > tunnel.MaxDatagramSize {
+		maxSize = tunnel.MaxDatagramSize
+	}
+	return &packetForwardingHandler{
+		list:          list,
+		readChannel:   make(chan *packet, 50),
+		tunnels:       make(map[string]*udpTunnel),
+		closeChannel:  make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		idleTimeout:   idleTimeout,
+		maxSize:       maxSize,
+		maxFlows:      maxFlows,
+	}
+}
+
+/*
+visitorConn carries the visitor address of a flow which is wrapped in socks. The
+address is taken from the socks request.
+*/
+type visitorConn struct {
+	net.Conn
+	visitor net.Addr
+}
+
+func (vc *visitorConn) RemoteAddr() net.Addr { return vc.visitor }
+
+// SocksAddr implements tunnel.SocksConn.
+func (vc *visitorConn) SocksAddr() net.Addr { return vc.visitor }
+
+/*
+visitorAddr returns the udp address of the visitor of a flow, or nil if the server
+did not provide it.
+*/
+func visitorAddr(conn net.Conn) *net.UDPAddr {
+	var addr *net.UDPAddr
+	switch a := conn.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		addr = a
+	case *net.TCPAddr:
+		addr = &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case nil:
+		return nil
+	default:
+		addr, _ = net.ResolveUDPAddr("udp", a.String())
+	}
+	if addr == nil || addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return nil
+	}
+	return addr
+}
+
+/*
+deadline is a deadline which can be waited on with a channel. The channel is
+closed once the deadline passes. It is replaced if the deadline is moved to the
+future again.
+*/
+type deadline struct {
+	lock    sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // wait for the timer to close the channel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.expired)
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(expired) })
+		return
+	}
+
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *udpTunnel) close() {
-	t.closed = true
-	t.closeChannel <- true
-	t.conn.Close()
+	t.closeOnce.Do(func() {
+		close(t.closeChannel)
+		t.conn.Close()
+		t.pfh.removeTunnel(t)
+	})
+}
+
+func (t *udpTunnel) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+func (t *udpTunnel) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActive))
+}
+
+func (t *udpTunnel) flow() UdpFlow {
+	return UdpFlow{
+		Visitor:    t.addr,
+		Started:    t.started,
+		LastActive: t.idleSince(),
+		PacketsIn:  atomic.LoadUint64(&t.packetsIn),
+		PacketsOut: atomic.LoadUint64(&t.packetsOut),
+		BytesIn:    atomic.LoadUint64(&t.bytesIn),
+		BytesOut:   atomic.LoadUint64(&t.bytesOut),
+	}
 }
 
 func (t *udpTunnel) copyToTcp() {
 	defer t.close()
 	for {
 		select {
-		case buffer := <-t.writeChannel:
-			n := len(buffer)
-			if n <= 0 {
-				log.Println("Error")
-				return
-			}
-			lengthBytes := make([]byte, 2)
-			binary.BigEndian.PutUint16(lengthBytes, uint16(n))
-			packet := append(lengthBytes, buffer[:n]...)
+		case pkt := <-t.writeChannel:
+			n := len(pkt.bytes) - 2
 			// fmt.Println("Writing ", n+2, "bytes to TCP")
-			_, err := t.conn.Write(packet)
+			_, err := t.conn.Write(pkt.bytes)
+			pkt.release()
 			if err != nil {
-				log.Println("Error")
+				log.Println("Error while writing to the tunnel:", err)
 				return
 			}
+			t.touch()
+			atomic.AddUint64(&t.packetsOut, 1)
+			atomic.AddUint64(&t.bytesOut, uint64(n))
+			atomic.AddUint64(&t.pfh.packetsOut, 1)
+			atomic.AddUint64(&t.pfh.bytesOut, uint64(n))
 		case <-t.closeChannel:
 			log.Println("Closed")
 			return
@@ -64,73 +274,243 @@ func (t *udpTunnel) copyToTcp() {
 
 func (t *udpTunnel) copyToUdp() {
 	defer t.close()
-	buffer := make([]byte, 2048)
 	for {
-		_, err := io.ReadFull(t.conn, buffer[:2])
-		if err != nil {
-			log.Println("Error")
-			return
+		buf := packetPool.Get().(*[]byte)
+		pkt := &packet{buf: buf, addr: t.addr}
+		length, err := tunnel.ReadDatagram(t.conn, (*buf)[:t.pfh.maxSize])
+		if err == tunnel.ErrDatagramTooLarge {
+			pkt.release()
+			atomic.AddUint64(&t.pfh.droppedOversize, 1)
+			continue
 		}
-
-		// Extract the length information
-		length := binary.BigEndian.Uint16(buffer[:2])
-
-		// Read the rest of the UDP packet
-		_, err = io.ReadFull(t.conn, buffer[:length])
 		if err != nil {
-			log.Println("Error")
+			pkt.release()
 			return
 		}
+		pkt.bytes = (*buf)[:length]
 
 		// fmt.Println("Writing ", length, "bytes to UDP")
 
-		if t.closed {
+		t.touch()
+		atomic.AddUint64(&t.packetsIn, 1)
+		atomic.AddUint64(&t.bytesIn, uint64(length))
+		atomic.AddUint64(&t.pfh.packetsIn, 1)
+		atomic.AddUint64(&t.pfh.bytesIn, uint64(length))
+
+		select {
+		case t.pfh.readChannel <- pkt:
+		case <-t.closeChannel:
+			pkt.release()
+			return
+		case <-t.pfh.closeChannel:
+			pkt.release()
 			return
 		}
-
-		t.pfh.readChannel <- &packet{buffer[:length], t.addr, false} //FIXME
 	}
 }
 
 func (pfh *packetForwardingHandler) startTunnel(conn net.Conn) {
-	pfh.port += 1
-	if pfh.port == 0 {
-		pfh.port += 1
-	}
-	tun := udpTunnel{
+	tun := &udpTunnel{
 		conn:         conn,
-		addr:         &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(pfh.port)}, //FIXME
+		started:      time.Now(),
 		pfh:          pfh,
-		writeChannel: make(chan []byte, 20),
-		closeChannel: make(chan bool, 3),
-		closed:       false,
+		writeChannel: make(chan *packet, 20),
+		closeChannel: make(chan struct{}),
+	}
+	tun.touch()
+
+	pfh.lock.Lock()
+	if addr := visitorAddr(conn); addr != nil {
+		tun.addr = addr
+	} else {
+		// The server did not tell the visitor. Use a local address to tell the flows apart.
+		for {
+			pfh.port += 1
+			if pfh.port == 0 {
+				pfh.port += 1
+			}
+			tun.addr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(pfh.port)}
+			if _, ok := pfh.tunnels[tun.addr.String()]; !ok {
+				break
+			}
+		}
+	}
+	// A new flow from the same visitor replaces the old one.
+	old := pfh.tunnels[tun.addr.String()]
+	if old == nil && pfh.maxFlows > 0 && len(pfh.tunnels) >= pfh.maxFlows {
+		pfh.lock.Unlock()
+		atomic.AddUint64(&pfh.rejectedFlows, 1)
+		log.Println("Rejecting udp flow from", tun.addr, "too many flows")
+		conn.Close()
+		return
 	}
 	pfh.tunnels[tun.addr.String()] = tun
-	log.Println("Starting tunnel")
+	pfh.lock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	log.Println("Starting tunnel for", tun.addr)
 	go tun.copyToTcp()
 	tun.copyToUdp()
 }
 
+/*
+reapIdleFlows closes the flows which have not seen any datagram for the idle timeout.
+*/
+func (pfh *packetForwardingHandler) reapIdleFlows() {
+	if pfh.idleTimeout < 0 {
+		return
+	}
+	interval := pfh.idleTimeout / 4
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-pfh.closeChannel:
+			return
+		}
+		idle := make([]*udpTunnel, 0)
+		pfh.lock.Lock()
+		for _, tun := range pfh.tunnels {
+			if time.Since(tun.idleSince()) >= pfh.idleTimeout {
+				idle = append(idle, tun)
+			}
+		}
+		pfh.lock.Unlock()
+		for _, tun := range idle {
+			log.Println("Closing idle udp flow of", tun.addr)
+			tun.close()
+		}
+	}
+}
+
+func (pfh *packetForwardingHandler) flows() []UdpFlow {
+	pfh.lock.Lock()
+	defer pfh.lock.Unlock()
+	flows := make([]UdpFlow, 0, len(pfh.tunnels))
+	for _, tun := range pfh.tunnels {
+		flows = append(flows, tun.flow())
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Started.Before(flows[j].Started) })
+	return flows
+}
+
+func (pfh *packetForwardingHandler) removeTunnel(tun *udpTunnel) {
+	pfh.lock.Lock()
+	defer pfh.lock.Unlock()
+	if pfh.tunnels[tun.addr.String()] == tun {
+		delete(pfh.tunnels, tun.addr.String())
+	}
+}
+
 func (pfh *packetForwardingHandler) startForwarding() error {
 	log.Println("starting forwarding")
+	go pfh.reapIdleFlows()
 	for {
 		conn, err := pfh.list.Accept()
 		if err != nil {
 			log.Println("Error occured")
-			pfh.readChannel <- &packet{nil, nil, true}
+			pfh.close(io.EOF)
 			return err
 		}
 		go pfh.startTunnel(conn)
 	}
 }
 
-func (pfh *packetForwardingHandler) writeTo(b []byte, addr net.Addr) {
+/*
+close stops the handler. Pending and later reads return err, and all the flows
+are closed.
+*/
+func (pfh *packetForwardingHandler) close(err error) {
+	pfh.closeOnce.Do(func() {
+		pfh.lock.Lock()
+		pfh.closeErr = err
+		tunnels := make([]*udpTunnel, 0, len(pfh.tunnels))
+		for _, tun := range pfh.tunnels {
+			tunnels = append(tunnels, tun)
+		}
+		pfh.lock.Unlock()
+
+		close(pfh.closeChannel)
+		for _, tun := range tunnels {
+			tun.close()
+		}
+	})
+}
+
+func (pfh *packetForwardingHandler) err() error {
+	pfh.lock.Lock()
+	defer pfh.lock.Unlock()
+	return pfh.closeErr
+}
+
+func (pfh *packetForwardingHandler) readFrom(p []byte) (int, net.Addr, error) {
+	if isClosedChan(pfh.closeChannel) {
+		return 0, nil, pfh.err()
+	}
+	select {
+	case pkt := <-pfh.readChannel:
+		n := copy(p, pkt.bytes)
+		pkt.release()
+		return n, pkt.addr, nil
+	case <-pfh.closeChannel:
+		return 0, nil, pfh.err()
+	case <-pfh.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (pfh *packetForwardingHandler) writeTo(b []byte, addr net.Addr) (n int, err error) {
+	if isClosedChan(pfh.closeChannel) {
+		return 0, pfh.err()
+	}
+	if addr == nil {
+		return 0, fmt.Errorf("missing address")
+	}
+	if len(b) > pfh.maxSize {
+		atomic.AddUint64(&pfh.droppedOversize, 1)
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+
+	pfh.lock.Lock()
 	tun, ok := pfh.tunnels[addr.String()]
+	pfh.lock.Unlock()
 	if !ok {
-		return
+		return 0, fmt.Errorf("no active flow for %v", addr)
 	}
-	if tun.closed {
-		return
+
+	// The caller may reuse b as soon as WriteTo returns.
+	buf := packetPool.Get().(*[]byte)
+	pkt := &packet{buf: buf, bytes: (*buf)[:len(b)+2]}
+	binary.BigEndian.PutUint16(pkt.bytes, uint16(len(b)))
+	copy(pkt.bytes[2:], b)
+	select {
+	case tun.writeChannel <- pkt:
+		return len(b), nil
+	case <-tun.closeChannel:
+		err = net.ErrClosed
+	case <-pfh.closeChannel:
+		err = pfh.err()
+	case <-pfh.writeDeadline.wait():
+		err = os.ErrDeadlineExceeded
+	}
+	pkt.release()
+	return 0, err
+}
+
+func (pfh *packetForwardingHandler) stats() tunnel.UdpStats {
+	return tunnel.UdpStats{
+		PacketsIn:       atomic.LoadUint64(&pfh.packetsIn),
+		PacketsOut:      atomic.LoadUint64(&pfh.packetsOut),
+		BytesIn:         atomic.LoadUint64(&pfh.bytesIn),
+		BytesOut:        atomic.LoadUint64(&pfh.bytesOut),
+		DroppedOversize: atomic.LoadUint64(&pfh.droppedOversize),
+		RejectedFlows:   atomic.LoadUint64(&pfh.rejectedFlows),
 	}
-	tun.writeChannel <- b
 }
@@ -0,0 +1,400 @@
+package pinggy_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
+)
+
+func connectUdp(t *testing.T) (*pinggytest.Server, pinggy.PinggyListener) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	conf.AltType = pinggy.UDP
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pl.Close() })
+	return srv, pl
+}
+
+func TestUdpPacketConn(t *testing.T) {
+	srv, pl := connectUdp(t)
+
+	pl.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := pl.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	pl.SetReadDeadline(time.Time{})
+
+	visitor, err := srv.Tunnels()[0].DialUDP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	visitor.Write([]byte("ping"))
+
+	buf := make([]byte, 100)
+	n, addr, err := pl.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	if host, _, _ := net.SplitHostPort(addr.String()); host != pinggytest.DefaultVisitorIP {
+		t.Fatalf("unexpected visitor address %v", addr)
+	}
+	n, err = pl.WriteTo([]byte("pong!"), addr)
+	if err != nil || n != 5 {
+		t.Fatalf("write returned %d %v", n, err)
+	}
+	n, err = visitor.Read(buf)
+	if err != nil || string(buf[:n]) != "pong!" {
+		t.Fatalf("visitor read %q %v", buf[:n], err)
+	}
+
+	large := make([]byte, 50000)
+	visitor.Write(large)
+	n, _, err = pl.ReadFrom(large)
+	if err != nil || n != len(large) {
+		t.Fatalf("read %d bytes of a large datagram, %v", n, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := pl.ReadFrom(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pl.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected closed error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock ReadFrom")
+	}
+}
+
+func TestUdpFlows(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conf := srv.Config()
+	conf.AltType = pinggy.UDP
+	conf.UdpFlowIdleTimeout = 200 * time.Millisecond
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	visitor, err := srv.Tunnels()[0].DialUDP("203.0.113.7:4500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	visitor.Write([]byte("hello"))
+
+	buf := make([]byte, 100)
+	_, addr, err := pl.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "203.0.113.7:4500" {
+		t.Fatalf("unexpected visitor address %v", addr)
+	}
+	flows := pl.UdpFlows()
+	if len(flows) != 1 || flows[0].Visitor.String() != addr.String() || flows[0].BytesIn != 5 {
+		t.Fatalf("unexpected flows %+v", flows)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(pl.UdpFlows()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow was not closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestUdpLargeDatagrams(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conf := srv.Config()
+	conf.AltType = pinggy.UDP
+	conf.UdpForwardingAddr = echo.LocalAddr().String()
+	conf.UdpMaxDatagramSize = 60000
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go pl.StartForwarding()
+
+	visitor, err := srv.Tunnels()[0].DialUDP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	visitor.Write(make([]byte, 60001))
+	large := make([]byte, 60000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	visitor.Write(large)
+
+	buf := make([]byte, 65535)
+	n, err := visitor.Read(buf)
+	if err != nil || n != len(large) || buf[n-1] != large[n-1] {
+		t.Fatalf("echo of %d bytes returned %d bytes, %v", len(large), n, err)
+	}
+	if stats := pl.UdpStats(); stats.DroppedOversize != 1 || stats.PacketsIn != 1 || stats.BytesOut != 60000 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUdpForwardingReplyFromOtherPort(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The local server receives on one socket and replies from another one.
+	recv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	reply, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := recv.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conf := srv.Config()
+	conf.AltType = pinggy.UDP
+	conf.UdpForwardingAddr = recv.LocalAddr().String()
+	conf.UdpMaxFlows = 1
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go pl.StartForwarding()
+
+	visitor, err := srv.Tunnels()[0].DialUDP("203.0.113.9:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	visitor.Write([]byte("hello"))
+	buf := make([]byte, 100)
+	n, err := visitor.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("visitor read %q %v", buf[:n], err)
+	}
+
+	flows := pl.UdpFlows()
+	if len(flows) != 1 || flows[0].Visitor.String() != "203.0.113.9:7000" {
+		t.Fatalf("unexpected flows %+v", flows)
+	}
+
+	second, err := srv.Tunnels()[0].DialUDP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(buf); err == nil {
+		t.Fatal("flow over the limit was not rejected")
+	}
+	if stats := pl.UdpStats(); stats.RejectedFlows != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestUdpForwardingWithoutHost(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The local server listens on all the interfaces, as the target has no host.
+	echo, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	conf := srv.Config()
+	conf.AltType = pinggy.UDP
+	conf.UdpForwardingAddr = fmt.Sprintf(":%d", echo.LocalAddr().(*net.UDPAddr).Port)
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go pl.StartForwarding()
+
+	visitor, err := srv.Tunnels()[0].DialUDP("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	visitor.Write([]byte("hello"))
+	buf := make([]byte, 100)
+	n, err := visitor.Read(buf)
+	if err != nil || string(buf[:n]) != "echo:hello" {
+		t.Fatalf("visitor read %q %v", buf[:n], err)
+	}
+}
+
+// namedEcho starts an udp server which echoes the datagrams prefixed with its name.
+func namedEcho(t *testing.T, name string) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUdpForwardingRules(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	game := namedEcho(t, "game")
+	voice := namedEcho(t, "voice")
+	_, lan, _ := net.ParseCIDR("203.0.113.0/24")
+
+	conf := srv.Config()
+	conf.AltType = pinggy.UDP
+	conf.UdpForwardingAddr = game
+	conf.UdpForwardingRules = []tunnel.UdpRule{{Target: voice, Visitors: lan}}
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go pl.StartForwarding()
+
+	exchange := func(visitor, msg string) string {
+		conn, err := srv.Tunnels()[0].DialUDP(visitor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(msg))
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	if reply := exchange("203.0.113.5:4000", "hi"); reply != "voice:hi" {
+		t.Fatalf("visitor rule: %q", reply)
+	}
+	if reply := exchange("", "hi"); reply != "game:hi" {
+		t.Fatalf("default target: %q", reply)
+	}
+
+	// Changing the address keeps the rules.
+	if err := pl.UpdateUdpForwarding(game); err != nil {
+		t.Fatal(err)
+	}
+	if reply := exchange("203.0.113.5:4000", "hi"); reply != "voice:hi" {
+		t.Fatalf("kept rule: %q", reply)
+	}
+
+	err = pl.SetUdpForwardingRules(tunnel.UdpRule{
+		Target:   voice,
+		Classify: func(visitor net.Addr, first []byte) bool { return bytes.HasPrefix(first, []byte("rtp")) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := exchange("", "rtp1"); reply != "voice:rtp1" {
+		t.Fatalf("classifier rule: %q", reply)
+	}
+	if reply := exchange("203.0.113.5:4001", "hi"); reply != "game:hi" {
+		t.Fatalf("replaced rules: %q", reply)
+	}
+}
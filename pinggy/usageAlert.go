@@ -0,0 +1,342 @@
+package pinggy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Usage of a tunnel as reported by the server through the usages stream.
+*/
+type Usage struct {
+	// Time in seconds since the tunnel was created.
+	ElapsedTime int64 `json:"elapsedTime"`
+
+	NumLiveConnections  int64 `json:"numLiveConnections"`
+	NumTotalConnections int64 `json:"numTotalConnections"`
+	NumTotalReqBytes    int64 `json:"numTotalReqBytes"`
+	NumTotalResBytes    int64 `json:"numTotalResBytes"`
+	NumTotalTxBytes     int64 `json:"numTotalTxBytes"`
+}
+
+/*
+Parse a line received from the usages stream (SetUsagesUpdateListener, LongPollUsages
+or GetCurUsages).
+*/
+func ParseUsage(line string) (*Usage, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, fmt.Errorf("empty usage line")
+	}
+	usage := &Usage{}
+	err := json.Unmarshal([]byte(line), usage)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+/*
+Total bytes transferred through the tunnel. Http tunnels report request and
+response bytes separately, other tunnels report only the transmitted bytes.
+*/
+func (u *Usage) BandwidthUsed() int64 {
+	total := u.NumTotalReqBytes + u.NumTotalResBytes
+	if u.NumTotalTxBytes > total {
+		return u.NumTotalTxBytes
+	}
+	return total
+}
+
+/*
+Elapsed time as a time.Duration.
+*/
+func (u *Usage) Elapsed() time.Duration {
+	return time.Duration(u.ElapsedTime) * time.Second
+}
+
+type UsageAlertType string
+
+const (
+	UsageAlert_TimeRemaining    UsageAlertType = "timeRemaining"
+	UsageAlert_BandwidthUsed    UsageAlertType = "bandwidthUsed"
+	UsageAlert_LiveConnections  UsageAlertType = "liveConnections"
+	UsageAlert_TotalConnections UsageAlertType = "totalConnections"
+	UsageAlert_Reconnected      UsageAlertType = "reconnected"
+)
+
+/*
+UsageAlert is passed to the callback and posted to the webhook when a threshold is crossed.
+*/
+type UsageAlert struct {
+	Type UsageAlertType `json:"type"`
+
+	// Threshold and the value that crossed it. Durations are in seconds and
+	// bandwidth is in bytes.
+	Threshold int64 `json:"threshold"`
+	Value     int64 `json:"value"`
+
+	Usage Usage     `json:"usage"`
+	Time  time.Time `json:"time"`
+
+	// Error is set only for UsageAlert_Reconnected when the reconnect failed.
+	Error string `json:"error,omitempty"`
+}
+
+type UsageAlertConfig struct {
+	/*
+		Lifetime of the tunnel. Annonymous and free tunnels expire after a fixed time
+		(60 minutes at the time of writing). TimeRemaining and ReconnectBefore are
+		effective only if it is set.
+	*/
+	TunnelLifetime time.Duration
+
+	/*
+		Raise an alert once the remaining time goes below this value. Zero disables it.
+	*/
+	TimeRemaining time.Duration
+
+	/*
+		Raise an alert once the total bytes transferred goes above this value. Zero disables it.
+	*/
+	BandwidthUsed int64
+
+	/*
+		Raise an alert once the number of live connections goes above this value.
+		The alert is raised again after the number drops below the threshold
+		and crosses it again. Zero disables it.
+	*/
+	LiveConnections int64
+
+	/*
+		Raise an alert once the total number of connections goes above this value. Zero disables it.
+	*/
+	TotalConnections int64
+
+	/*
+		Callback for the alerts. It is called from the goroutine reading the usages, so
+		it should not block.
+	*/
+	OnAlert func(UsageAlert)
+
+	/*
+		Alerts are posted as json to this url if it is not empty. Eg. http://localhost:9000/alerts
+	*/
+	WebhookUrl string
+
+	/*
+		Time allowed for a webhook post. Default is 10 seconds.
+	*/
+	WebhookTimeout time.Duration
+
+	/*
+		Reconnect the tunnel proactively when remaining time goes below this value.
+		Zero disables it. A UsageAlert_Reconnected alert is raised after the attempt.
+		A failed attempt is retried with an increasing delay, up to 30 seconds.
+	*/
+	ReconnectBefore time.Duration
+
+	/*
+		Logger for errors. If Logger is `nil`, we use the default Logger.
+	*/
+	Logger *log.Logger
+}
+
+/*
+UsageAlerter watches the usages stream of a tunnel and raises alerts. It implements
+PinggyUsagesUpdateListener.
+*/
+type UsageAlerter struct {
+	pl     PinggyListener
+	conf   UsageAlertConfig
+	client *http.Client
+
+	lock         sync.Mutex
+	raised       map[UsageAlertType]bool
+	lastUsage    *Usage
+	reconnecting bool
+
+	// A failed reconnect is not retried before nextReconnect. The delay doubles
+	// with each failure.
+	reconnectDelay time.Duration
+	nextReconnect  time.Time
+}
+
+/*
+Start watching usages of the tunnel and raise alerts as configured. It replaces any
+usages update listener already set on the tunnel.
+*/
+func WatchUsages(pl PinggyListener, conf UsageAlertConfig) (*UsageAlerter, error) {
+	if conf.Logger == nil {
+		conf.Logger = log.Default()
+	}
+	if conf.WebhookTimeout <= 0 {
+		conf.WebhookTimeout = 10 * time.Second
+	}
+	ua := &UsageAlerter{
+		pl:     pl,
+		conf:   conf,
+		client: &http.Client{Timeout: conf.WebhookTimeout},
+		raised: make(map[UsageAlertType]bool),
+	}
+	err := pl.SetUsagesUpdateListener(ua)
+	if err != nil {
+		return nil, err
+	}
+	return ua, nil
+}
+
+/*
+Stop watching usages.
+*/
+func (ua *UsageAlerter) Stop() error {
+	return ua.pl.SetUsagesUpdateListener(nil)
+}
+
+/*
+Last usage received from the server. It returns nil if nothing received yet.
+*/
+func (ua *UsageAlerter) LastUsage() *Usage {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+	if ua.lastUsage == nil {
+		return nil
+	}
+	usage := *ua.lastUsage
+	return &usage
+}
+
+func (ua *UsageAlerter) Update(line string) {
+	usage, err := ParseUsage(line)
+	if err != nil {
+		ua.conf.Logger.Println("Could not parse usage:", err)
+		return
+	}
+
+	var alerts []UsageAlert
+	reconnect := false
+
+	ua.lock.Lock()
+	if ua.lastUsage != nil && usage.ElapsedTime < ua.lastUsage.ElapsedTime {
+		// It is a new tunnel. Probably after reconnect.
+		ua.raised = make(map[UsageAlertType]bool)
+	}
+	ua.lastUsage = usage
+
+	if ua.conf.TunnelLifetime > 0 {
+		remaining := ua.conf.TunnelLifetime - usage.Elapsed()
+		if ua.conf.TimeRemaining > 0 {
+			alerts = ua.check(alerts, usage, UsageAlert_TimeRemaining,
+				remaining <= ua.conf.TimeRemaining, int64(ua.conf.TimeRemaining.Seconds()), int64(remaining.Seconds()))
+		}
+		if ua.conf.ReconnectBefore > 0 && remaining <= ua.conf.ReconnectBefore &&
+			!ua.reconnecting && !time.Now().Before(ua.nextReconnect) {
+			ua.reconnecting = true
+			reconnect = true
+		}
+	}
+	if ua.conf.BandwidthUsed > 0 {
+		alerts = ua.check(alerts, usage, UsageAlert_BandwidthUsed,
+			usage.BandwidthUsed() >= ua.conf.BandwidthUsed, ua.conf.BandwidthUsed, usage.BandwidthUsed())
+	}
+	if ua.conf.LiveConnections > 0 {
+		alerts = ua.check(alerts, usage, UsageAlert_LiveConnections,
+			usage.NumLiveConnections >= ua.conf.LiveConnections, ua.conf.LiveConnections, usage.NumLiveConnections)
+	}
+	if ua.conf.TotalConnections > 0 {
+		alerts = ua.check(alerts, usage, UsageAlert_TotalConnections,
+			usage.NumTotalConnections >= ua.conf.TotalConnections, ua.conf.TotalConnections, usage.NumTotalConnections)
+	}
+	ua.lock.Unlock()
+
+	for _, alert := range alerts {
+		ua.raise(alert)
+	}
+
+	if reconnect {
+		// Reconnect closes the connection this update is coming from.
+		go ua.reconnect(*usage)
+	}
+}
+
+// check appends an alert when the condition becomes true. The alert is rearmed once the condition becomes false.
+func (ua *UsageAlerter) check(alerts []UsageAlert, usage *Usage, typ UsageAlertType, crossed bool, threshold, value int64) []UsageAlert {
+	if !crossed {
+		ua.raised[typ] = false
+		return alerts
+	}
+	if ua.raised[typ] {
+		return alerts
+	}
+	ua.raised[typ] = true
+	return append(alerts, UsageAlert{
+		Type:      typ,
+		Threshold: threshold,
+		Value:     value,
+		Usage:     *usage,
+		Time:      time.Now(),
+	})
+}
+
+func (ua *UsageAlerter) reconnect(usage Usage) {
+	alert := UsageAlert{Type: UsageAlert_Reconnected, Usage: usage}
+	err := ua.pl.Reconnect()
+	if err != nil {
+		ua.conf.Logger.Println("Proactive reconnect failed:", err)
+		alert.Error = err.Error()
+	}
+	alert.Time = time.Now()
+
+	ua.lock.Lock()
+	ua.reconnecting = false
+	if err == nil {
+		ua.lastUsage = nil
+		ua.raised = make(map[UsageAlertType]bool)
+		ua.reconnectDelay = 0
+		ua.nextReconnect = time.Time{}
+	} else {
+		ua.reconnectDelay *= 2
+		if ua.reconnectDelay < minReconnectDelay {
+			ua.reconnectDelay = minReconnectDelay
+		}
+		if ua.reconnectDelay > maxReconnectDelay {
+			ua.reconnectDelay = maxReconnectDelay
+		}
+		ua.nextReconnect = alert.Time.Add(ua.reconnectDelay)
+	}
+	ua.lock.Unlock()
+
+	ua.raise(alert)
+}
+
+func (ua *UsageAlerter) raise(alert UsageAlert) {
+	if ua.conf.OnAlert != nil {
+		ua.conf.OnAlert(alert)
+	}
+	if ua.conf.WebhookUrl != "" {
+		go ua.post(alert)
+	}
+}
+
+func (ua *UsageAlerter) post(alert UsageAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		ua.conf.Logger.Println("Could not marshal alert:", err)
+		return
+	}
+	resp, err := ua.client.Post(ua.conf.WebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		ua.conf.Logger.Println("Could not post alert:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		ua.conf.Logger.Printf("Alert webhook returned status: %d\n", resp.StatusCode)
+	}
+}
@@ -0,0 +1,244 @@
+package pinggy_test
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+)
+
+type usageLines chan string
+
+func (ul usageLines) Update(line string) { ul <- line }
+
+func TestUsagesListenerReplaced(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	// Clearing and setting the listener again must not leave two streams behind.
+	lines := make(usageLines, 10)
+	for _, listener := range []pinggy.PinggyUsagesUpdateListener{lines, nil, lines} {
+		if err := pl.SetUsagesUpdateListener(listener); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	for len(lines) > 0 {
+		<-lines
+	}
+
+	srv.Tunnels()[0].SetUsage(pinggy.Usage{ElapsedTime: 10, NumTotalTxBytes: 1234})
+	select {
+	case <-lines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("usage update not received")
+	}
+	select {
+	case line := <-lines:
+		t.Fatalf("usage update delivered twice: %q", line)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatchUsages(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	// New connections are refused while the proxy is down, the current one is kept.
+	proxy := newDownProxy(t, srv.Addr)
+
+	conf := srv.Config()
+	conf.Server = proxy.Addr().String()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	alerts := make(chan pinggy.UsageAlert, 10)
+	ua, err := pinggy.WatchUsages(pl, pinggy.UsageAlertConfig{
+		TunnelLifetime:  time.Hour,
+		BandwidthUsed:   1000,
+		ReconnectBefore: 5 * time.Minute,
+		OnAlert:         func(alert pinggy.UsageAlert) { alerts <- alert },
+		Logger:          log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Stop()
+
+	next := func() pinggy.UsageAlert {
+		select {
+		case alert := <-alerts:
+			return alert
+		case <-time.After(5 * time.Second):
+			t.Fatal("no alert raised")
+		}
+		return pinggy.UsageAlert{}
+	}
+
+	tunnel := srv.Tunnels()[0]
+	tunnel.SetUsage(pinggy.Usage{ElapsedTime: 60, NumTotalTxBytes: 1234})
+	if alert := next(); alert.Type != pinggy.UsageAlert_BandwidthUsed || alert.Value != 1234 {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+
+	// A failed reconnect is not retried on every usage update.
+	atomic.StoreInt32(&proxy.down, 1)
+	tunnel.SetUsage(pinggy.Usage{ElapsedTime: 3500, NumTotalTxBytes: 1234})
+	if alert := next(); alert.Type != pinggy.UsageAlert_Reconnected || alert.Error == "" {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	for i := int64(1); i <= 5; i++ {
+		tunnel.SetUsage(pinggy.Usage{ElapsedTime: 3500 + i, NumTotalTxBytes: 1234})
+	}
+	select {
+	case alert := <-alerts:
+		t.Fatalf("reconnect retried at once: %+v", alert)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// After the delay it is tried again and succeeds.
+	atomic.StoreInt32(&proxy.down, 0)
+	time.Sleep(time.Second)
+	tunnel.SetUsage(pinggy.Usage{ElapsedTime: 3510, NumTotalTxBytes: 1234})
+	if alert := next(); alert.Type != pinggy.UsageAlert_Reconnected || alert.Error != "" {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	// The server drops the old connection asynchronously.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tunnels := srv.Tunnels()
+		if len(tunnels) == 1 && tunnels[0] != tunnel {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not replaced")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// logLines passes every line logged to it to the channel.
+type logLines chan string
+
+func (ll logLines) Write(p []byte) (int, error) {
+	ll <- string(p)
+	return len(p), nil
+}
+
+func TestUsageAlertWebhook(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conf := srv.Config()
+	conf.Type = pinggy.TCP
+	conf.Logger = log.New(io.Discard, "", 0)
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	var status int32 = http.StatusOK
+	posted := make(chan pinggy.UsageAlert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		var alert pinggy.UsageAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("invalid alert body: %v", err)
+		}
+		posted <- alert
+		code := int(atomic.LoadInt32(&status))
+		if code == 0 {
+			// Never answers in time.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.WriteHeader(code)
+	}))
+	defer hook.Close()
+
+	logs := make(logLines, 10)
+	ua, err := pinggy.WatchUsages(pl, pinggy.UsageAlertConfig{
+		LiveConnections: 5,
+		WebhookUrl:      hook.URL,
+		WebhookTimeout:  200 * time.Millisecond,
+		Logger:          log.New(logs, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Stop()
+
+	tunnel := srv.Tunnels()[0]
+	// raise crosses the threshold and rearms the alert for the next call.
+	raise := func() pinggy.UsageAlert {
+		tunnel.SetUsage(pinggy.Usage{NumLiveConnections: 7})
+		select {
+		case alert := <-posted:
+			tunnel.SetUsage(pinggy.Usage{NumLiveConnections: 0})
+			return alert
+		case <-time.After(5 * time.Second):
+			t.Fatal("alert was not posted")
+		}
+		return pinggy.UsageAlert{}
+	}
+	logged := func(want string) {
+		select {
+		case line := <-logs:
+			if !strings.Contains(line, want) {
+				t.Fatalf("logged %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not logged", want)
+		}
+	}
+
+	if alert := raise(); alert.Type != pinggy.UsageAlert_LiveConnections || alert.Threshold != 5 || alert.Value != 7 {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	select {
+	case line := <-logs:
+		t.Fatalf("successful post logged %q", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	raise()
+	logged("status: 500")
+
+	atomic.StoreInt32(&status, 0)
+	raise()
+	logged("Could not post alert")
+}
@@ -0,0 +1,292 @@
+/*
+Package webhooktest receives webhooks through a pinggy tunnel in integration tests.
+
+It is analogous to httptest.Server, except that the server is reachable from the
+internet through an http tunnel. Every request is recorded in memory so that the
+test can wait for the webhook and inspect it.
+
+	wh, err := webhooktest.NewServer(pinggy.Config{Token: token})
+	defer wh.Close()
+
+	registerWebhook(wh.URL + "/hook")
+	req, err := wh.WaitForRequest(ctx, webhooktest.MatchPath("/hook"))
+*/
+package webhooktest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+/*
+Request is a recorded incoming request.
+*/
+type Request struct {
+	Method string
+
+	// Url with the path and query of the request.
+	URL    *url.URL
+	Host   string
+	Header http.Header
+	Body   []byte
+
+	// RemoteAddr of the connection as seen through the tunnel.
+	RemoteAddr string
+
+	// VisitorIP is the first address of X-Forwarded-For if present, otherwise the
+	// ip of RemoteAddr.
+	VisitorIP string
+
+	Received time.Time
+}
+
+/*
+Response scripted for a path.
+*/
+type Response struct {
+	// Default is 200.
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+/*
+Matcher selects requests in WaitForRequest.
+*/
+type Matcher func(*Request) bool
+
+/*
+Match the requests with the path.
+*/
+func MatchPath(path string) Matcher {
+	return func(r *Request) bool { return r.URL.Path == path }
+}
+
+/*
+Match the requests with the method, such as POST.
+*/
+func MatchMethod(method string) Matcher {
+	return func(r *Request) bool { return strings.EqualFold(r.Method, method) }
+}
+
+/*
+Match the requests with a header having the value.
+*/
+func MatchHeader(name, value string) Matcher {
+	return func(r *Request) bool {
+		for _, v := range r.Header.Values(name) {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+/*
+Match the requests matching all the matchers.
+*/
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(r *Request) bool {
+		for _, m := range matchers {
+			if !m(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+/*
+Server records the requests received through an http tunnel.
+*/
+type Server struct {
+	// Public url of the tunnel without a trailing slash. The https url is used
+	// when the tunnel provides one.
+	URL string
+
+	// Urls of the tunnel as returned by RemoteUrls.
+	URLs []string
+
+	// Listener is the underlying tunnel.
+	Listener pinggy.PinggyListener
+
+	httpServer *http.Server
+
+	lock      sync.Mutex
+	requests  []*Request
+	responses map[string][]Response
+	notify    chan struct{} // closed and replaced on every new request
+}
+
+/*
+Open an http tunnel with the config and start recording the requests. The tunnel
+type is always HTTP. Use the Config of a pinggytest.Server to run it offline.
+*/
+func NewServer(conf pinggy.Config) (*Server, error) {
+	conf.Type = pinggy.HTTP
+	conf.AltType = ""
+	conf.TcpForwardingAddr = ""
+	conf.UdpForwardingAddr = ""
+
+	pl, err := pinggy.ConnectWithConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := pl.RemoteUrls2()
+	if err != nil || len(urls) == 0 {
+		pl.Close()
+		return nil, fmt.Errorf("could not get the tunnel url: %v", err)
+	}
+
+	s := &Server{
+		URLs:      urls,
+		Listener:  pl,
+		responses: make(map[string][]Response),
+		notify:    make(chan struct{}),
+	}
+	s.URL = strings.TrimSuffix(urls[0], "/")
+	for _, u := range urls {
+		if strings.HasPrefix(u, "https://") {
+			s.URL = strings.TrimSuffix(u, "/")
+		}
+	}
+
+	s.httpServer = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	go s.httpServer.Serve(pl)
+
+	return s, nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	req := &Request{
+		Method:     r.Method,
+		URL:        &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:       r.Host,
+		Header:     r.Header.Clone(),
+		Body:       body,
+		RemoteAddr: r.RemoteAddr,
+		Received:   time.Now(),
+	}
+	req.VisitorIP = visitorIP(r)
+
+	s.lock.Lock()
+	s.requests = append(s.requests, req)
+	close(s.notify)
+	s.notify = make(chan struct{})
+	res := Response{StatusCode: http.StatusOK}
+	if scripted := s.responses[r.URL.Path]; len(scripted) > 0 {
+		res = scripted[0]
+		if len(scripted) > 1 {
+			s.responses[r.URL.Path] = scripted[1:]
+		}
+	}
+	s.lock.Unlock()
+
+	for name, values := range res.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+func visitorIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+Respond scripts the responses for a path. Requests to the path get the responses
+in the given order and the last one is repeated. Paths without a script get an
+empty 200 response.
+*/
+func (s *Server) Respond(path string, responses ...Response) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(responses) == 0 {
+		delete(s.responses, path)
+		return
+	}
+	s.responses[path] = append([]Response{}, responses...)
+}
+
+/*
+Requests returns all the requests recorded so far.
+*/
+func (s *Server) Requests() []*Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Request{}, s.requests...)
+}
+
+/*
+Reset forgets the recorded requests. Scripted responses are kept.
+*/
+func (s *Server) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = nil
+}
+
+/*
+WaitForRequest returns the first recorded request matching the matcher, including
+the ones received before the call. It waits until such a request is received or
+the context is done. A nil matcher matches any request.
+*/
+func (s *Server) WaitForRequest(ctx context.Context, matcher Matcher) (*Request, error) {
+	checked := 0
+	for {
+		s.lock.Lock()
+		requests := s.requests
+		notify := s.notify
+		s.lock.Unlock()
+
+		if checked > len(requests) {
+			// Reset was called.
+			checked = 0
+		}
+		for ; checked < len(requests); checked++ {
+			if matcher == nil || matcher(requests[checked]) {
+				return requests[checked], nil
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+Close the tunnel.
+*/
+func (s *Server) Close() error {
+	err := s.Listener.Close()
+	s.httpServer.Close()
+	return err
+}
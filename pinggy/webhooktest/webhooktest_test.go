@@ -0,0 +1,68 @@
+package webhooktest_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/pinggytest"
+	"github.com/Pinggy-io/pinggy-go/pinggy/webhooktest"
+)
+
+func TestWebhook(t *testing.T) {
+	srv := pinggytest.NewUnstartedServer()
+	srv.Logger = log.New(io.Discard, "", 0)
+	srv.Start()
+	defer srv.Close()
+
+	conf := srv.Config()
+	conf.Logger = log.New(io.Discard, "", 0)
+	wh, err := webhooktest.NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+
+	wh.Respond("/hook", webhooktest.Response{StatusCode: http.StatusAccepted, Body: []byte("first")}, webhooktest.Response{Body: []byte("rest")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := srv.HTTPClient()
+	go func() {
+		client.Get(wh.URL + "/other")
+		res, err := client.Post(wh.URL+"/hook?id=1", "application/json", strings.NewReader(`{"event":"push"}`))
+		if err == nil {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusAccepted || string(body) != "first" {
+				t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+			}
+		}
+	}()
+
+	req, err := wh.WaitForRequest(ctx, webhooktest.MatchAll(webhooktest.MatchMethod("POST"), webhooktest.MatchPath("/hook")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Body) != `{"event":"push"}` || req.URL.Query().Get("id") != "1" || req.VisitorIP != pinggytest.DefaultVisitorIP {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	res, err := client.Get(wh.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "rest" {
+		t.Fatalf("unexpected scripted response: %s", body)
+	}
+	if n := len(wh.Requests()); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}